@@ -0,0 +1,346 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"patchfiles/generator"
+	"patchfiles/local"
+	"patchfiles/parser"
+	"patchfiles/remote"
+)
+
+// remoteOptions configures running the patch script on hosts over SSH.
+type remoteOptions struct {
+	hosts          string        // File with one [user@]host[:port] per line
+	vars           repeatedList  // KEY=VALUE variables exported to the script
+	user           string        // Login user for hosts without one
+	port           int           // SSH port for hosts without one
+	identities     repeatedList  // Private key files
+	knownHosts     string        // known_hosts file
+	insecureHosts  bool          // Accept any host key
+	concurrency    int           // Number of hosts worked on at the same time
+	timeout        time.Duration // Time limit per host
+	connectTimeout time.Duration // Time limit for establishing a connection
+	sudo           bool          // Run the script with sudo
+}
+
+// register adds the remote flags to a flag set.
+func (o *remoteOptions) register(cmd *Command) {
+	defaultUser := envOr("USER", "root")
+	if current, err := user.Current(); err == nil {
+		defaultUser = current.Username
+	}
+
+	cmd.Flags.StringVar(&o.hosts, "hosts", "", "file with one [user@]host[:port] per line to run the script on over SSH, this host when empty")
+	cmd.Flags.Var(&o.vars, "var", "KEY=VALUE exported to the script on every host, repeatable, e.g. PATCHFILES_SYSLOG=1")
+	cmd.Flags.StringVar(&o.user, "user", defaultUser, "SSH user for hosts without one")
+	cmd.Flags.IntVar(&o.port, "port", 22, "SSH port for hosts without one")
+	cmd.Flags.Var(&o.identities, "identity", "private key file, repeatable, defaults to ssh-agent and ~/.ssh/id_*")
+	cmd.Flags.StringVar(&o.knownHosts, "known-hosts", "", "known_hosts file to verify host keys, defaults to ~/.ssh/known_hosts")
+	cmd.Flags.BoolVar(&o.insecureHosts, "insecure-ignore-host-key", false, "accept any host key, only for throwaway machines")
+	cmd.Flags.IntVar(&o.concurrency, "concurrency", 10, "number of hosts patched at the same time")
+	cmd.Flags.DurationVar(&o.timeout, "timeout", 10*time.Minute, "time limit per host")
+	cmd.Flags.DurationVar(&o.connectTimeout, "connect-timeout", 10*time.Second, "time limit for connecting to a host")
+	cmd.Flags.BoolVar(&o.sudo, "sudo", false, "run the script with 'sudo -n' when logging in as a non-root user")
+}
+
+// newApplyCommand returns the command that applies patches on this host or on remote hosts.
+func newApplyCommand() *Command {
+	return newPatchCommand("apply", "applied", "Apply selected patches on this host, or on many hosts over SSH with -hosts.")
+}
+
+// newRevertCommand returns the command that reverts patches on this host or on remote hosts.
+func newRevertCommand() *Command {
+	return newPatchCommand("revert", "reverted", "Revert selected patches on this host, or on many hosts over SSH with -hosts.")
+}
+
+// newPatchCommand returns the apply or revert command. Both run natively on this host, or stream the
+// generated patch or revert script to remote hosts.
+func newPatchCommand(name, done, summary string) *Command {
+	var (
+		input       inputOptions
+		metadata    metadataOptions
+		remoteHosts remoteOptions
+		root        string
+		environment string
+		format      string
+		yes         bool
+		confirm     bool
+	)
+
+	cmd := newCommand(name, "[selector...]", summary)
+	cmd.Help = `Selectors are patch names, short names or categories and default to all patches. On this host
+the patches are ` + done + ` natively with the semantics of the generated scripts: backups, append
+blocks, the commands before and after, the assertions and the control file. With -hosts, a script
+with only the selected patches is generated and streamed to every host like
+"ssh host 'bash -s' < script.sh". The command fails when a patch or an assertion fails, or when the
+script fails on any host. Risky patches applied with -hosts are reverted on every host unless
+"apply -hosts <file> -confirm" cancels their rollback from a new connection.`
+	input.register(cmd)
+	metadata.register(cmd)
+	remoteHosts.register(cmd)
+	cmd.Flags.StringVar(&root, "root", envOr("PATCHFILES_ROOT", "/"), "root filesystem to patch on this host (env PATCHFILES_ROOT)")
+	cmd.Flags.StringVar(&environment, "environment", envOr("ENVIRONMENT", "dev"), "environment written in the script header (env ENVIRONMENT)")
+	cmd.Flags.StringVar(&format, "format", "table", "report format: table, json or yaml")
+	if name == "apply" {
+		cmd.Flags.BoolVar(&yes, "yes", false, "apply high-risk patches, which all leaves out and a selector by name or category refuses without it")
+		cmd.Flags.BoolVar(&confirm, "confirm", false, "confirm the risky patches applied with -hosts, cancelling their rollback on every host")
+	}
+
+	cmd.Run = func(app *App, args []string) error {
+		if format != "table" && format != "json" && format != "yaml" {
+			return usageError{fmt.Errorf("unknown format %q", format)}
+		}
+
+		gen := generator.Generator{
+			Log:         app.Log,
+			Environment: strings.ToLower(environment),
+			Author:      metadata.author,
+			Version:     metadata.version,
+		}
+
+		if confirm {
+			if remoteHosts.hosts == "" || len(args) > 0 {
+				return usageError{errors.New("-confirm takes -hosts and no selectors, run './patch.sh confirm' on this host")}
+			}
+
+			// the confirm action of the patch script needs none of its patches
+			script, _, err := gen.Render(nil)
+			if err != nil {
+				return err
+			}
+			return remoteHosts.run(app, script, []string{"confirm"}, format)
+		}
+
+		results, err := input.loadValid(app)
+		if err != nil {
+			return err
+		}
+
+		selected := selectPatches(results, args)
+		if len(selected) == 0 {
+			return fmt.Errorf("no patch matches %v", args)
+		}
+		if name == "apply" && !yes {
+			selected, err = leaveOutHighRisk(app, selected, args)
+			if err != nil {
+				return err
+			}
+		}
+
+		if remoteHosts.hosts == "" {
+			return runLocal(app, name, selected, root, format)
+		}
+
+		patch, revert, err := gen.Render(selected)
+		if err != nil {
+			return err
+		}
+
+		if name == "revert" {
+			return remoteHosts.run(app, revert, []string{"all"}, format)
+		}
+
+		// the script is not stored on the hosts, so the rollback of risky patches is confirmed from here
+		var risky []string
+		for _, r := range selected {
+			if r.Patch.Risky {
+				risky = append(risky, r.Name)
+			}
+		}
+		if len(risky) > 0 && !slices.Contains(remoteHosts.vars.values, "PATCHFILES_ROLLBACK_MINUTES=0") {
+			command := fmt.Sprintf("patchfiles apply -hosts %s -confirm", remoteHosts.hosts)
+			remoteHosts.vars.values = append(remoteHosts.vars.values, "PATCHFILES_CONFIRM_COMMAND="+command)
+			defer fmt.Fprintf(app.Stderr, "the risky patches %s are reverted on every host unless you run '%s' from a new connection\n",
+				strings.Join(risky, " "), command)
+		}
+
+		return remoteHosts.run(app, patch, []string{"all", "--yes"}, format)
+	}
+
+	return cmd
+}
+
+// runLocal applies or reverts the patches on this host and prints the result of every patch.
+func runLocal(app *App, action string, patches []*parser.Result, root, format string) error {
+	patcher := local.Patcher{
+		Log:  app.Log,
+		Root: root,
+	}
+
+	run := patcher.Apply
+	if action == "revert" {
+		run = patcher.Revert
+	}
+
+	results, err := run(app.Ctx, patches)
+	if errors.Is(err, local.ErrAlreadyPatched) || errors.Is(err, local.ErrNotPatched) {
+		fmt.Fprintf(app.Stderr, "%s, nothing to do\n", err)
+		return nil
+	}
+	if errors.Is(err, local.ErrLocked) || errors.Is(err, local.ErrInterrupted) {
+		return err
+	}
+
+	printErr := printFormatted(app.Stdout, format, results, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tDECISION\tTARGET\tCOMMANDS\tVERIFY\tREASON")
+		for _, r := range results {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d/%d ok\t%d/%d ok\t%s\n",
+				r.Name, r.Decision, r.Target, len(r.Commands)-r.CommandsFailed(), len(r.Commands),
+				len(r.Verify)-r.VerifyFailed(), len(r.Verify), r.Reason)
+			for _, a := range r.Verify {
+				if a.Problem != "" {
+					fmt.Fprintf(tw, "\t\t\t\tFAIL\t%s: %s\n", a.Assertion, a.Problem)
+				}
+			}
+		}
+		tw.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	if printErr != nil {
+		return printErr
+	}
+
+	failed, unverified := 0, 0
+	for _, r := range results {
+		if r.Decision == local.Failed {
+			failed++
+		}
+		if r.VerifyFailed() > 0 {
+			unverified++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d patch(es) failed to %s", failed, action)
+	}
+	if unverified > 0 {
+		return fmt.Errorf("the assertions of %d patch(es) failed", unverified)
+	}
+
+	return nil
+}
+
+// leaveOutHighRisk returns the patches without the high-risk ones when all patches are selected, like
+// the scripts do for all. High-risk patches selected by name or category are listed with what they do
+// and refused, there is no terminal to confirm them on.
+func leaveOutHighRisk(app *App, selected []*parser.Result, selectors []string) (kept []*parser.Result, err error) {
+	all := len(selectors) == 0 || slices.Contains(selectors, "all")
+
+	high := 0
+	for _, r := range selected {
+		switch {
+		case r.Patch.RiskLevel() != "high":
+			kept = append(kept, r)
+		case all:
+			fmt.Fprintf(app.Stderr, "leaving out the high-risk patch %s, pass -yes to apply it\n", r.Name)
+		default:
+			high++
+			fmt.Fprintf(app.Stderr, "%s is high-risk and will:\n", r.Name)
+			for _, effect := range strings.Split(generator.Effects(r), "\n") {
+				fmt.Fprintf(app.Stderr, "    * %s\n", effect)
+			}
+		}
+	}
+
+	switch {
+	case high > 0:
+		return nil, fmt.Errorf("%d high-risk patch(es) selected, pass -yes to apply them", high)
+	case len(kept) == 0:
+		return nil, errors.New("every selected patch is high-risk, pass -yes to apply them")
+	}
+
+	return
+}
+
+// run streams the script to all hosts with the arguments and prints the report. The script contains
+// only the selected patches, confirmed here, so a patch script runs with "all --yes".
+func (o *remoteOptions) run(app *App, script []byte, args []string, format string) error {
+	fd, err := os.Open(o.hosts)
+	if err != nil {
+		return err
+	}
+	hosts, err := remote.ParseHosts(fd, o.user, o.port)
+	fd.Close()
+	if err != nil {
+		return usageError{fmt.Errorf("%s: %w", o.hosts, err)}
+	}
+	if len(hosts) == 0 {
+		return usageError{fmt.Errorf("%s: no hosts", o.hosts)}
+	}
+
+	// -var is checked here, the errors of the runner are not usage errors
+	if _, err := remote.Command(args, o.vars.values, o.sudo); err != nil {
+		return usageError{err}
+	}
+
+	config, closeAgent, err := remote.ClientConfig(remote.AuthOptions{
+		Identities:     o.identities.values,
+		KnownHosts:     o.knownHosts,
+		InsecureHosts:  o.insecureHosts,
+		ConnectTimeout: o.connectTimeout,
+	})
+	if err != nil {
+		return err
+	}
+	defer closeAgent()
+
+	runner := remote.Runner{
+		Log:         app.Log,
+		Config:      config,
+		Concurrency: o.concurrency,
+		Timeout:     o.timeout,
+		Sudo:        o.sudo,
+	}
+	report, err := runner.Run(app.Ctx, hosts, script, args, o.vars.values)
+	if err != nil {
+		return err
+	}
+
+	err = printFormatted(app.Stdout, format, report, func(w io.Writer) {
+		printReport(w, report)
+	})
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, r := range report {
+		if r.Failed() {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d host(s) failed", failed, len(report))
+	}
+
+	return nil
+}
+
+// printReport prints the output of every host followed by a summary table.
+func printReport(w io.Writer, report []remote.Result) {
+	for _, r := range report {
+		fmt.Fprintf(w, "==> %s <==\n%s", r.Host, r.Output)
+		if r.Output != "" && !strings.HasSuffix(r.Output, "\n") {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintln(w)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tEXIT\tDURATION\tERROR")
+	for _, r := range report {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", r.Host, r.ExitCode, r.Duration, r.Error)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,147 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"patchfiles/generator"
+
+	"go.uber.org/zap"
+)
+
+// newBuildCommand returns the command that generates patch and revert scripts.
+func newBuildCommand() *Command {
+	var (
+		input        inputOptions
+		metadata     metadataOptions
+		outputDir    string
+		nameTemplate string
+		environments = envList("ENVIRONMENT")
+		bundles      stringList
+		logDir       string
+		syslog       bool
+		rollback     int
+	)
+
+	cmd := newCommand("build", "", "Generate patch and revert scripts for every environment and bundle.")
+	input.register(cmd)
+	metadata.register(cmd)
+	cmd.Flags.StringVar(&outputDir, "output-dir", ".", "directory to write generated scripts to")
+	cmd.Flags.StringVar(&nameTemplate, "name-template", generator.DefaultNameTemplate, "template of script file names, fields: .Action, .Environment, .Bundle")
+	cmd.Flags.Var(&environments, "environment", "environment to generate scripts for, repeatable, defaults to dev (env ENVIRONMENT)")
+	cmd.Flags.Var(&bundles, "bundle", "category to generate separate scripts for, repeatable, 'all' for every patch")
+	cmd.Flags.StringVar(&logDir, "script-log-dir", generator.DefaultLogDir, "directory the scripts write their run logs to, overridden by PATCHFILES_LOG_DIR at run time")
+	cmd.Flags.BoolVar(&syslog, "script-syslog", false, "make the scripts copy their run logs to syslog, overridden by PATCHFILES_SYSLOG at run time")
+	cmd.Flags.IntVar(&rollback, "script-rollback-minutes", generator.DefaultRollbackMinutes, "minutes after which the scripts revert risky patches unless confirmed, overridden by PATCHFILES_ROLLBACK_MINUTES at run time")
+
+	cmd.Run = func(app *App, args []string) error {
+		if len(args) > 0 {
+			return usageError{fmt.Errorf("unexpected arguments %v", args)}
+		}
+		if rollback < 1 {
+			return usageError{fmt.Errorf("-script-rollback-minutes is %d, must be at least 1, PATCHFILES_ROLLBACK_MINUTES=0 turns the rollback off at run time", rollback)}
+		}
+
+		envs := environments.values
+		if len(envs) == 0 {
+			envs = []string{"dev"}
+		}
+
+		bundleNames := bundles.values
+		if len(bundleNames) == 0 {
+			bundleNames = []string{"all"}
+		}
+
+		results, errs := input.load(app)
+		for _, e := range errs {
+			app.Log.Error("received error",
+				zap.Error(parseError(e)),
+			)
+		}
+
+		// patches lint rejects would produce broken scripts, no script is written then
+		invalid := validate(results)
+		for _, err := range invalid {
+			app.Log.Error("invalid patch",
+				zap.Error(err),
+			)
+		}
+		if len(invalid) > 0 {
+			return fmt.Errorf("%d problem(s) found, run lint for details", len(invalid))
+		}
+
+		gens := make([]*generator.Generator, 0)
+		names := make(map[string]string)
+		for _, environment := range envs {
+			for _, bundle := range bundleNames {
+				gen := &generator.Generator{
+					Log:             app.Log,
+					Environment:     strings.ToLower(environment),
+					Author:          metadata.author,
+					Version:         metadata.version,
+					OutputDir:       outputDir,
+					NameTemplate:    nameTemplate,
+					LogDir:          logDir,
+					Syslog:          syslog,
+					RollbackMinutes: rollback,
+				}
+				if bundle != "all" {
+					gen.Bundle = bundle
+					gen.Categories = []string{bundle}
+				}
+
+				// scripts sharing a file name would overwrite each other
+				for _, action := range []string{"patch", "revert"} {
+					fileLoc, err := gen.FileName(action)
+					if err != nil {
+						return usageError{fmt.Errorf("-name-template: %w", err)}
+					}
+					script := fmt.Sprintf("the %s script of environment %s and bundle %s", action, gen.Environment, bundle)
+					if other, ok := names[fileLoc]; ok {
+						return usageError{fmt.Errorf("-name-template renders %s for both %s and %s, use .Action, .Environment and .Bundle to tell them apart", fileLoc, other, script)}
+					}
+					names[fileLoc] = script
+				}
+
+				gens = append(gens, gen)
+			}
+		}
+
+		for _, gen := range gens {
+			err := gen.Open()
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, r := range results {
+			logger := app.Log.WithOptions(zap.Fields(
+				zap.String("fileLoc", *r.FileLoc),
+				zap.String("name", r.Name),
+			))
+			logger.Debug("received result")
+
+			for _, gen := range gens {
+				gen.Write(r)
+			}
+		}
+
+		for _, gen := range gens {
+			gen.Close()
+		}
+
+		app.Log.Info("processing is done. stats",
+			zap.Int("total", len(results)+len(errs)),
+			zap.Int("good", len(results)),
+			zap.Int("errors", len(errs)),
+		)
+
+		if len(errs) > 0 {
+			return fmt.Errorf("%d patch file(s) failed to parse", len(errs))
+		}
+
+		return nil
+	}
+
+	return cmd
+}
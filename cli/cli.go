@@ -0,0 +1,261 @@
+// Package cli implements the patchfiles command line. Every subcommand is defined once, with its
+// typed flags, environment variable fallbacks and summary, and the help output is generated from it.
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"patchfiles/logger"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// name is the program name used in help output.
+	name = "patchfiles"
+)
+
+// Command is a single subcommand of the command line.
+type Command struct {
+	Name    string                              // Name used to invoke the command
+	Args    string                              // Usage of positional arguments, e.g. "<patch>"
+	Summary string                              // One-line description shown in help output
+	Help    string                              // Additional paragraphs shown in the command help
+	Flags   *flag.FlagSet                       // Typed flags of the command
+	Run     func(app *App, args []string) error // Runs the command with the remaining positional arguments
+}
+
+// App contains state shared by all commands.
+type App struct {
+	Ctx     context.Context // Canceled when the process receives a termination signal
+	Log     *zap.Logger     // Logger instance for logging operations
+	Content fs.FS           // Filesystem with the embedded patches directory
+	Stdout  io.Writer       // Destination of command output
+	Stderr  io.Writer       // Destination of errors and help output
+}
+
+// usageError is returned for invalid command line usage and results in exit code 2.
+type usageError struct {
+	err error
+}
+
+func (e usageError) Error() string {
+	return e.err.Error()
+}
+
+// commands returns the command tree. It is built on every call, so flag values never leak between runs.
+func commands() []*Command {
+	return []*Command{
+		newBuildCommand(),
+		newLintCommand(),
+		newListCommand(),
+		newShowCommand(),
+		newDiffCommand(),
+		newRenderCommand(),
+		newApplyCommand(),
+		newRevertCommand(),
+		newVersionCommand(),
+	}
+}
+
+// newCommand returns a command with a flag set whose help output is generated from the command definition.
+func newCommand(name, args, summary string) *Command {
+	cmd := &Command{
+		Name:    name,
+		Args:    args,
+		Summary: summary,
+		Flags:   flag.NewFlagSet(name, flag.ContinueOnError),
+	}
+	cmd.Flags.Usage = func() {
+		printCommandUsage(cmd.Flags.Output(), cmd)
+	}
+
+	return cmd
+}
+
+// Main runs the command line with the given arguments (without the program name) and returns the exit code.
+func Main(args []string, content fs.FS) int {
+	ctx, stop := signal.NotifyContext(context.Background(),
+		syscall.SIGHUP,
+		syscall.SIGINT,
+		syscall.SIGTERM,
+		syscall.SIGQUIT,
+	)
+	defer stop()
+
+	app := &App{
+		Ctx:     ctx,
+		Content: content,
+		Stdout:  os.Stdout,
+		Stderr:  os.Stderr,
+	}
+
+	err := app.run(args)
+	var usage usageError
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.As(err, &usage):
+		fmt.Fprintf(app.Stderr, "error: %v\n", err)
+		return 2
+	default:
+		fmt.Fprintf(app.Stderr, "error: %v\n", err)
+		return 1
+	}
+}
+
+// run parses the global flags, sets up the logger and dispatches to the selected command.
+func (app *App) run(args []string) (err error) {
+	cmds := commands()
+
+	global := flag.NewFlagSet(name, flag.ContinueOnError)
+	global.SetOutput(app.Stderr)
+	logOutputs := envList("PATCHFILES_LOG_OUTPUT")
+	logOptions := logger.Options{}
+	global.StringVar(&logOptions.Level, "log-level", envOr("PATCHFILES_LOG_LEVEL", "info"), "minimum log level: debug, info, warn or error (env PATCHFILES_LOG_LEVEL)")
+	global.StringVar(&logOptions.Encoding, "log-format", envOr("PATCHFILES_LOG_FORMAT", "console"), "log format: console or json (env PATCHFILES_LOG_FORMAT)")
+	global.Var(&logOutputs, "log-output", "file, stdout or stderr to write logs to, repeatable, defaults to stderr (env PATCHFILES_LOG_OUTPUT)")
+	global.BoolVar(&logOptions.Caller, "log-caller", false, "include the source location in log entries")
+	global.Usage = func() {
+		printUsage(app.Stderr, global, cmds)
+	}
+
+	err = global.Parse(args)
+	if err != nil {
+		return
+	}
+
+	args = global.Args()
+	if len(args) == 0 {
+		global.Usage()
+		return usageError{errors.New("no command given")}
+	}
+
+	if args[0] == "help" {
+		return app.help(global, cmds, args[1:])
+	}
+
+	cmd := findCommand(cmds, args[0])
+	if cmd == nil {
+		global.Usage()
+		return usageError{fmt.Errorf("unknown command %q", args[0])}
+	}
+
+	cmd.Flags.SetOutput(app.Stderr)
+	positional, err := parseInterspersed(cmd.Flags, args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		return usageError{err}
+	}
+
+	logOptions.OutputPaths = logOutputs.values
+	log, err := logger.Setup(logOptions)
+	if err != nil {
+		return usageError{fmt.Errorf("setting up logger: %w", err)}
+	}
+	defer log.Sync()
+	app.Log = log
+
+	return cmd.Run(app, positional)
+}
+
+// parseInterspersed parses flags that may appear before, between and after positional arguments,
+// e.g. "render sshd -script patch". Everything after "--" is positional.
+func parseInterspersed(flags *flag.FlagSet, args []string) (positional []string, err error) {
+	for len(args) > 0 {
+		err = flags.Parse(args)
+		if err != nil {
+			return
+		}
+
+		// flag.Parse stops at the first positional argument or consumes "--" and stops
+		rest := flags.Args()
+		consumed := len(args) - len(rest)
+		if consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		if len(rest) == 0 {
+			break
+		}
+
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+
+	return
+}
+
+// help prints the usage of a command, or of the whole program when no command is given.
+func (app *App) help(global *flag.FlagSet, cmds []*Command, args []string) error {
+	if len(args) == 0 {
+		printUsage(app.Stdout, global, cmds)
+		return nil
+	}
+
+	cmd := findCommand(cmds, args[0])
+	if cmd == nil {
+		return usageError{fmt.Errorf("unknown command %q", args[0])}
+	}
+
+	printCommandUsage(app.Stdout, cmd)
+	return nil
+}
+
+// findCommand returns the command with the given name, or nil.
+func findCommand(cmds []*Command, name string) *Command {
+	for _, cmd := range cmds {
+		if cmd.Name == name {
+			return cmd
+		}
+	}
+
+	return nil
+}
+
+// printUsage prints the program usage with global flags and the list of commands.
+func printUsage(w io.Writer, global *flag.FlagSet, cmds []*Command) {
+	fmt.Fprintf(w, "Usage: %s [global flags] <command> [flags] [arguments]\n\n", name)
+	fmt.Fprintln(w, "Commands:")
+	for _, cmd := range cmds {
+		fmt.Fprintf(w, "  %-10s %s\n", cmd.Name, cmd.Summary)
+	}
+
+	fmt.Fprintln(w, "\nGlobal flags:")
+	global.SetOutput(w)
+	global.PrintDefaults()
+
+	fmt.Fprintf(w, "\nRun '%s help <command>' or '%s <command> -help' for command flags.\n", name, name)
+}
+
+// printCommandUsage prints the usage, summary and flags of a command.
+func printCommandUsage(w io.Writer, cmd *Command) {
+	usage := fmt.Sprintf("%s %s [flags]", name, cmd.Name)
+	if cmd.Args != "" {
+		usage += " " + cmd.Args
+	}
+
+	fmt.Fprintf(w, "Usage: %s\n\n%s\n", usage, cmd.Summary)
+	if cmd.Help != "" {
+		fmt.Fprintf(w, "\n%s\n", cmd.Help)
+	}
+
+	hasFlags := false
+	cmd.Flags.VisitAll(func(*flag.Flag) {
+		hasFlags = true
+	})
+	if hasFlags {
+		fmt.Fprintln(w, "\nFlags:")
+		cmd.Flags.SetOutput(w)
+		cmd.Flags.PrintDefaults()
+	}
+}
@@ -0,0 +1,513 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"patchfiles/generator"
+	"patchfiles/internal/sshtest"
+	"patchfiles/local"
+	"patchfiles/remote"
+)
+
+// patches is an in-memory filesystem standing in for the embedded patches.
+var patches = fstest.MapFS{
+	"patches/sshd.yaml": {Data: []byte(`output: /etc/ssh/sshd_config
+categories: [security]
+mode: overwrite
+commentCharacter: "#"
+commandsAfter: [systemctl restart sshd]
+description: hardens sshd
+body: |
+  PasswordAuthentication no
+`)},
+	"patches/limits_1.yaml": {Data: []byte(`output: /etc/pam.d/common-session
+categories: [performance]
+mode: append
+commentCharacter: "#"
+description: enables pam_limits
+body: |
+  session required pam_limits.so
+`)},
+}
+
+// run executes the command line with the test patches and returns stdout, stderr and the error.
+func run(t *testing.T, args ...string) (string, string, error) {
+	t.Helper()
+
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	app := &App{
+		Ctx:     t.Context(),
+		Content: patches,
+		Stdout:  stdout,
+		Stderr:  stderr,
+	}
+
+	err := app.run(args)
+	return stdout.String(), stderr.String(), err
+}
+
+func TestHelpListsEveryCommand(t *testing.T) {
+	out, _, err := run(t, "help")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cmd := range commands() {
+		if !strings.Contains(out, "  "+cmd.Name) || !strings.Contains(out, cmd.Summary) {
+			t.Errorf("help is missing command %s:\n%s", cmd.Name, out)
+		}
+
+		_, stderr, err := run(t, cmd.Name, "-help")
+		if !errors.Is(err, flag.ErrHelp) || !strings.Contains(stderr, "Usage: patchfiles "+cmd.Name) {
+			t.Errorf("%s -help: %v\n%s", cmd.Name, err, stderr)
+		}
+	}
+}
+
+func TestUsageErrors(t *testing.T) {
+	cases := [][]string{
+		{},
+		{"nope"},
+		{"show"},
+		{"build", "-nope"},
+		{"version", "extra"},
+	}
+
+	for _, args := range cases {
+		_, _, err := run(t, args...)
+		var usage usageError
+		if !errors.As(err, &usage) {
+			t.Errorf("%v: got %v, want a usage error", args, err)
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	t.Setenv("ENVIRONMENT", "prod")
+	t.Setenv("AUTHOR", "from-env")
+	dir := t.TempDir()
+
+	_, _, err := run(t, "build", "-output-dir", dir, "-author", "from-flag", "-bundle", "all,security")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"patch.sh", "revert.sh", "patch-security.sh", "revert-security.sh"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	script, _ := os.ReadFile(filepath.Join(dir, "patch-security.sh"))
+	if !strings.Contains(string(script), "# author: from-flag") || !strings.Contains(string(script), "# environment: prod") {
+		t.Errorf("flags and environment fallbacks are not applied:\n%s", script[:300])
+	}
+	if strings.Contains(string(script), "limits_1") {
+		t.Error("security bundle contains a performance patch")
+	}
+}
+
+func TestBuildFailures(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, nil, 0o644)
+
+	_, _, err := run(t, "build", "-output-dir", filepath.Join(file, "scripts"))
+	var usage usageError
+	if err == nil || errors.As(err, &usage) || !strings.Contains(err.Error(), "creating output directory") {
+		t.Errorf("build into a directory that cannot be created: %v", err)
+	}
+
+	cases := [][]string{
+		{"-name-template", "x.sh"},
+		{"-name-template", "{{.Environment}}.sh"},
+		{"-name-template", "{{.Action}}.sh", "-environment", "dev,prod"},
+		{"-name-template", "{{.Action}}-{{.Environment}}.sh", "-bundle", "all,security"},
+		{"-name-template", "{{.Nope}}.sh"},
+	}
+	for _, args := range cases {
+		output := t.TempDir()
+		_, _, err := run(t, append([]string{"build", "-output-dir", output}, args...)...)
+		if !errors.As(err, &usage) {
+			t.Errorf("%v: got %v, want a usage error", args, err)
+		}
+		if entries, _ := os.ReadDir(output); len(entries) > 0 {
+			t.Errorf("%v: build wrote %s", args, entries[0].Name())
+		}
+	}
+}
+
+func TestBuildRejectsInvalidPatch(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "foo.yaml"), []byte("output: etc/foo.conf\nmode: apend\nbody: x\n"), 0o644)
+	output := t.TempDir()
+
+	_, _, err := run(t, "build", "-patches", dir, "-output-dir", output)
+	if err == nil || !strings.Contains(err.Error(), "2 problem(s)") {
+		t.Fatalf("build of an invalid patch: %v", err)
+	}
+	if entries, _ := os.ReadDir(output); len(entries) > 0 {
+		t.Errorf("build wrote %s for an invalid patch", entries[0].Name())
+	}
+}
+
+func TestInvalidPatchIsRefused(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "foo.yaml"), []byte("output: etc/foo.conf\nmode: apend\nbody: x\n"), 0o644)
+	root := t.TempDir()
+
+	for _, args := range [][]string{
+		{"apply", "-patches", dir, "-root", root, "all"},
+		{"revert", "-patches", dir, "-root", root, "all"},
+		{"list", "-patches", dir},
+		{"show", "-patches", dir, "foo"},
+	} {
+		_, _, err := run(t, args...)
+		if err == nil || !strings.Contains(err.Error(), "must be an absolute path") {
+			t.Errorf("%v: %v", args, err)
+		}
+	}
+	if entries, _ := os.ReadDir(root); len(entries) > 0 {
+		t.Errorf("apply wrote %s for an invalid patch", entries[0].Name())
+	}
+}
+
+func TestLint(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "bad.yaml"), []byte("output: etc/relative\nmode: replace\nbody: x\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "broken.yaml"), []byte("output: [\n"), 0o644)
+
+	out, _, err := run(t, "lint", "-patches", dir)
+	if err == nil {
+		t.Fatal("lint accepted invalid patches")
+	}
+	for _, problem := range []string{"must be an absolute path", "mode \"replace\"", "broken.yaml"} {
+		if !strings.Contains(out, problem) {
+			t.Errorf("lint output is missing %q:\n%s", problem, out)
+		}
+	}
+
+	out, _, err = run(t, "lint")
+	if err != nil {
+		t.Fatalf("lint of valid patches: %v\n%s", err, out)
+	}
+}
+
+func TestRenderFlagsAfterArgument(t *testing.T) {
+	out, _, err := run(t, "render", "sshd", "-script", "revert")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out, "revert script") || strings.Contains(out, "patch script") {
+		t.Errorf("render ignored -script after the patch name:\n%s", out)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "etc/ssh"), 0o755)
+	os.WriteFile(filepath.Join(root, "etc/ssh/sshd_config"), []byte("PasswordAuthentication yes\n"), 0o644)
+
+	out, _, err := run(t, "diff", "-root", root, "security")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "--- /etc/ssh/sshd_config\n+++ /etc/ssh/sshd_config (sshd)\n@@ -1 +1,2 @@\n-PasswordAuthentication yes\n+PasswordAuthentication no\n+\n"
+	if out != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestList(t *testing.T) {
+	out, _, err := run(t, "list", "-category", "security")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out, "NAME") || !strings.Contains(out, "/etc/ssh/sshd_config") || strings.Contains(out, "limits_1") {
+		t.Errorf("table output:\n%s", out)
+	}
+
+	out, _, err = run(t, "list", "-format", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []listEntry
+	if err := json.Unmarshal([]byte(out), &entries); err != nil || len(entries) != 2 {
+		t.Fatalf("json output (%v):\n%s", err, out)
+	}
+	if entries[0].Name != "limits_1" || entries[0].ShortName != "limits" || entries[0].Mode != "append" {
+		t.Errorf("unexpected entry: %+v", entries[0])
+	}
+
+	out, _, err = run(t, "list", "-format", "yaml")
+	if err != nil || !strings.Contains(out, "shortName: sshd") {
+		t.Errorf("yaml output (%v):\n%s", err, out)
+	}
+
+	_, _, err = run(t, "list", "-format", "xml")
+	var usage usageError
+	if !errors.As(err, &usage) {
+		t.Errorf("unknown format: got %v, want a usage error", err)
+	}
+}
+
+func TestShowResolvesPatch(t *testing.T) {
+	out, _, err := run(t, "show", "limits_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"# PATCHFILES START limits_1 ", "# PATCHFILES END limits_1", "pf_remove_block"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("show is missing %q:\n%s", want, out)
+		}
+	}
+
+	out, _, err = run(t, "show", "sshd", "-format", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resolved generator.Resolved
+	if err := json.Unmarshal([]byte(out), &resolved); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(resolved.Backup, "cp -a") || resolved.Payload != "PasswordAuthentication no\n\n" {
+		t.Errorf("unexpected resolved patch: %+v", resolved)
+	}
+}
+
+func TestApplyOverSSH(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not available")
+	}
+
+	// the server runs the script locally, with a stub systemctl and against a fake root
+	server := sshtest.New(t)
+	bin := t.TempDir()
+	os.WriteFile(filepath.Join(bin, "systemctl"), []byte("#!/usr/bin/env bash\nexit 0\n"), 0o755)
+	server.Env = append(os.Environ(), "PATH="+bin+":"+os.Getenv("PATH"))
+
+	root := t.TempDir()
+	hosts := filepath.Join(t.TempDir(), "hosts")
+	os.WriteFile(hosts, []byte("# test fleet\nadmin@"+server.Addr+"\n"), 0o644)
+
+	out, _, err := run(t, "apply", "-hosts", hosts, "-identity", server.Identity, "-insecure-ignore-host-key",
+		"-var", "PATCHFILES_ROOT="+root, "-var", "PATCHFILES_LOG_DIR="+filepath.Join(root, "log"), "-var", "PATCHFILES_ALLOW_NONROOT=1", "security")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	if !strings.Contains(out, "Patching 'sshd'") || strings.Contains(out, "limits_1") || !strings.Contains(out, "HOST") {
+		t.Errorf("report:\n%s", out)
+	}
+
+	body, _ := os.ReadFile(filepath.Join(root, "etc/ssh/sshd_config"))
+	if string(body) != "PasswordAuthentication no\n\n" {
+		t.Errorf("sshd_config = %q", body)
+	}
+
+	// the second run exits early on the control file, a failing host fails the command
+	os.WriteFile(hosts, []byte(server.Addr+"\n127.0.0.1:1\n"), 0o644)
+	out, _, err = run(t, "apply", "-hosts", hosts, "-identity", server.Identity, "-insecure-ignore-host-key",
+		"-var", "PATCHFILES_ROOT="+root, "-format", "json")
+	if err == nil || err.Error() != "1 of 2 host(s) failed" {
+		t.Fatalf("apply with an unreachable host: %v", err)
+	}
+
+	var report []remote.Result
+	if err := json.Unmarshal([]byte(out), &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report) != 2 || !strings.Contains(report[0].Output, "System already patched") || report[1].Error == "" {
+		t.Errorf("report: %+v", report)
+	}
+
+}
+
+func TestApplyRiskyOverSSH(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not available")
+	}
+	current, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	// the server has stubs to schedule and cancel the rollback, and a key of the user on the fake root
+	server := sshtest.New(t)
+	bin := t.TempDir()
+	for _, name := range []string{"systemctl", "systemd-run"} {
+		os.WriteFile(filepath.Join(bin, name), []byte("#!/usr/bin/env bash\nexit 0\n"), 0o755)
+	}
+	server.Env = append(os.Environ(), "PATH="+bin+":"+os.Getenv("PATH"))
+
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, current.HomeDir, ".ssh"), 0o755)
+	os.WriteFile(filepath.Join(root, current.HomeDir, ".ssh/authorized_keys"), []byte("ssh-ed25519 AAAA test\n"), 0o644)
+	hosts := filepath.Join(t.TempDir(), "hosts")
+	os.WriteFile(hosts, []byte(server.Addr+"\n"), 0o644)
+
+	content := fstest.MapFS{
+		"patches/sshd.yaml": {Data: []byte(`output: /etc/ssh/sshd_config
+categories: [security]
+mode: overwrite
+risky: true
+description: hardens sshd
+body: |
+  PasswordAuthentication no
+`)},
+	}
+	apply := func(args ...string) (string, string, error) {
+		stdout := new(bytes.Buffer)
+		stderr := new(bytes.Buffer)
+		app := &App{
+			Ctx:     t.Context(),
+			Content: content,
+			Stdout:  stdout,
+			Stderr:  stderr,
+		}
+		err := app.run(append([]string{"apply", "-hosts", hosts, "-identity", server.Identity, "-insecure-ignore-host-key",
+			"-var", "PATCHFILES_ROOT=" + root, "-var", "PATCHFILES_LOG_DIR=" + filepath.Join(root, "log"), "-var", "PATCHFILES_ALLOW_NONROOT=1"}, args...))
+		return stdout.String(), stderr.String(), err
+	}
+
+	// the script and the command tell how to confirm from here, the script is not on the host
+	confirm := "patchfiles apply -hosts " + hosts + " -confirm"
+	out, stderr, err := apply("sshd")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	if !strings.Contains(out, "run '"+confirm+"'") || !strings.Contains(stderr, "the risky patches sshd are reverted on every host unless you run '"+confirm+"'") {
+		t.Errorf("apply does not tell how to confirm:\n%s\n%s", out, stderr)
+	}
+	if _, err := os.Stat(filepath.Join(root, generator.RollbackDir, "job")); err != nil {
+		t.Fatalf("no rollback is scheduled: %v", err)
+	}
+
+	out, _, err = apply("-confirm")
+	if err != nil || !strings.Contains(out, "Confirmed sshd, the rollback is cancelled.") {
+		t.Fatalf("confirm: %v\n%s", err, out)
+	}
+	if _, err := os.Stat(filepath.Join(root, generator.RollbackDir)); err == nil {
+		t.Error("confirm left the rollback in place")
+	}
+
+	_, _, err = run(t, "apply", "-confirm")
+	var usage usageError
+	if !errors.As(err, &usage) {
+		t.Errorf("-confirm without -hosts: got %v, want a usage error", err)
+	}
+}
+
+func TestRemoteUsageErrors(t *testing.T) {
+	dir := t.TempDir()
+	hosts := filepath.Join(dir, "hosts")
+	os.WriteFile(hosts, []byte("web1:nope\n"), 0o644)
+	empty := filepath.Join(dir, "empty")
+	os.WriteFile(empty, []byte("# no hosts yet\n"), 0o644)
+	good := filepath.Join(dir, "good")
+	os.WriteFile(good, []byte("admin@127.0.0.1:1\n"), 0o644)
+
+	cases := [][]string{
+		{"apply", "-hosts", hosts, "all"},
+		{"apply", "-hosts", empty, "all"},
+		{"apply", "-hosts", good, "-var", "NOT A VAR", "all"},
+		{"revert", "-hosts", good, "-var", "1X=y", "all"},
+	}
+	for _, args := range cases {
+		_, _, err := run(t, args...)
+		var usage usageError
+		if !errors.As(err, &usage) {
+			t.Errorf("%v: got %v, want a usage error", args, err)
+		}
+	}
+}
+
+func TestApplyAndRevertLocally(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "etc/pam.d"), 0o755)
+	os.WriteFile(filepath.Join(root, "etc/pam.d/common-session"), []byte("session optional pam_umask.so\n"), 0o644)
+
+	out, _, err := run(t, "apply", "-root", root, "performance", "-format", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var results []local.Result
+	if err := json.Unmarshal([]byte(out), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Name != "limits_1" || results[0].Decision != local.Applied {
+		t.Errorf("results: %+v", results)
+	}
+	if body, _ := os.ReadFile(filepath.Join(root, "etc/pam.d/common-session")); !strings.Contains(string(body), "pam_limits.so") {
+		t.Errorf("common-session was not patched:\n%s", body)
+	}
+
+	_, stderr, err := run(t, "apply", "-root", root, "performance")
+	if err != nil || !strings.Contains(stderr, "system already patched") {
+		t.Errorf("second apply: %v\n%s", err, stderr)
+	}
+
+	out, _, err = run(t, "revert", "-root", root, "limits")
+	if err != nil || !strings.Contains(out, "limits_1  reverted") {
+		t.Errorf("revert: %v\n%s", err, out)
+	}
+	if body, _ := os.ReadFile(filepath.Join(root, "etc/pam.d/common-session")); string(body) != "session optional pam_umask.so\n" {
+		t.Errorf("common-session was not reverted:\n%s", body)
+	}
+}
+
+func TestApplyHighRisk(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "etc/pam.d"), 0o755)
+
+	content := fstest.MapFS{
+		"patches/limits_1.yaml": patches["patches/limits_1.yaml"],
+		"patches/sshd.yaml": {Data: []byte(`output: /etc/ssh/sshd_config
+categories: [security]
+mode: overwrite
+risk: high
+notify: [restart sshd]
+description: hardens sshd
+body: |
+  PasswordAuthentication no
+`)},
+	}
+	apply := func(args ...string) (string, error) {
+		stderr := new(bytes.Buffer)
+		app := &App{
+			Ctx:     t.Context(),
+			Content: content,
+			Stdout:  new(bytes.Buffer),
+			Stderr:  stderr,
+		}
+		err := app.run(append([]string{"apply", "-root", root}, args...))
+		return stderr.String(), err
+	}
+
+	// selected by name, the patch is listed and refused
+	stderr, err := apply("sshd")
+	if err == nil || !strings.Contains(stderr, "* write /etc/ssh/sshd_config (overwrite)") || !strings.Contains(stderr, "* notify restart sshd") {
+		t.Fatalf("apply sshd: %v\n%s", err, stderr)
+	}
+
+	// all leaves it out
+	stderr, err = apply("all")
+	if err != nil || !strings.Contains(stderr, "leaving out the high-risk patch sshd") {
+		t.Fatalf("apply all: %v\n%s", err, stderr)
+	}
+	if _, err := os.Stat(filepath.Join(root, "etc/ssh/sshd_config")); err == nil {
+		t.Error("sshd_config was written without -yes")
+	}
+}
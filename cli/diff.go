@@ -0,0 +1,57 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"patchfiles/generator"
+	"patchfiles/textdiff"
+)
+
+// newDiffCommand returns the command that shows how patches would change the files on this host.
+func newDiffCommand() *Command {
+	var (
+		input inputOptions
+		root  string
+	)
+
+	cmd := newCommand("diff", "[selector...]", "Show a unified diff between the target files on this host and their patched content.")
+	cmd.Help = "Selectors are 'all', patch names, short names or categories. Without selectors all patches are compared.\nValues are computed from the facts of the host below the root."
+	input.register(cmd)
+	cmd.Flags.StringVar(&root, "root", envOr("PATCHFILES_ROOT", "/"), "root filesystem the targets are read from (env PATCHFILES_ROOT)")
+
+	cmd.Run = func(app *App, args []string) error {
+		results, err := input.loadValid(app)
+		if err != nil {
+			return err
+		}
+
+		failed := 0
+		for _, r := range selectPatches(results, args) {
+			current, err := os.ReadFile(filepath.Join(root, r.Patch.Output))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+
+			computed, err := generator.ComputeValues(app.Ctx, r, root)
+			patched := ""
+			if err == nil {
+				patched, err = generator.Patched(r, string(current), computed)
+			}
+			if err != nil {
+				fmt.Fprintf(app.Stderr, "%s: %s\n", r.Name, err)
+				failed++
+				continue
+			}
+			fmt.Fprint(app.Stdout, textdiff.Unified(r.Patch.Output, r.Patch.Output+" ("+r.Name+")", string(current), patched))
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d patch(es) do not apply to their target", failed)
+		}
+
+		return nil
+	}
+
+	return cmd
+}
@@ -0,0 +1,224 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"patchfiles/parser"
+
+	"go.uber.org/zap"
+)
+
+// stringList is a flag holding a list of values. It accepts comma-separated values and can be repeated.
+// Values set from an environment variable fallback are replaced by the first value from the command line.
+type stringList struct {
+	values   []string
+	fallback bool // values came from the environment and are replaced on Set
+}
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+
+	return strings.Join(l.values, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	if l.fallback {
+		l.values = nil
+		l.fallback = false
+	}
+	l.values = append(l.values, splitList(value)...)
+
+	return nil
+}
+
+// repeatedList is a flag holding one value per occurrence, for values that may contain commas.
+type repeatedList struct {
+	values []string
+}
+
+func (l *repeatedList) String() string {
+	if l == nil {
+		return ""
+	}
+
+	return strings.Join(l.values, " ")
+}
+
+func (l *repeatedList) Set(value string) error {
+	l.values = append(l.values, value)
+
+	return nil
+}
+
+// envList returns a stringList defaulting to the comma-separated value of an environment variable.
+func envList(key string) stringList {
+	return stringList{
+		values:   splitList(os.Getenv(key)),
+		fallback: true,
+	}
+}
+
+// envOr returns the trimmed value of an environment variable, or fallback when it is empty.
+func envOr(key, fallback string) string {
+	value := strings.Trim(os.Getenv(key), " ")
+	if value == "" {
+		return fallback
+	}
+
+	return value
+}
+
+// splitList splits a comma-separated list, trims its items and drops empty ones.
+func splitList(in string) (out []string) {
+	for _, item := range strings.Split(in, ",") {
+		item = strings.Trim(item, " ")
+		if item != "" {
+			out = append(out, item)
+		}
+	}
+
+	return
+}
+
+// inputOptions selects where patch definitions are read from.
+type inputOptions struct {
+	dirs stringList // Directories with patch YAML files, embedded patches when empty
+}
+
+// register adds the input flags to a flag set.
+func (o *inputOptions) register(cmd *Command) {
+	o.dirs = envList("PATCHFILES_PATCHES")
+	cmd.Flags.Var(&o.dirs, "patches", "directory with patch YAML files, repeatable, defaults to the embedded patches (env PATCHFILES_PATCHES)")
+}
+
+// load parses all patches from the input directories, or from the embedded patches.
+func (o *inputOptions) load(app *App) (results []*parser.Result, errs []*parser.Error) {
+	if len(o.dirs.values) == 0 {
+		return parser.Load(app.Log, app.Content)
+	}
+
+	for _, dir := range o.dirs.values {
+		dir = filepath.Clean(dir)
+		app.Log.Debug("loading patches",
+			zap.String("dir", dir),
+		)
+
+		r, e := parser.LoadDir(app.Log, os.DirFS(dir), ".")
+
+		// file locations are relative to the directory, make them point at the real files
+		for _, result := range r {
+			fileLoc := filepath.Join(dir, *result.FileLoc)
+			result.FileLoc = &fileLoc
+		}
+		for _, err := range e {
+			fileLoc := dir
+			if err.FileLoc != nil {
+				fileLoc = filepath.Join(dir, *err.FileLoc)
+			}
+			err.FileLoc = &fileLoc
+		}
+
+		results = append(results, r...)
+		errs = append(errs, e...)
+	}
+
+	return
+}
+
+// loadValid loads patches like load, but fails on the first parse error or the first problem
+// lint reports.
+func (o *inputOptions) loadValid(app *App) ([]*parser.Result, error) {
+	results, errs := o.load(app)
+	if len(errs) > 0 {
+		return nil, parseError(errs[0])
+	}
+
+	if invalid := validate(results); len(invalid) > 0 {
+		return nil, invalid[0]
+	}
+
+	return results, nil
+}
+
+// validate checks the patches and returns every problem found, including names used by more
+// than one patch, prefixed with the file location.
+func validate(results []*parser.Result) (errs []error) {
+	seen := make(map[string]string)
+	for _, r := range results {
+		for _, err := range r.Validate() {
+			errs = append(errs, fmt.Errorf("%s: %w", *r.FileLoc, err))
+		}
+
+		if other, ok := seen[r.Name]; ok {
+			errs = append(errs, fmt.Errorf("%s: name %q is already used by %s", *r.FileLoc, r.Name, other))
+		}
+		seen[r.Name] = *r.FileLoc
+	}
+
+	return
+}
+
+// parseError formats a parser error with its file location.
+func parseError(e *parser.Error) error {
+	if e.FileLoc == nil {
+		return e.Error
+	}
+
+	return fmt.Errorf("%s: %w", *e.FileLoc, e.Error)
+}
+
+// metadataOptions holds the metadata written into script headers.
+type metadataOptions struct {
+	author  string // Author written in the header
+	version string // Version written in the header
+}
+
+// register adds the metadata flags to a flag set.
+func (o *metadataOptions) register(cmd *Command) {
+	cmd.Flags.StringVar(&o.author, "author", envOr("AUTHOR", ""), "author written in script headers (env AUTHOR)")
+	cmd.Flags.StringVar(&o.version, "script-version", envOr("VERSION", ""), "version written in script headers (env VERSION)")
+}
+
+// selects reports whether a patch matches a selector: "all", its short name or one of its
+// categories like in the generated scripts, and additionally its full name.
+func selects(r *parser.Result, selector string) bool {
+	return selector == "all" ||
+		selector == r.Name ||
+		selector == r.ShortName() ||
+		slices.Contains(r.Patch.Categories, selector)
+}
+
+// selectPatches returns the patches matched by any of the selectors, or all patches without selectors.
+func selectPatches(results []*parser.Result, selectors []string) (selected []*parser.Result) {
+	if len(selectors) == 0 {
+		return results
+	}
+
+	for _, r := range results {
+		for _, selector := range selectors {
+			if selects(r, selector) {
+				selected = append(selected, r)
+				break
+			}
+		}
+	}
+
+	return
+}
+
+// findPatch returns the patch with the given name.
+func findPatch(results []*parser.Result, name string) (*parser.Result, error) {
+	for _, r := range results {
+		if r.Name == name {
+			return r, nil
+		}
+	}
+
+	return nil, fmt.Errorf("patch %q not found", name)
+}
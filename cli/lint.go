@@ -0,0 +1,41 @@
+package cli
+
+import (
+	"fmt"
+)
+
+// newLintCommand returns the command that validates patch definitions.
+func newLintCommand() *Command {
+	var input inputOptions
+
+	cmd := newCommand("lint", "", "Check patch definitions for parse errors, invalid fields and duplicate names.")
+	input.register(cmd)
+
+	cmd.Run = func(app *App, args []string) error {
+		if len(args) > 0 {
+			return usageError{fmt.Errorf("unexpected arguments %v", args)}
+		}
+
+		results, errs := input.load(app)
+
+		problems := 0
+		for _, e := range errs {
+			fmt.Fprintln(app.Stdout, parseError(e))
+			problems++
+		}
+
+		for _, err := range validate(results) {
+			fmt.Fprintln(app.Stdout, err)
+			problems++
+		}
+
+		if problems > 0 {
+			return fmt.Errorf("%d problem(s) found", problems)
+		}
+
+		fmt.Fprintf(app.Stdout, "%d patch(es) ok\n", len(results))
+		return nil
+	}
+
+	return cmd
+}
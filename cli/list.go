@@ -0,0 +1,108 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"patchfiles/parser"
+
+	"gopkg.in/yaml.v2"
+)
+
+// listEntry is a single row of the list command output.
+type listEntry struct {
+	Name        string   `json:"name" yaml:"name"`
+	ShortName   string   `json:"shortName" yaml:"shortName"`
+	Categories  []string `json:"categories" yaml:"categories"`
+	Output      string   `json:"output" yaml:"output"`
+	Mode        string   `json:"mode" yaml:"mode"`
+	Risk        string   `json:"risk" yaml:"risk"`
+	Description string   `json:"description" yaml:"description"`
+}
+
+// newListCommand returns the command that lists patches.
+func newListCommand() *Command {
+	var (
+		input    inputOptions
+		category string
+		format   string
+	)
+
+	cmd := newCommand("list", "", "List patches with their short name, categories, output, mode, risk and description.")
+	input.register(cmd)
+	cmd.Flags.StringVar(&category, "category", "", "only list patches in this category")
+	cmd.Flags.StringVar(&format, "format", "table", "output format: table, json or yaml")
+
+	cmd.Run = func(app *App, args []string) error {
+		if len(args) > 0 {
+			return usageError{fmt.Errorf("unexpected arguments %v", args)}
+		}
+
+		results, err := input.loadValid(app)
+		if err != nil {
+			return err
+		}
+
+		entries := make([]listEntry, 0)
+		for _, r := range results {
+			if category != "" && !slices.Contains(r.Patch.Categories, category) {
+				continue
+			}
+			entries = append(entries, newListEntry(r))
+		}
+
+		return printFormatted(app.Stdout, format, entries, func(w io.Writer) {
+			tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "NAME\tSHORT\tCATEGORIES\tOUTPUT\tMODE\tRISK\tDESCRIPTION")
+			for _, e := range entries {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+					e.Name, e.ShortName, strings.Join(e.Categories, ","), e.Output, e.Mode, e.Risk, e.Description)
+			}
+			tw.Flush()
+		})
+	}
+
+	return cmd
+}
+
+// newListEntry returns the list row of a patch, with the description on a single line.
+func newListEntry(r *parser.Result) listEntry {
+	return listEntry{
+		Name:        r.Name,
+		ShortName:   r.ShortName(),
+		Categories:  r.Patch.Categories,
+		Output:      r.Patch.Output,
+		Mode:        r.Patch.Mode,
+		Risk:        r.Patch.RiskLevel(),
+		Description: strings.Join(strings.Fields(r.Patch.Description), " "),
+	}
+}
+
+// printFormatted writes a value as JSON or YAML, or calls table for the table format.
+// A nil table makes the table format invalid.
+func printFormatted(w io.Writer, format string, value any, table func(w io.Writer)) error {
+	switch {
+	case format == "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(value)
+
+	case format == "yaml":
+		body, err := yaml.Marshal(value)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(body)
+		return err
+
+	case format == "table" && table != nil:
+		table(w)
+		return nil
+	}
+
+	return usageError{fmt.Errorf("unknown format %q", format)}
+}
@@ -0,0 +1,60 @@
+package cli
+
+import (
+	"fmt"
+
+	"patchfiles/generator"
+)
+
+// newRenderCommand returns the command that prints the script blocks generated for one patch.
+func newRenderCommand() *Command {
+	var (
+		input       inputOptions
+		environment string
+		script      string
+	)
+
+	cmd := newCommand("render", "<patch>", "Print the bash blocks generated for a patch in the patch and revert scripts.")
+	input.register(cmd)
+	cmd.Flags.StringVar(&environment, "environment", envOr("ENVIRONMENT", "dev"), "environment to render for (env ENVIRONMENT)")
+	cmd.Flags.StringVar(&script, "script", "both", "script to render: patch, revert or both")
+
+	cmd.Run = func(app *App, args []string) error {
+		if len(args) != 1 {
+			return usageError{fmt.Errorf("expected one patch name, got %d arguments", len(args))}
+		}
+		if script != "patch" && script != "revert" && script != "both" {
+			return usageError{fmt.Errorf("unknown script %q", script)}
+		}
+
+		results, err := input.loadValid(app)
+		if err != nil {
+			return err
+		}
+
+		r, err := findPatch(results, args[0])
+		if err != nil {
+			return err
+		}
+
+		gen := generator.Generator{
+			Log:         app.Log,
+			Environment: environment,
+		}
+		patch, revert, err := gen.RenderItem(r)
+		if err != nil {
+			return err
+		}
+
+		if script != "revert" {
+			fmt.Fprintf(app.Stdout, "# ---- patch script ----\n%s", patch)
+		}
+		if script != "patch" {
+			fmt.Fprintf(app.Stdout, "# ---- revert script ----\n%s", revert)
+		}
+
+		return nil
+	}
+
+	return cmd
+}
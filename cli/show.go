@@ -0,0 +1,127 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"patchfiles/generator"
+)
+
+// newShowCommand returns the command that prints a fully resolved patch.
+func newShowCommand() *Command {
+	var (
+		input  inputOptions
+		format string
+	)
+
+	cmd := newCommand("show", "<patch>", "Print a patch as the scripts execute it: payload, backup, commands and revert.")
+	cmd.Help = "The payload is the exact content written, including the markers of append mode. Paths carry\nthe ${PATCHFILES_ROOT} prefix the scripts use."
+	input.register(cmd)
+	cmd.Flags.StringVar(&format, "format", "text", "output format: text, json or yaml")
+
+	cmd.Run = func(app *App, args []string) error {
+		if len(args) != 1 {
+			return usageError{fmt.Errorf("expected one patch name, got %d arguments", len(args))}
+		}
+
+		results, err := input.loadValid(app)
+		if err != nil {
+			return err
+		}
+
+		r, err := findPatch(results, args[0])
+		if err != nil {
+			return err
+		}
+
+		resolved := generator.Resolve(r)
+		if format == "text" {
+			printResolved(app.Stdout, resolved)
+			return nil
+		}
+
+		return printFormatted(app.Stdout, format, resolved, nil)
+	}
+
+	return cmd
+}
+
+// printResolved writes a resolved patch in a human readable form.
+func printResolved(w io.Writer, r *generator.Resolved) {
+	fmt.Fprintf(w, "Name:        %s\n", r.Name)
+	fmt.Fprintf(w, "Short name:  %s\n", r.ShortName)
+	fmt.Fprintf(w, "File:        %s\n", r.FileLoc)
+	if r.Kind != "" {
+		fmt.Fprintf(w, "Kind:        %s\n", r.Kind)
+	}
+	fmt.Fprintf(w, "Output:      %s\n", r.Output)
+	fmt.Fprintf(w, "Mode:        %s\n", r.Mode)
+	if r.Format != "" {
+		fmt.Fprintf(w, "Format:      %s\n", r.Format)
+	}
+	fmt.Fprintf(w, "Categories:  %s\n", strings.Join(r.Categories, ", "))
+	fmt.Fprintf(w, "Risk:        %s\n", r.Risk)
+	if r.Risky {
+		fmt.Fprintln(w, "Risky:       yes, the patch script reverts it unless confirmed")
+	}
+	fmt.Fprintf(w, "Description: %s\n", strings.Join(strings.Fields(r.Description), " "))
+
+	if len(r.Values) > 0 {
+		fmt.Fprintln(w, "\nValues (computed on the host, used as %{name}):")
+		for _, value := range r.Values {
+			fmt.Fprintf(w, "    %s\n", value)
+		}
+	}
+
+	fmt.Fprintln(w, "\nPayload:")
+	for _, line := range strings.Split(strings.TrimSuffix(r.Payload, "\n"), "\n") {
+		fmt.Fprintf(w, "    %s\n", line)
+	}
+
+	fmt.Fprintln(w, "\nApply:")
+	for _, command := range r.CommandsBefore {
+		fmt.Fprintf(w, "    %s\n", strings.TrimSuffix(command, "\n"))
+	}
+	if r.Backup != "" {
+		fmt.Fprintf(w, "    %s\n", r.Backup)
+	}
+	switch r.Mode {
+	case "diff":
+		fmt.Fprintf(w, "    apply payload to %s with patch, when every hunk matches (diff)\n", r.Output)
+	case "lines":
+		fmt.Fprintf(w, "    apply the rules to the lines of %s, recording the change (lines)\n", r.Output)
+	case "merge":
+		fmt.Fprintf(w, "    merge payload into %s as %s (merge)\n", r.Output, r.Format)
+	default:
+		fmt.Fprintf(w, "    write payload to %s (%s)\n", r.Output, r.Mode)
+	}
+	for _, command := range r.CommandsAfter {
+		fmt.Fprintf(w, "    %s\n", strings.TrimSuffix(command, "\n"))
+	}
+	printNotify(w, r.Notify)
+
+	if len(r.Verify) > 0 {
+		fmt.Fprintln(w, "\nVerify (after all patches and handlers):")
+		for _, assertion := range r.Verify {
+			fmt.Fprintf(w, "    %s\n", assertion)
+		}
+	}
+
+	fmt.Fprintln(w, "\nRevert:")
+	for _, command := range r.RevertBefore {
+		fmt.Fprintf(w, "    %s\n", strings.TrimSuffix(command, "\n"))
+	}
+	fmt.Fprintf(w, "    %s\n", r.Revert)
+	for _, command := range r.RevertAfter {
+		fmt.Fprintf(w, "    %s\n", strings.TrimSuffix(command, "\n"))
+	}
+	printNotify(w, r.Notify)
+}
+
+// printNotify writes the handlers a patch notifies.
+func printNotify(w io.Writer, notify []string) {
+	for _, handler := range notify {
+		fmt.Fprintf(w, "    notify %s (once, after all patches)\n", handler)
+	}
+}
@@ -0,0 +1,26 @@
+package cli
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Version is the patchfiles version, set at build time with
+// -ldflags "-X patchfiles/cli.Version=v1.2.3".
+var Version = "dev"
+
+// newVersionCommand returns the command that prints the version.
+func newVersionCommand() *Command {
+	cmd := newCommand("version", "", "Print the patchfiles version.")
+
+	cmd.Run = func(app *App, args []string) error {
+		if len(args) > 0 {
+			return usageError{fmt.Errorf("unexpected arguments %v", args)}
+		}
+
+		fmt.Fprintf(app.Stdout, "%s %s (%s %s/%s)\n", name, Version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+		return nil
+	}
+
+	return cmd
+}
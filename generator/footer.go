@@ -2,19 +2,25 @@ package generator
 
 import (
 	"bytes"
-	"os"
+	"encoding/base64"
+	"io"
 	"strings"
 	"text/template"
 
+	"patchfiles/parser"
+
 	"go.uber.org/zap"
 )
 
 // Footer contains template data for generating script footers.
 type Footer struct {
-	Names                 []string // List of all patch names for help output
-	Categories            []string // List of all categories for help output
-	ScriptFor             string   // Action type: "PATCHING" or "REVERTING"
-	PatchFilesControlFile string   // Path to control file that tracks patch status
+	Names                 []string          // List of all patch names for help output
+	Categories            []string          // List of all categories for help output
+	ScriptFor             string            // Action type: "PATCHING" or "REVERTING"
+	PatchFilesControlFile string            // Path to control file that tracks patch status
+	Handlers              []parser.Handler  // Handlers notified by the patches of the script, in the order they run
+	Rollback              string            // Base64-encoded revert script run by the rollback of risky patches, empty without risky patches
+	Risks                 map[string]string // Risk level of every patch by name, for help output
 }
 
 const (
@@ -35,15 +41,23 @@ const (
 
 		echo "Available patches are:";
 		{{ range $name := .Names }}
-			echo "* {{$name}}";
+			echo "* {{$name}}{{ with index $.Risks $name }} (risk: {{.}}){{ end }}";
 		{{ end }}
 
 		echo -e "\n";
 		echo "Examples:";
 		echo "./patch.sh all";
+		echo "./patch.sh all --include-risky";
+		echo "./patch.sh interactive";
 		echo "./patch.sh security";
 		echo "./patch.sh sshd";
+		echo "./patch.sh check all";
+		echo "./patch.sh reapply security";
+		echo "./patch.sh verify all";
+		echo "./patch.sh confirm";
+		echo "./patch.sh resume";
 		echo "./revert.sh sshd";
+		echo "./revert.sh interrupted";
 	}
 
 	if [[ "$category" == "" || "$category" == "help" ]]; then
@@ -51,20 +65,183 @@ const (
 		exit 1;
 	fi;
 
+	# one run at a time, and none while another run is interrupted, unless it resumes or reverts that run
+	if ! pf_lock; then
+		pf_log "exit reason=locked";
+		exit 1;
+	fi
+
+	if ! pf_interrupted; then
+		pf_log "exit reason=interrupted";
+		exit 1;
+	fi
+
+	{{ if eq .ScriptFor "PATCHING" }}
+		{{- if .Rollback }}
+		PF_ROLLBACK_SCRIPT="{{.Rollback}}";
+		{{ end }}
+		if [[ "$action" == "confirm" ]]; then
+			pf_confirm;
+			exit $?;
+		fi
+	{{ end }}
+
+	{{ if eq .ScriptFor "PATCHING" }}
+		if [[ "$category" == "interactive" && -z "$PF_RESUMING" ]]; then
+			if ! pf_interactive; then
+				echo "Nothing was changed.";
+				pf_log "exit reason=interactive-quit";
+				exit 1;
+			fi
+		fi
+	{{ end }}
+
+	for name in "${PF_NAMES[@]}"; do
+		if [[ "$category" == "interactive" && -z "$PF_RESUMING" ]]; then
+			[[ " ${PF_SELECTED[*]} " == *" $name "* ]] || pf_decision skipped-condition "$name" "selector=interactive";
+		elif pf_selects "$name"; then
+			PF_SELECTED+=("$name");
+		else
+			pf_decision skipped-condition "$name" "selector=$category";
+		fi
+	done
+
+	if [[ "${#PF_SELECTED[@]}" -eq 0 ]]; then
+		echo "No patch matches '$category', run with help to list patches and categories." >&2;
+		pf_log "exit reason=no-match";
+		exit 1;
+	fi
+
+	{{ if eq .ScriptFor "PATCHING" }}
+		# every bulk action leaves the high-risk patches out of all, a resumed run was confirmed when it started
+		if [[ -z "$PF_RESUMING" ]]; then
+			if ! pf_high_risk; then
+				echo "Nothing was changed.";
+				pf_log "exit reason=risk-declined";
+				exit 1;
+			fi
+			if [[ "${#PF_SELECTED[@]}" -eq 0 ]]; then
+				echo "Every selected patch is high-risk, pass --include-risky to select them." >&2;
+				pf_log "exit reason=risk";
+				exit 1;
+			fi
+		fi
+	{{ end }}
+
+	if [[ "$action" != "check" && "$action" != "verify" ]] && ! pf_preflight; then
+		pf_log "exit reason=preflight";
+		exit 1;
+	fi
+
 	{{ if eq .ScriptFor "PATCHING" }}
-		echo 1 > {{.PatchFilesControlFile}};
+		# the rollback of risky patches is scheduled before anything is changed, a resumed run keeps the
+		# rollback scheduled by the interrupted one
+		if [[ "$action" == "apply" || "$action" == "reapply" ]] && [[ -n "$(pf_risky_selected)" && "$PF_ROLLBACK_MINUTES" != "0" ]]; then
+			if [[ -n "$PF_RESUMING" ]] && test -f "$PF_ROLLBACK_DIR/job"; then
+				PF_ROLLBACK_SCHEDULED=1;
+			elif ! pf_schedule_rollback $(pf_risky_selected); then
+				echo "Cannot schedule the rollback of the risky patches, nothing was changed." >&2;
+				pf_log "exit reason=rollback";
+				exit 1;
+			fi
+		fi
+	{{ end }}
+
+	if ! pf_journal_open; then
+		echo "Cannot write the journal $PF_JOURNAL_FILE, nothing was changed." >&2;
+		pf_log "exit reason=journal";
+		exit 1;
+	fi
+
+	# the journal records every patch started and done, the patches an interrupted run finished keep
+	# their decisions
+	if [[ "$action" != "verify" ]]; then
+		for name in "${PF_SELECTED[@]}"; do
+			if [[ -n "${PF_FINISHED[$name]}" ]]; then
+				pf_decision "${PF_FINISHED[$name]}" "$name" interrupted-run;
+				continue;
+			fi
+
+			pf_journal start "$name";
+			{{ if eq .ScriptFor "PATCHING" }}"pf_patch_$name"{{ else }}"pf_revert_$name"{{ end }};
+			pf_journal done "$name" "${PF_DECISIONS[$name]}";
+		done
+	fi
+
+	{{- if .Handlers }}
+
+	# the handlers the patches notified run once each, in a fixed order, after all patches
+	{{- range $handler := .Handlers }}
+	if [[ -n "${PF_NOTIFIED[{{quote $handler.Name}}]}" ]]; then
+		echo "Running handler '{{$handler.Name}}'";
+		{{$handler.Command}};
+		pf_handler_done $? {{quote $handler.Name}};
+	fi
+	{{- end }}
+	{{- end }}
+
+	{{ if eq .ScriptFor "PATCHING" }}
+		# the assertions run after the handlers, for every selected patch that did not fail
+		if [[ "$action" != "check" ]]; then
+			for name in "${PF_SELECTED[@]}"; do
+				if [[ "${PF_DECISIONS[$name]}" != "failed" ]] && declare -F "pf_verify_$name" >/dev/null; then
+					"pf_verify_$name";
+				fi
+			done
+		fi
+
+		if [[ -n "$PF_ROLLBACK_SCHEDULED" ]]; then
+			pf_arm_rollback;
+		fi
+	{{ end }}
+
+	pf_journal_close;
+	pf_log "summary action=$action selector=$category done=$PF_DONE skipped=$PF_SKIPPED failed=$PF_FAILED commands_failed=$PF_COMMANDS_FAILED{{ if eq .ScriptFor "PATCHING" }} drifted=$PF_DRIFTED verify_failed=${#PF_VERIFY_FAILED[@]}{{ end }}";
+	if [[ -n "$PF_LOG_FILE" && "$PF_LOG_FILE" != "/dev/null" ]]; then
+		echo "Log written to $PF_LOG_FILE";
+	fi
+
+	# a failed patch exits with 1 and leaves the control file untouched
+	if [[ "$PF_FAILED" -gt 0 ]]; then
+		echo "$PF_FAILED patch(es) failed, see the log for details." >&2;
+		exit 1;
+	fi
+
+	{{ if eq .ScriptFor "PATCHING" }}
+		# check reports drift by its exit code, failed assertions exit with 1 after the control file is written
+		if [[ "$action" == "check" ]]; then
+			if [[ "$PF_DRIFTED" -gt 0 ]]; then
+				echo "$PF_DRIFTED patch(es) drifted. Run './patch.sh reapply $category' to re-converge.";
+				exit 1;
+			fi
+			echo "No drift detected.";
+		elif [[ "$action" == "apply" ]]; then
+			echo 1 > "${PATCHFILES_ROOT}{{.PatchFilesControlFile}}";
+		fi
+
+		if [[ "${#PF_VERIFY_FAILED[@]}" -gt 0 ]]; then
+			echo "The assertions of ${#PF_VERIFY_FAILED[@]} patch(es) failed: ${!PF_VERIFY_FAILED[*]}" >&2;
+			exit 1;
+		fi
+		if [[ "$action" == "verify" ]]; then
+			if [[ "$PF_ASSERTIONS" -eq 0 ]]; then
+				echo "The selected patches have no assertions.";
+			else
+				echo "All $PF_ASSERTIONS assertion(s) passed.";
+			fi
+		fi
 	{{ end }}	
 
 	{{ if eq .ScriptFor "REVERTING" }}
-		rm -f {{.PatchFilesControlFile}};
+		rm -f "${PATCHFILES_ROOT}{{.PatchFilesControlFile}}";
 	{{ end }}	
 `
 )
 
-// writeFooter generates and writes the bash script footer to the given file descriptor.
-// It includes a help function, category/patch listing, and logic to create/remove the control file
-// that tracks whether the system has been patched.
-func (generator *Generator) writeFooter(fd *os.File, scriptFor string) (err error) {
+// writeFooter generates and writes the bash script footer to the given writer.
+// It includes a help function, category/patch listing, runs the selected patches with their handlers
+// and assertions, and creates/removes the control file that tracks whether the system has been patched.
+func (generator *Generator) writeFooter(w io.Writer, scriptFor string) (err error) {
 	logger := generator.Log.WithOptions(zap.Fields())
 	logger.Debug("attempt to write footer",
 		zap.String("scriptFor", scriptFor),
@@ -72,13 +249,18 @@ func (generator *Generator) writeFooter(fd *os.File, scriptFor string) (err erro
 
 	buf := new(bytes.Buffer)
 
-	tpl, err := template.New("template").Parse(templateFooter)
+	tpl, err := template.New("template").Funcs(funcs).Parse(templateFooter)
 
 	obj := Footer{
 		ScriptFor:             scriptFor,
 		Names:                 generator.names,
 		Categories:            generator.categories,
-		PatchFilesControlFile: patchFilesControlFile,
+		PatchFilesControlFile: ControlFile,
+		Handlers:              orderHandlers(generator.notified),
+		Risks:                 generator.risks,
+	}
+	if scriptFor == "PATCHING" && len(generator.risky) > 0 {
+		obj.Rollback = base64.StdEncoding.EncodeToString(generator.revertCopy.Bytes())
 	}
 
 	t := template.Must(tpl, err)
@@ -90,8 +272,7 @@ func (generator *Generator) writeFooter(fd *os.File, scriptFor string) (err erro
 	res := buf.String()
 	res = strings.ReplaceAll(res, "\t", "")
 
-	fd.WriteString(res + "\n")
-	fd.Sync()
+	_, err = io.WriteString(w, res+"\n")
 
 	return
 }
@@ -2,46 +2,229 @@
 package generator
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"os"
-	"strings"
+	"path/filepath"
+	"slices"
+	"sort"
+	"text/template"
+	"time"
 
 	"patchfiles/parser"
 
 	"go.uber.org/zap"
 )
 
+const (
+	// DefaultNameTemplate names scripts patch.sh and revert.sh, with a "-<bundle>" suffix for
+	// category bundles and a "_dev" suffix in the dev environment.
+	DefaultNameTemplate = `{{.Action}}{{if .Bundle}}-{{.Bundle}}{{end}}{{if eq .Environment "dev"}}_dev{{end}}.sh`
+	// DefaultLogDir is the directory the scripts write their run logs to, unless PATCHFILES_LOG_DIR is set.
+	DefaultLogDir = "/var/log/patchfiles"
+	// DefaultRollbackMinutes is the time after which risky patches are reverted unless confirmed,
+	// unless PATCHFILES_ROLLBACK_MINUTES is set.
+	DefaultRollbackMinutes = 10
+	// RollbackDir is the directory the patch script keeps the scheduled rollback of risky patches in.
+	RollbackDir = "/var/lib/patchfiles/rollback"
+	// LockFile is the file the scripts take an flock on, so only one run changes the system at a time.
+	LockFile = "/var/lib/patchfiles/lock"
+	// JournalFile is the file the scripts record the steps of a run in, it is left behind by an interrupted run.
+	JournalFile = "/var/lib/patchfiles/journal"
+)
+
+// ScriptName contains template data for naming a generated script file.
+type ScriptName struct {
+	Action      string // Script action: "patch" or "revert"
+	Environment string // Environment name (dev, prod, etc.)
+	Bundle      string // Name of the category subset, empty for all patches
+}
+
 // Generator manages the generation of patch and revert bash scripts from YAML definitions.
+// The scripts are rendered into io.Writers passed to Start; Open and Close wrap this for files.
 type Generator struct {
-	Log         *zap.Logger // Logger instance for logging operations
-	Environment string      // Environment name (dev, prod, etc.)
+	Log             *zap.Logger // Logger instance for logging operations
+	Environment     string      // Environment name (dev, prod, etc.)
+	Author          string      // Author written in the header, AUTHOR environment variable when empty
+	Version         string      // Version written in the header, VERSION environment variable when empty
+	Built           time.Time   // Build time written in the header, current time when zero
+	OutputDir       string      // Directory Open creates the scripts in, working directory when empty
+	NameTemplate    string      // Template of script file names, DefaultNameTemplate when empty
+	Bundle          string      // Name of the category subset, used in file names
+	Categories      []string    // Only patches in one of these categories are written, all when empty
+	LogDir          string      // Default directory of the run logs written by the scripts, DefaultLogDir when empty
+	Syslog          bool        // Whether the scripts copy their run logs to syslog by default
+	RollbackMinutes int         // Default minutes after which risky patches are reverted unless confirmed, DefaultRollbackMinutes when zero
 
 	n          map[string]string // Map of patch names for tracking
 	names      []string          // List of all patch names
 	c          map[string]string // Map of categories for tracking
 	categories []string          // List of all categories
-	fdPatch    *os.File          // File descriptor for patch script
-	fdRevert   *os.File          // File descriptor for revert script
+	notified   []string          // Handlers notified by the written patches, in the order of their first notification
+	risky      []string          // Names of the written patches marked risky
+	risks      map[string]string // Risk level of every written patch by name, for the footer help output
+	patch      io.Writer         // Destination of the patch script
+	revert     io.Writer         // Destination of the revert script
+	revertCopy bytes.Buffer      // Copy of the revert script, embedded in the patch script for the rollback of risky patches
+	fdPatch    *os.File          // File descriptor for patch script, set by Open
+	fdRevert   *os.File          // File descriptor for revert script, set by Open
+}
+
+// Start directs the patch and revert scripts to the given writers and writes their headers.
+// It must be called before Write.
+func (generator *Generator) Start(patch, revert io.Writer) (err error) {
+	generator.n = make(map[string]string)
+	generator.c = make(map[string]string)
+	generator.names = nil
+	generator.categories = nil
+	generator.notified = nil
+	generator.risky = nil
+	generator.risks = make(map[string]string)
+	generator.revertCopy.Reset()
+	generator.patch = patch
+	generator.revert = io.MultiWriter(revert, &generator.revertCopy)
+
+	err = generator.writeHeader(patch, "PATCHING")
+	if err != nil {
+		return
+	}
+
+	err = generator.writeHeader(generator.revert, "REVERTING")
+	return
+}
+
+// Finish writes footers to both scripts. It collects all patch names and categories,
+// sorted so the output is stable, for the footer help output. The revert script is finished
+// first, so the patch script can embed it for the rollback of risky patches.
+func (generator *Generator) Finish() (err error) {
+	for name := range generator.n {
+		generator.names = append(generator.names, name)
+	}
+	for category := range generator.c {
+		generator.categories = append(generator.categories, category)
+	}
+	sort.Strings(generator.names)
+	sort.Strings(generator.categories)
+
+	err = generator.writeFooter(generator.revert, "REVERTING")
+	if err != nil {
+		return
+	}
+
+	err = generator.writeFooter(generator.patch, "PATCHING")
+	return
+}
+
+// Render returns the complete patch and revert scripts for the given parsed patches.
+func (generator *Generator) Render(results []*parser.Result) (patch, revert []byte, err error) {
+	bufPatch := new(bytes.Buffer)
+	bufRevert := new(bytes.Buffer)
+
+	err = generator.Start(bufPatch, bufRevert)
+	if err != nil {
+		return
+	}
+
+	for _, r := range results {
+		err = generator.write(r)
+		if err != nil {
+			return
+		}
+	}
+
+	err = generator.Finish()
+	if err != nil {
+		return
+	}
+
+	return bufPatch.Bytes(), bufRevert.Bytes(), nil
+}
+
+// RenderItem returns the patch and revert blocks of a single patch, without headers and footers.
+func (generator *Generator) RenderItem(p *parser.Result) (patch, revert []byte, err error) {
+	bufPatch := new(bytes.Buffer)
+	bufRevert := new(bytes.Buffer)
+
+	err = generator.writePatch(bufPatch, p)
+	if err != nil {
+		return
+	}
+
+	err = generator.writeRevert(bufRevert, p)
+	if err != nil {
+		return
+	}
+
+	return bufPatch.Bytes(), bufRevert.Bytes(), nil
+}
+
+// FileName returns the path of the script for the given action ("patch" or "revert"),
+// rendered from NameTemplate and placed in OutputDir.
+func (generator *Generator) FileName(action string) (fileLoc string, err error) {
+	nameTemplate := generator.NameTemplate
+	if nameTemplate == "" {
+		nameTemplate = DefaultNameTemplate
+	}
+
+	tpl, err := template.New("name").Parse(nameTemplate)
+	if err != nil {
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	err = tpl.Execute(buf, ScriptName{
+		Action:      action,
+		Environment: generator.Environment,
+		Bundle:      generator.Bundle,
+	})
+	if err != nil {
+		return
+	}
+
+	fileLoc = filepath.Join(generator.OutputDir, buf.String())
+	return
 }
 
 // Open creates and opens file descriptors for both patch and revert bash scripts.
-// It creates patch.sh (or patch_dev.sh in dev environment) and revert.sh (or revert_dev.sh).
-// Each file is created with executable permissions and gets a header written to it.
-func (generator *Generator) Open() {
+// File names come from FileName, e.g. patch.sh and revert.sh, or patch_dev.sh and revert_dev.sh
+// in the dev environment. Each file is created with executable permissions and gets a header written to it.
+// It returns the first error, with no file left open.
+func (generator *Generator) Open() (err error) {
 	files := []string{
 		"patch",
 		"revert",
 	}
 
-	generator.n = make(map[string]string)
-	generator.c = make(map[string]string)
+	if generator.OutputDir != "" {
+		err = os.MkdirAll(generator.OutputDir, 0o755)
+		if err != nil {
+			return fmt.Errorf("creating output directory: %w", err)
+		}
+	}
+
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, fd := range []*os.File{generator.fdPatch, generator.fdRevert} {
+			if fd != nil {
+				fd.Close()
+			}
+		}
+		generator.fdPatch, generator.fdRevert = nil, nil
+	}()
 
 	for _, name := range files {
-		fileLoc := fmt.Sprintf("%s.sh", name)
-		if generator.Environment == "dev" {
-			fileLoc = fmt.Sprintf("%s_dev.sh", name)
+		fileLoc, err := generator.FileName(name)
+		if err != nil {
+			return fmt.Errorf("naming %s script: %w", name, err)
 		}
+
 		fd, err := os.Create(fileLoc)
+		if err != nil {
+			return fmt.Errorf("opening %s script: %w", name, err)
+		}
 		os.Chmod(fileLoc, 0o755)
 
 		if name == "patch" {
@@ -49,53 +232,23 @@ func (generator *Generator) Open() {
 		} else {
 			generator.fdRevert = fd
 		}
+	}
 
-		if err != nil {
-			generator.Log.Error("error in opening file",
-				zap.Error(err),
-				zap.String("fileLoc", fileLoc),
-			)
-		} else {
-			action := fmt.Sprintf("%sING", strings.ToUpper(name))
-			err = generator.writeHeader(fd, action)
-			if err != nil {
-				generator.Log.Error("error in writing header",
-					zap.String("fileLoc", fileLoc),
-					zap.Error(err),
-				)
-			}
-		}
+	err = generator.Start(generator.fdPatch, generator.fdRevert)
+	if err != nil {
+		return fmt.Errorf("writing header: %w", err)
 	}
+
+	return nil
 }
 
 // Close writes footers to both patch and revert scripts, then closes and syncs the file descriptors.
-// It collects all patch names and categories for the footer help output before closing.
 func (generator *Generator) Close() {
-	for name := range generator.n {
-		generator.names = append(generator.names, name)
-	}
-	for category := range generator.c {
-		generator.categories = append(generator.categories, category)
-	}
-
-	files := []string{
-		"patch",
-		"revert",
-	}
-	for _, name := range files {
-		action := fmt.Sprintf("%sING", strings.ToUpper(name))
-		var err error
-		if name == "patch" {
-			err = generator.writeFooter(generator.fdPatch, action)
-		} else {
-			err = generator.writeFooter(generator.fdRevert, action)
-		}
-
-		if err != nil {
-			generator.Log.Error("error in writing footer",
-				zap.Error(err),
-			)
-		}
+	err := generator.Finish()
+	if err != nil {
+		generator.Log.Error("error in writing footer",
+			zap.Error(err),
+		)
 	}
 
 	if generator.fdPatch != nil {
@@ -111,22 +264,60 @@ func (generator *Generator) Close() {
 
 // Write generates output for a patch and revert script.
 func (generator *Generator) Write(p *parser.Result) {
+	err := generator.write(p)
+	if err != nil {
+		generator.Log.Error("error in writing patch",
+			zap.Error(err),
+			zap.String("name", p.Name),
+		)
+	}
+}
+
+// Includes reports whether a patch belongs to the generator's category subset.
+func (generator *Generator) Includes(p *parser.Result) bool {
+	if len(generator.Categories) == 0 {
+		return true
+	}
+
+	for _, category := range p.Patch.Categories {
+		if slices.Contains(generator.Categories, category) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// write records the patch name and categories for the footer and renders the patch into both scripts.
+// Patches outside the category subset are skipped.
+func (generator *Generator) write(p *parser.Result) (err error) {
+	if !generator.Includes(p) {
+		return
+	}
+
 	generator.n[p.Name] = ""
 	for _, category := range p.Patch.Categories {
 		generator.c[category] = ""
 	}
+	for _, name := range p.Patch.Notify {
+		if !slices.Contains(generator.notified, name) {
+			generator.notified = append(generator.notified, name)
+		}
+	}
+	if p.Patch.Risky {
+		generator.risky = append(generator.risky, p.Name)
+	}
+	generator.risks[p.Name] = p.Patch.RiskLevel()
 
-	err := generator.writePatch(p)
+	err = generator.writePatch(generator.patch, p)
 	if err != nil {
-		generator.Log.Error("error in writing patch file",
-			zap.Error(err),
-		)
+		return fmt.Errorf("writing patch: %w", err)
 	}
 
-	err = generator.writeRevert(p)
+	err = generator.writeRevert(generator.revert, p)
 	if err != nil {
-		generator.Log.Error("error in writing revert file",
-			zap.Error(err),
-		)
+		return fmt.Errorf("writing revert: %w", err)
 	}
+
+	return
 }
@@ -0,0 +1,113 @@
+package generator
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"patchfiles/parser"
+)
+
+func TestFileName(t *testing.T) {
+	cases := []struct {
+		gen  Generator
+		want string
+	}{
+		{gen: Generator{Environment: "prod"}, want: "patch.sh"},
+		{gen: Generator{Environment: "dev"}, want: "patch_dev.sh"},
+		{gen: Generator{Environment: "prod", Bundle: "security"}, want: "patch-security.sh"},
+		{gen: Generator{Environment: "dev", Bundle: "security", OutputDir: "out"}, want: filepath.Join("out", "patch-security_dev.sh")},
+		{gen: Generator{Environment: "stage", NameTemplate: "{{.Environment}}/{{.Action}}.bash"}, want: filepath.Join("stage", "patch.bash")},
+	}
+
+	for _, c := range cases {
+		got, err := c.gen.FileName("patch")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("FileName() = %q, want %q", got, c.want)
+		}
+	}
+}
+
+func TestRenderBundle(t *testing.T) {
+	gen, patches := newTestGenerator(t)
+	gen.Bundle = "networking"
+	gen.Categories = []string{"networking"}
+
+	results := []*parser.Result{patches["app_1"], patches["app_2"], patches["net_1"]}
+	patch, revert, err := gen.Render(results)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, script := range [][]byte{patch, revert} {
+		if !bytes.Contains(script, []byte("COMMAND 'net_1'")) {
+			t.Error("bundle is missing net_1")
+		}
+		if bytes.Contains(script, []byte("COMMAND 'app_")) {
+			t.Error("bundle contains patches outside its categories")
+		}
+	}
+
+	if strings.Contains(string(patch), `echo "* services"`) {
+		t.Error("help lists categories outside the bundle")
+	}
+}
+
+func TestTools(t *testing.T) {
+	got := Tools([]string{
+		"systemctl restart sshd",
+		`chmod +x "${PATCHFILES_ROOT}/usr/bin/autotune.sh"`,
+		`# reload rules
+udevadm control --reload && udevadm trigger
+SERVICE_FILE="/etc/x.service"
+cat > "$SERVICE_FILE" << 'EOFSERVICE'
+[Unit]
+ExecStart=/usr/bin/autotune.sh
+EOFSERVICE
+if [ -f /proc/sys/x ]; then sysctl -p; fi
+MEM_KB=$(awk '/MemTotal/ {print $2}' /proc/meminfo) # total memory
+echo done | logger -t test`,
+	})
+
+	want := []string{"awk", "cat", "chmod", "logger", "sysctl", "systemctl", "udevadm"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Tools() = %v, want %v", got, want)
+	}
+}
+
+func TestComputeValues(t *testing.T) {
+	root := t.TempDir()
+	err := os.MkdirAll(filepath.Join(root, "proc"), 0o755)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(root, "proc/cpuinfo"), []byte("processor\t: 0\n"), 0o644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileLoc := "tune_1.yaml"
+	p := &parser.Result{Name: "tune_1", FileLoc: &fileLoc, Patch: &parser.Patch{Values: parser.Values{
+		{Name: "mem", Expr: "mem_mb", Min: "64"},
+		{Name: "spare", Expr: "cpus - 1", Max: "mem"},
+	}}}
+
+	// facts missing from the root count as the smallest host
+	got, err := ComputeValues(t.Context(), p, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["mem"] != "64" || got["spare"] != "0" {
+		t.Errorf("ComputeValues() = %v", got)
+	}
+
+	p.Patch.Values = append(p.Patch.Values, parser.Value{Name: "per_spare", Expr: "mem / spare"})
+	if _, err := ComputeValues(t.Context(), p, root); err == nil || !strings.Contains(err.Error(), "division by 0") {
+		t.Errorf("division by zero: %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package generator
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"patchfiles/parser"
+
+	"go.uber.org/zap"
+)
+
+// update rewrites the golden files with the current output: go test ./generator -update
+var update = flag.Bool("update", false, "update golden files")
+
+// golden compares output with testdata/golden/<name>.golden, or rewrites it with -update.
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+
+	fileLoc := filepath.Join("testdata", "golden", name+".golden")
+	if *update {
+		err := os.MkdirAll(filepath.Dir(fileLoc), 0o755)
+		if err == nil {
+			err = os.WriteFile(fileLoc, got, 0o644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(fileLoc)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s (run with -update to accept it):\n%s", fileLoc, got)
+	}
+}
+
+// newTestGenerator returns a generator with fixed metadata and the fixture patches by name.
+func newTestGenerator(t *testing.T) (*Generator, map[string]*parser.Result) {
+	t.Helper()
+
+	results, errs := parser.Load(zap.NewNop(), os.DirFS("testdata"))
+	if len(errs) > 0 {
+		t.Fatalf("parsing fixtures: %v", errs[0].Error)
+	}
+
+	byName := make(map[string]*parser.Result)
+	for _, r := range results {
+		byName[r.Name] = r
+	}
+
+	gen := &Generator{
+		Log:         zap.NewNop(),
+		Environment: "test",
+		Author:      "tester",
+		Version:     "v0.0.0",
+		Built:       time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	return gen, byName
+}
+
+func TestGoldenHeader(t *testing.T) {
+	gen, _ := newTestGenerator(t)
+
+	for _, scriptFor := range []string{"PATCHING", "REVERTING"} {
+		t.Run(scriptFor, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			if err := gen.writeHeader(buf, scriptFor); err != nil {
+				t.Fatal(err)
+			}
+			golden(t, "header_"+scriptFor, buf.Bytes())
+		})
+	}
+}
+
+func TestGoldenFooter(t *testing.T) {
+	gen, _ := newTestGenerator(t)
+	gen.names = []string{"app_1", "app_2"}
+	gen.categories = []string{"networking", "services"}
+	gen.risks = map[string]string{"app_1": "low", "app_2": "high"}
+
+	for _, scriptFor := range []string{"PATCHING", "REVERTING"} {
+		t.Run(scriptFor, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			if err := gen.writeFooter(buf, scriptFor); err != nil {
+				t.Fatal(err)
+			}
+			golden(t, "footer_"+scriptFor, buf.Bytes())
+		})
+	}
+}
+
+func TestGoldenItems(t *testing.T) {
+	gen, patches := newTestGenerator(t)
+
+	cases := []struct {
+		mode  string
+		patch string
+	}{
+		{mode: "overwrite", patch: "app_1"},
+		{mode: "append", patch: "app_2"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.mode, func(t *testing.T) {
+			p := patches[c.patch]
+			if p.Patch.Mode != c.mode {
+				t.Fatalf("fixture %s has mode %s, want %s", c.patch, p.Patch.Mode, c.mode)
+			}
+
+			buf := new(bytes.Buffer)
+			if err := gen.writePatch(buf, p); err != nil {
+				t.Fatal(err)
+			}
+			golden(t, "patch_"+c.mode, buf.Bytes())
+
+			buf.Reset()
+			if err := gen.writeRevert(buf, p); err != nil {
+				t.Fatal(err)
+			}
+			golden(t, "revert_"+c.mode, buf.Bytes())
+		})
+	}
+}
+
+func TestRenderIsStable(t *testing.T) {
+	gen, patches := newTestGenerator(t)
+
+	results := []*parser.Result{patches["app_1"], patches["app_2"], patches["net_1"]}
+	patch1, revert1, err := gen.Render(results)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patch2, revert2, err := gen.Render(results)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(patch1, patch2) || !bytes.Equal(revert1, revert2) {
+		t.Error("rendering the same patches twice gives different scripts")
+	}
+}
@@ -0,0 +1,52 @@
+package generator
+
+import (
+	"slices"
+
+	"patchfiles/parser"
+)
+
+// Handlers returns the handlers the patches notify, each once, in the order they run, with their
+// commands, e.g. {"restart sshd", "systemctl restart sshd"}.
+func Handlers(patches []*parser.Result) []parser.Handler {
+	var names []string
+	for _, p := range patches {
+		for _, name := range p.Patch.Notify {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+
+	return orderHandlers(names)
+}
+
+// orderHandlers returns the handlers of names in the order of parser.Handlers, handlers of the
+// same kind in the order of names. Names that are no handler are left out.
+func orderHandlers(names []string) (handlers []parser.Handler) {
+	ranks := make(map[string]int)
+	for _, name := range names {
+		command, rank, err := parser.HandlerCommand(name)
+		if err != nil {
+			continue
+		}
+		ranks[name] = rank
+		handlers = append(handlers, parser.Handler{Name: name, Command: command})
+	}
+
+	slices.SortStableFunc(handlers, func(a, b parser.Handler) int {
+		return ranks[a.Name] - ranks[b.Name]
+	})
+
+	return
+}
+
+// handlerCommands returns the commands of the handlers a patch notifies, so the preflight check
+// covers their tools.
+func handlerCommands(p *parser.Result) (commands []string) {
+	for _, handler := range orderHandlers(p.Patch.Notify) {
+		commands = append(commands, handler.Command)
+	}
+
+	return
+}
@@ -2,6 +2,7 @@ package generator
 
 import (
 	"bytes"
+	"io"
 	"os"
 	"strings"
 	"text/template"
@@ -23,19 +24,1196 @@ const (
 	#
 	#
 
-	args=("$@")
+	# PATCHFILES_ROOT is prepended to every target, backup and state path
+	PATCHFILES_ROOT="${PATCHFILES_ROOT%/}"
+
+	# --allow-nonroot (or PATCHFILES_ALLOW_NONROOT=1) skips the root check, for testing with PATCHFILES_ROOT.
+	# --include-risky keeps high-risk patches in all, --yes also applies them without asking.
+	PF_ALLOW_NONROOT="${PATCHFILES_ALLOW_NONROOT:-0}"
+	PF_INCLUDE_RISKY=0
+	PF_YES=0
+	args=()
+	for arg in "$@"; do
+		case "$arg" in
+			--allow-nonroot) PF_ALLOW_NONROOT=1 ;;
+			--include-risky) PF_INCLUDE_RISKY=1 ;;
+			--yes) PF_YES=1; PF_INCLUDE_RISKY=1 ;;
+			*) args+=("$arg") ;;
+		esac
+	done
+
+	action="{{ if eq .ScriptFor "PATCHING" }}apply{{ else }}revert{{ end }}"
 	category="${args[0]}"
 
+	# every run writes a timestamped log to PATCHFILES_LOG_DIR, PATCHFILES_SYSLOG=1 copies it to syslog
+	PF_LOG_DIR="${PATCHFILES_LOG_DIR:-${PATCHFILES_ROOT}{{.LogDir}}}"
+	PF_SYSLOG="${PATCHFILES_SYSLOG:-{{ if .Syslog }}1{{ else }}0{{ end }}}"
+	PF_LOG_FILE=""
+	PF_DONE=0
+	PF_SKIPPED=0
+	PF_FAILED=0
+	PF_COMMANDS_FAILED=0
+
+	# pf_log appends a timestamped line to the log of this run and copies it to syslog when enabled.
+	# The log file is created on first use, so runs that only print the help leave no log behind.
+	function pf_log() {
+		if [[ "$category" == "" || "$category" == "help" ]]; then
+			return 0
+		fi
+
+		if [[ -z "$PF_LOG_FILE" ]]; then
+			PF_LOG_FILE="$PF_LOG_DIR/$(date -u +%Y%m%dT%H%M%SZ)-$action-$$.log"
+			if ! mkdir -p "$PF_LOG_DIR" 2>/dev/null || ! touch "$PF_LOG_FILE" 2>/dev/null; then
+				echo "Warning: cannot write to $PF_LOG_DIR, the log of this run is discarded" >&2
+				PF_LOG_FILE="/dev/null"
+			fi
+			pf_log "start action=$action selector=$category host=$HOSTNAME user=$(id -un) version={{.Version}}"
+		fi
+
+		echo "$(date -u +%Y-%m-%dT%H:%M:%SZ) $*" >> "$PF_LOG_FILE"
+		if [[ "$PF_SYSLOG" == "1" ]] && command -v logger >/dev/null; then
+			logger -t patchfiles -- "$*"
+		fi
+	}
+
+	# pf_decision logs what happened to a patch, records it and counts it for the summary line.
+	declare -A PF_DECISIONS
+	function pf_decision() {
+		local decision="$1" name="$2" reason="$3"
+
+		PF_DECISIONS["$name"]="$decision"
+
+		case "$decision" in
+			failed) PF_FAILED=$((PF_FAILED + 1)) ;;
+			skipped-*) PF_SKIPPED=$((PF_SKIPPED + 1)) ;;
+			*) PF_DONE=$((PF_DONE + 1)) ;;
+		esac
+
+		pf_log "decision=$decision patch=$name${reason:+ reason=$reason}"
+	}
+
+	# pf_command_done logs the exit code of a command run before or after writing or reverting a patch
+	# and returns it.
+	function pf_command_done() {
+		local code="$1" name="$2" command="$3"
+
+		if [[ "$code" -ne 0 ]]; then
+			PF_COMMANDS_FAILED=$((PF_COMMANDS_FAILED + 1))
+			echo "Warning: command '$command' of '$name' exited with $code" >&2
+		fi
+
+		pf_log "command patch=$name exit=$code command=$command"
+		return "$code"
+	}
+
+	# pf_notify queues handlers, e.g. 'restart sshd'. The footer runs every queued handler once,
+	# after all selected patches. The journal keeps them for a resumed run.
+	declare -A PF_NOTIFIED
+	function pf_notify() {
+		local handler
+
+		for handler in "$@"; do
+			PF_NOTIFIED["$handler"]=1
+			pf_journal notify "$handler"
+		done
+	}
+
+	# one run at a time: the footer takes an flock on PF_LOCK_FILE before anything else, waiting up to
+	# PATCHFILES_LOCK_TIMEOUT seconds for another run to finish
+	PF_LOCK_FILE="${PATCHFILES_ROOT}{{.LockFile}}"
+	PF_LOCK_TIMEOUT="${PATCHFILES_LOCK_TIMEOUT:-0}"
+
+	# pf_lock takes the lock on file descriptor 9, it is released when the script exits. The scheduled
+	# rollback of risky patches waits for the lock however long it takes.
+	function pf_lock() {
+		local code holder
+
+		if ! command -v flock >/dev/null; then
+			echo "Warning: flock is not installed, another run at the same time is not prevented" >&2
+			return 0
+		fi
+
+		mkdir -p "$(dirname "$PF_LOCK_FILE")" && exec 9>>"$PF_LOCK_FILE" || return 1
+		if [[ "$action" == "rollback" ]]; then
+			flock 9
+		elif [[ "$PF_LOCK_TIMEOUT" == "0" ]]; then
+			flock -n 9
+		else
+			flock -w "$PF_LOCK_TIMEOUT" 9
+		fi
+		code=$?
+
+		if [[ "$code" -ne 0 ]]; then
+			holder="$(cat "$PF_LOCK_FILE" 2>/dev/null)"
+			echo "Error: another run holds $PF_LOCK_FILE${holder:+ ($holder)}, try again when it is done." >&2
+			return 1
+		fi
+
+		echo "pid=$$ script=$PF_SCRIPT action=$action selector=$category" > "$PF_LOCK_FILE"
+	}
+
+	# runs that change targets keep a journal in PF_JOURNAL_FILE: the run, the selected patches, every
+	# patch started and done with its decision and every handler notified. The footer removes it at the
+	# end of the run, so a journal left behind is the record of an interrupted run.
+	PF_SCRIPT="{{ if eq .ScriptFor "PATCHING" }}patch{{ else }}revert{{ end }}"
+	PF_JOURNAL_FILE="${PATCHFILES_ROOT}{{.JournalFile}}"
+	PF_JOURNAL=""
+	PF_JOURNAL_CLEAR=""
+	PF_RESUMING=""
+	declare -A PF_RESUME PF_FINISHED
+
+	# pf_journal appends a line to the journal of this run, when it keeps one.
+	function pf_journal() {
+		if [[ -n "$PF_JOURNAL" ]]; then
+			echo "$*" >> "$PF_JOURNAL_FILE"
+		fi
+	}
+
+	# pf_journal_open starts the journal of a run that changes targets. A resumed run appends to the
+	# journal of the run it finishes.
+	function pf_journal_open() {
+		case "$action" in
+			apply|reapply|revert) ;;
+			*) return 0 ;;
+		esac
+
+		mkdir -p "$(dirname "$PF_JOURNAL_FILE")" || return 1
+		PF_JOURNAL=1
+		PF_JOURNAL_CLEAR=1
+		if [[ -n "$PF_RESUMING" ]]; then
+			pf_journal "resumed $(date -u +%Y-%m-%dT%H:%M:%SZ)"
+			return
+		fi
+
+		echo "run $PF_SCRIPT $action $category $(date -u +%Y-%m-%dT%H:%M:%SZ)" > "$PF_JOURNAL_FILE" || return 1
+		pf_journal "selected ${PF_SELECTED[*]}"
+	}
+
+	# pf_journal_close removes the journal at the end of the run that kept or finished it.
+	function pf_journal_close() {
+		if [[ -n "$PF_JOURNAL_CLEAR" ]]; then
+			rm -f "$PF_JOURNAL_FILE"
+		fi
+	}
+
+	# pf_interrupted reads the journal of an interrupted run. Other runs that change targets refuse to
+	# start while there is one. resume finishes the run with the script that started it: the patches
+	# it finished keep their decisions, the others run again and PF_RESUME marks those it started, the
+	# handlers it notified are queued. interrupted, of the revert script, reverts every patch an
+	# interrupted patch run started. It returns 1 when the run cannot go on.
+	function pf_interrupted() {
+		local kind rest name decision script="" run_action="" selector="" started="" running="" names=""
+		local -a order=()
+		local -A begun=()
+
+		case "$action" in
+			check|verify|confirm|rollback) return 0 ;;
+		esac
+
+		if ! test -f "$PF_JOURNAL_FILE"; then
+			if [[ "$action" == "resume" || "$action" == "interrupted" ]]; then
+				echo "No run was interrupted, nothing to $action."
+				pf_log "exit reason=not-interrupted"
+				exit 0
+			fi
+			return 0
+		fi
+
+		while read -r kind rest; do
+			case "$kind" in
+				run) read -r script run_action selector started <<< "$rest" ;;
+				selected) names="$rest" ;;
+				start)
+					running="$rest"
+					[[ -n "${begun[$rest]}" ]] || order+=("$rest")
+					begun["$rest"]=1
+					;;
+				done)
+					name="${rest%% *}"
+					decision="${rest#* }"
+					[[ "$running" == "$name" ]] && running=""
+					if [[ "$decision" == "failed" ]]; then
+						unset 'PF_FINISHED[$name]'
+					else
+						PF_FINISHED["$name"]="$decision"
+					fi
+					;;
+				notify) [[ "$action" == "resume" ]] && PF_NOTIFIED["$rest"]=1 ;;
+			esac
+		done < "$PF_JOURNAL_FILE"
+		local run="$script.sh $run_action $selector, started $started,"
+
+		case "$action" in
+			resume)
+				if [[ "$script" != "$PF_SCRIPT" ]]; then
+					echo "Error: $run was interrupted, run './$script.sh resume' to finish it." >&2
+					return 1
+				fi
+
+				for name in "${order[@]}"; do
+					[[ -n "${PF_FINISHED[$name]}" ]] || PF_RESUME["$name"]=1
+				done
+				echo "Resuming $run interrupted${running:+ at '$running'}."
+				pf_log "resume action=$run_action selector=$selector started=$started patches=$names"
+				action="$run_action"
+				category="$selector"
+				PF_ONLY="$names"
+				PF_RESUMING=1
+				;;
+			interrupted)
+				PF_FINISHED=()
+				if [[ "$script" != "patch" ]]; then
+					echo "Error: $run was interrupted, run './$script.sh resume' to finish it." >&2
+					return 1
+				fi
+
+				echo "Reverting the patches ${order[*]} of $run interrupted${running:+ at '$running'}."
+				pf_log "interrupted action=$run_action selector=$selector started=$started patches=${order[*]}"
+				action="rollback"
+				category="${order[*]}"
+				PF_ONLY="${order[*]}"
+				PF_JOURNAL_CLEAR=1
+				;;
+			*)
+				echo "Error: $run was interrupted${running:+ at '$running'}." >&2
+				if [[ "$script" == "patch" ]]; then
+					echo "Run './patch.sh resume' to finish it or './revert.sh interrupted' to revert the patches it started." >&2
+				else
+					echo "Run './revert.sh resume' to finish it." >&2
+				fi
+				return 1
+				;;
+		esac
+	}
+
+	# pf_handler_done logs the exit code of a handler, a failure counts like a failed command.
+	function pf_handler_done() {
+		local code="$1" handler="$2"
+
+		if [[ "$code" -ne 0 ]]; then
+			PF_COMMANDS_FAILED=$((PF_COMMANDS_FAILED + 1))
+			echo "Warning: handler '$handler' exited with $code" >&2
+		fi
+
+		pf_log "handler name=$handler exit=$code"
+	}
+
+	# every patch registers itself, the footer selects, preflights and runs the registered patches
+	PF_NAMES=()
+	PF_SELECTED=()
+	declare -A PF_SHORT PF_CATEGORIES PF_DESCRIPTION PF_TARGET PF_TOOLS PF_RISKY PF_HIGH_RISK
+
+	# pf_register records a patch with its short name, categories, description, target and the tools it calls.
+	function pf_register() {
+		local name="$1"
+
+		PF_NAMES+=("$name")
+		PF_SHORT["$name"]="$2"
+		PF_CATEGORIES["$name"]="$3"
+		PF_DESCRIPTION["$name"]="$4"
+		PF_TARGET["$name"]="$5"
+		PF_TOOLS["$name"]="$6"
+	}
+
+	# pf_selects reports whether a patch matches the selector: all, its short name or one of its categories.
+	# PF_ONLY, when set, lists the patch names to select instead, for rollback and resumed runs.
+	function pf_selects() {
+		local name="$1"
+
+		if [[ -n "${PF_ONLY+set}" ]]; then
+			[[ " $PF_ONLY " == *" $name "* ]]
+			return
+		fi
+
+		[[ "$category" == "all" || "$category" == "${PF_SHORT[$name]}" || " ${PF_CATEGORIES[$name]} " == *" $category "* ]]
+	}
+
+	# pf_writable reports whether a file and its directory can be written, or whether the nearest
+	# existing parent directory of a missing file can be written.
+	function pf_writable() {
+		local path="$1"
+
+		if test -e "$path"; then
+			test -w "$path" && test -w "$(dirname "$path")"
+			return
+		fi
+
+		while ! test -e "$path"; do
+			path="$(dirname "$path")"
+		done
+		test -d "$path" && test -w "$path"
+	}
+
+	# pf_preflight checks privileges, the commands the selected patches need and their targets.
+	# It prints every problem at once and returns 1 before anything is changed.
+	function pf_preflight() {
+		local name tool problem
+		local -a problems=()
+		local -A seen=()
+
+		if [[ "$EUID" -ne 0 && "$PF_ALLOW_NONROOT" != "1" ]]; then
+			problems+=("must run as root, --allow-nonroot skips this check for testing with PATCHFILES_ROOT")
+		fi
+
+		for tool in base64 grep awk cmp; do
+			command -v "$tool" >/dev/null || problems+=("missing command '$tool'")
+		done
+
+		for name in "${PF_SELECTED[@]}"; do
+			for tool in ${PF_TOOLS[$name]}; do
+				if [[ -z "${seen[$tool]}" ]] && ! command -v "$tool" >/dev/null; then
+					problems+=("missing command '$tool' needed by '$name'")
+				fi
+				seen["$tool"]=1
+			done
+
+			if ! pf_writable "${PF_TARGET[$name]}"; then
+				problems+=("cannot write '${PF_TARGET[$name]}' needed by '$name'")
+			fi
+		done
+		{{- if eq .ScriptFor "PATCHING" }}
+
+		# risky patches need a key to log in again with and, unless disabled, a scheduler for the rollback
+		local risky="$(pf_risky_selected)"
+		if [[ -n "$risky" ]]; then
+			if ! pf_authorized_keys; then
+				problems+=("no key in the authorized_keys of '$(pf_invoking_user)', the risky patches $risky could lock you out")
+			fi
+			if [[ "$PF_ROLLBACK_MINUTES" != "0" ]] && ! command -v systemd-run >/dev/null && ! command -v at >/dev/null; then
+				problems+=("missing command 'systemd-run' or 'at' to schedule the rollback of $risky, PATCHFILES_ROLLBACK_MINUTES=0 applies them without one")
+			fi
+			if test -f "$PF_ROLLBACK_DIR/job" && [[ -z "$PF_RESUMING" ]]; then
+				problems+=("the rollback of an earlier run is pending, run '$PF_CONFIRM_COMMAND' from a new session first")
+			fi
+		fi
+		{{- end }}
+
+		if [[ "${#problems[@]}" -eq 0 ]]; then
+			return 0
+		fi
+
+		echo "Preflight failed, nothing was changed:" >&2
+		for problem in "${problems[@]}"; do
+			echo "  * $problem" >&2
+			pf_log "preflight problem=$problem"
+		done
+
+		return 1
+	}
+
+	# pf_without_block prints a file without one patch's appended block. The start marker is matched
+	# as a prefix and the end marker as a whole line, both literally, so comment characters with
+	# regex meaning are safe and blocks of other patches stay untouched.
+	function pf_without_block() {
+		local output="$1" prefix="$2" end="$3"
+
+		PF_PREFIX="$prefix" PF_END="$end" awk '
+			index($0, ENVIRON["PF_PREFIX"]) == 1 { skip = 1 }
+			!skip { print }
+			skip && $0 == ENVIRON["PF_END"] { skip = 0 }
+		' "$output"
+	}
+
+	# pf_remove_block removes one patch's appended block from a file in place. It returns 2 when the
+	# file carries no block of the patch, so there is nothing to revert.
+	function pf_remove_block() {
+		local output="$1" prefix="$2" end="$3"
+
+		grep -qF -- "$prefix" "$output" 2>/dev/null || return 2
+
+		pf_without_block "$output" "$prefix" "$end" > "$output.patchfiles.tmp" && cat "$output.patchfiles.tmp" > "$output"
+		local status=$?
+		rm -f "$output.patchfiles.tmp"
+
+		return $status
+	}
+
+	# pf_ensure_newline terminates the last line of a non-empty file, so an appended block starts on its own line.
+	function pf_ensure_newline() {
+		local output="$1"
+
+		if [[ -s "$output" && -n "$(tail -c 1 "$output")" ]]; then
+			echo >> "$output"
+		fi
+	}
+
+	# pf_patch_file runs patch(1) with the base64 encoded unified diff on the target. Extra arguments
+	# like --dry-run and -R are passed on. No fuzz is allowed and no backup or reject files are left.
+	function pf_patch_file() {
+		local output="$1" payload="$2"
+		shift 2
+
+		echo "$payload" | base64 -d - | patch --force --fuzz=0 --silent --no-backup-if-mismatch --reject-file=- "$@" "$output"
+	}
+
+	# pf_revert_lines applies the diff recorded by pf_apply_lines in reverse, which restores the
+	# original lines, and removes the record. A target without a record was not changed, it returns 2
+	# then.
+	function pf_revert_lines() {
+		local output="$1" record="$2"
+
+		test -f "$record" || return 2
+
+		if ! patch --force --fuzz=0 --silent --no-backup-if-mismatch --reject-file=- --dry-run -R -i "$record" "$output" >&2; then
+			echo "Error: the lines recorded in '$record' do not match '$output' any more. The file is left unchanged." >&2
+			return 1
+		fi
+
+		patch --force --fuzz=0 --silent --no-backup-if-mismatch --reject-file=- -R -i "$record" "$output" && rm -f "$record"
+	}
+
 	{{ if eq .ScriptFor "PATCHING" }}
-		if test -f "{{.PatchFilesControlFile}}"; then
+		{{- .ValueFunctions }}
+		# pf_render prints a base64 encoded payload, base64 encoded again, with the placeholders of
+		# the values computed by a pf_values_<name> function, %{name}, replaced by PF_VALUE_<name>.
+		# Placeholders of other names are kept.
+		function pf_render() {
+			local name pairs=""
+
+			for name in ${!PF_VALUE_@}; do
+				pairs+="${name#PF_VALUE_}=${!name} "
+			done
+
+			echo "$1" | base64 -d - | awk -v pairs="$pairs" '
+				BEGIN {
+					n = split(pairs, pair, " ")
+					for (i = 1; i <= n; i++) {
+						eq = index(pair[i], "=")
+						value[substr(pair[i], 1, eq - 1)] = substr(pair[i], eq + 1)
+					}
+				}
+				{
+					line = $0
+					out = ""
+					while (match(line, /%[{][a-z][a-z0-9_]*[}]/)) {
+						name = substr(line, RSTART + 2, RLENGTH - 3)
+						out = out substr(line, 1, RSTART - 1) ((name in value) ? value[name] : substr(line, RSTART, RLENGTH))
+						line = substr(line, RSTART + RLENGTH)
+					}
+					print out line
+				}
+			' | base64 | tr -d '\n'
+		}
+
+		# pf_lines prints a file with the line rules in the environment applied: PF_RULES is the
+		# number of rules, PF_MATCH_<n>, PF_LINE_<n> and PF_STATE_<n> describe rule n and PF_COMMENT
+		# is the comment character. A present rule replaces its first match with its line and drops
+		# further matches, an absent rule drops matches and a commented rule comments matches out.
+		# Lines of present rules that matched nothing are appended.
+		function pf_lines() {
+			awk '
+				BEGIN {
+					n = ENVIRON["PF_RULES"]
+					comment = ENVIRON["PF_COMMENT"]
+					for (i = 1; i <= n; i++) {
+						re[i] = ENVIRON["PF_MATCH_" i]
+						line[i] = ENVIRON["PF_LINE_" i]
+						state[i] = ENVIRON["PF_STATE_" i]
+					}
+				}
+				{
+					keep = 1
+					for (i = 1; i <= n && keep; i++) {
+						if (state[i] == "commented") {
+							if (index($0, comment) != 1 && $0 ~ re[i]) $0 = comment $0
+						} else if ($0 ~ re[i]) {
+							if (state[i] == "absent" || done[i]) keep = 0
+							else { $0 = line[i]; done[i] = 1 }
+						}
+					}
+					if (keep) print
+				}
+				END {
+					for (i = 1; i <= n; i++) if (state[i] == "present" && !done[i]) print line[i]
+				}
+			' "$1"
+		}
+
+		# pf_apply_lines writes the target as printed by an editor function, e.g. pf_edit_<name>,
+		# and records the change as a unified diff, so revert restores the original lines exactly.
+		# An existing record is kept, reapply edits the lines on top of it, which puts the lines of
+		# the rules back and so keeps the record applicable in reverse. It returns 2 without writing
+		# anything when the target complies already.
+		function pf_apply_lines() {
+			local output="$1" record="$2" editor="$3" label="${1#"$PATCHFILES_ROOT"}" status
+
+			if ! test -f "$output"; then
+				echo "Error: '$output' does not exist, lines mode edits existing files." >&2
+				return 1
+			fi
+
+			"$editor" "$output" > "$output.patchfiles.tmp" || { rm -f "$output.patchfiles.tmp"; return 1; }
+			if cmp -s "$output" "$output.patchfiles.tmp"; then
+				rm -f "$output.patchfiles.tmp"
+				return 2
+			fi
+
+			if ! test -f "$record"; then
+				diff -u --label "$label" --label "$label" "$output" "$output.patchfiles.tmp" > "$record"
+				if [[ $? -gt 1 ]]; then
+					rm -f "$output.patchfiles.tmp" "$record"
+					return 1
+				fi
+			fi
+
+			cat "$output.patchfiles.tmp" > "$output"
+			status=$?
+			rm -f "$output.patchfiles.tmp"
+
+			return $status
+		}
+
+		# pf_merge prints a file with a fragment deep merged into it, like the merge package of
+		# patchfiles: pf_merge <json|yaml|ini|toml> <file> <base64 fragment>. JSON objects and YAML
+		# mappings are merged key by key, other values are replaced. INI and TOML files are merged
+		# by section and key, keeping their comments. A missing file counts as empty.
+		function pf_merge() {
+			python3 - "$@" <<'PF_MERGE'
+			import base64, json, sys
+
+
+			def split(text):
+			    lines = text.split("\n")
+			    if lines[-1] == "":
+			        lines.pop()
+			    return lines
+
+
+			def scan(line, quote, depth):
+			    i = 0
+			    while i < len(line):
+			        c = line[i]
+			        if quote in ('"""', "'''"):
+			            if line.startswith(quote, i):
+			                quote = ""
+			                i += 2
+			            elif quote == '"""' and c == "\\":
+			                i += 1
+			        elif quote == '"':
+			            if c == "\\":
+			                i += 1
+			            elif c == '"':
+			                quote = ""
+			        elif quote == "'":
+			            if c == "'":
+			                quote = ""
+			        elif line.startswith('"""', i) or line.startswith("'''", i):
+			            quote = line[i:i + 3]
+			            i += 2
+			        elif c in "\"'":
+			            quote = c
+			        elif c == "#":
+			            return "", depth
+			        elif c in "[{":
+			            depth += 1
+			        elif c in "]}":
+			            depth -= 1
+			        i += 1
+			    return (quote if len(quote) == 3 else ""), depth
+
+
+			def section_name(line):
+			    if line.startswith("[["):
+			        return "[[" + line[2:].split("]]", 1)[0].strip() + "]]"
+			    return line[1:].split("]", 1)[0].strip()
+
+
+			def parse(lines, toml, strict):
+			    items, i = [], 0
+			    while i < len(lines):
+			        line = lines[i].strip()
+			        if not line or line[0] in "#;":
+			            i += 1
+			            continue
+			        if line[0] == "[":
+			            name = section_name(line)
+			            if strict and toml and name.startswith("[["):
+			                raise ValueError("fragment: line %d: arrays of tables cannot be merged" % (i + 1))
+			            items.append((True, name, i, i + 1))
+			            i += 1
+			            continue
+			        key, found, value = line.partition("=")
+			        if not found:
+			            if strict:
+			                raise ValueError("fragment: line %d: %r is neither a section nor a key" % (i + 1, lines[i]))
+			            i += 1
+			            continue
+			        end = i + 1
+			        if toml:
+			            quote, depth = scan(value, "", 0)
+			            while (quote or depth > 0) and end < len(lines):
+			                quote, depth = scan(lines[end], quote, depth)
+			                end += 1
+			        items.append((False, key.strip(), i, end))
+			        i = end
+			    return items
+
+
+			def find(lines, section, top, toml):
+			    header, keys, found = -1, [], top
+			    for is_section, name, start, end in parse(lines, toml, False):
+			        if is_section and found:
+			            break
+			        if is_section and name == section:
+			            header, found = start, True
+			        elif not is_section and found:
+			            keys.append((name, start, end))
+			    return header, keys, found
+
+
+			def merge_lines(text, fragment, toml):
+			    lines, frag = split(text), split(fragment)
+			    section, top = "", True
+			    for is_section, name, start, end in parse(frag, toml, True):
+			        if is_section:
+			            section, top = name, False
+			            if not find(lines, section, False, toml)[2]:
+			                if lines and lines[-1].strip():
+			                    lines.append("")
+			                lines.append(frag[start].strip())
+			            continue
+			        header, keys, _ = find(lines, section, top, toml)
+			        matches = [key for key in keys if key[0] == name]
+			        if not matches:
+			            at = keys[-1][2] if keys else header + 1
+			            lines[at:at] = frag[start:end]
+			            continue
+			        for _, first, last in reversed(matches[1:]):
+			            del lines[first:last]
+			        lines[matches[0][1]:matches[0][2]] = frag[start:end]
+			    return "".join(line + "\n" for line in lines)
+
+
+			def deep(dst, src):
+			    if not isinstance(dst, dict) or not isinstance(src, dict):
+			        return src
+			    # a copy, so that merging into a YAML alias leaves the anchored mapping alone
+			    dst = dict(dst)
+			    for key, value in src.items():
+			        dst[key] = deep(dst.get(key), value)
+			    return dst
+
+
+			def merge(fmt, text, fragment):
+			    if fmt in ("ini", "toml"):
+			        return merge_lines(text, fragment, fmt == "toml")
+			    if fmt == "json":
+			        load, kind = json.loads, "JSON object"
+			    else:
+			        import yaml
+			        load, kind = yaml.safe_load, "YAML mapping"
+			    src = load(fragment)
+			    dst = load(text) if text.strip() else {}
+			    if not isinstance(src, dict):
+			        raise ValueError("fragment: not a " + kind)
+			    if not isinstance(dst, dict):
+			        raise ValueError("not a " + kind)
+			    if fmt == "json":
+			        return json.dumps(deep(dst, src), indent=2, ensure_ascii=False) + "\n"
+			    # aliases are written out in full, like the merge package does
+			    dumper = type("Dumper", (yaml.SafeDumper,), {"ignore_aliases": lambda self, data: True})
+			    return yaml.dump(deep(dst, src), Dumper=dumper, default_flow_style=False, sort_keys=False, allow_unicode=True)
+
+
+			fmt, path = sys.argv[1], sys.argv[2]
+			try:
+			    try:
+			        with open(path, encoding="utf-8") as f:
+			            text = f.read()
+			    except FileNotFoundError:
+			        text = ""
+			    out = merge(fmt, text, base64.b64decode(sys.argv[3]).decode("utf-8"))
+			except ImportError:
+			    sys.exit("Error: merging YAML into '%s' needs the python3 yaml module. The file is left unchanged." % path)
+			except Exception as err:
+			    sys.exit("Error: cannot merge into '%s': %s. The file is left unchanged." % (path, err))
+			sys.stdout.buffer.write(out.encode("utf-8"))
+PF_MERGE
+		}
+
+		# pf_apply_merge writes the target as printed by an editor function, e.g. pf_edit_<name>,
+		# after taking a backup like overwrite mode, unless one exists from an earlier run. It
+		# returns 2 without writing anything when the target carries the fragment already.
+		function pf_apply_merge() {
+			local output="$1" editor="$2" status
+
+			"$editor" "$output" > "$output.patchfiles.tmp" || { rm -f "$output.patchfiles.tmp"; return 1; }
+			if test -f "$output" && cmp -s "$output" "$output.patchfiles.tmp"; then
+				rm -f "$output.patchfiles.tmp"
+				return 2
+			fi
+
+			if ! test -e "$output.oldpatchfile" && ! test -e "$output.newpatchfile"; then
+				pf_take_backup "$output" || { rm -f "$output.patchfiles.tmp"; return 1; }
+			fi
+
+			cat "$output.patchfiles.tmp" > "$output"
+			status=$?
+			rm -f "$output.patchfiles.tmp"
+
+			return $status
+		}
+
+		# pf_diff_applied reports whether the target carries the diff already, which is the case
+		# when the diff applies in reverse.
+		function pf_diff_applied() {
+			pf_patch_file "$1" "$2" --dry-run -R >/dev/null 2>&1
+		}
+
+		# pf_apply_diff applies the base64 encoded unified diff to the target, only when every hunk
+		# matches, so a changed file is never left half patched.
+		function pf_apply_diff() {
+			local output="$1" payload="$2"
+
+			if ! pf_patch_file "$output" "$payload" --dry-run >&2; then
+				echo "Error: the diff does not apply to '$output', its hunks do not match. The file is left unchanged." >&2
+				return 1
+			fi
+
+			pf_patch_file "$output" "$payload"
+		}
+
+		# pf_take_backup saves the target before it is overwritten. A target that does not exist yet
+		# is recorded with a .newpatchfile marker, so revert knows to remove it.
+		function pf_take_backup() {
+			local output="$1"
+
+			if test -e "$output"; then
+				cp -a "$output" "$output.oldpatchfile"
+			else
+				touch "$output.newpatchfile"
+			fi
+		}
+
+		# pf_verified reports an assertion of a patch: the command exited with code and printed
+		# PF_OUTPUT, which must equal or contain the expected text when one is given. A failed
+		# assertion is counted for its patch and fails the run.
+		PF_ASSERTIONS=0
+		declare -A PF_VERIFY_FAILED
+		function pf_verified() {
+			local code="$1" name="$2" command="$3" equals="$4" contains="$5" problem=""
+
+			PF_ASSERTIONS=$((PF_ASSERTIONS + 1))
+			if [[ "$code" -ne 0 ]]; then
+				problem="exited with $code"
+			elif [[ -n "$equals" && "$PF_OUTPUT" != "$equals" ]]; then
+				problem="printed '$PF_OUTPUT', want '$equals'"
+			elif [[ -n "$contains" && "$PF_OUTPUT" != *"$contains"* ]]; then
+				problem="printed '$PF_OUTPUT', want it to contain '$contains'"
+			fi
+
+			if [[ -z "$problem" ]]; then
+				echo "PASS   $name: $command"
+				pf_log "verify patch=$name result=pass command=$command"
+				return 0
+			fi
+
+			PF_VERIFY_FAILED["$name"]=$((${PF_VERIFY_FAILED[$name]:-0} + 1))
+			echo "FAIL   $name: $command $problem"
+			pf_log "verify patch=$name result=fail command=$command problem=$problem"
+			return 1
+		}
+
+		# risky patches are reverted by PF_ROLLBACK_DIR/rollback.sh after PATCHFILES_ROLLBACK_MINUTES,
+		# unless the operator confirms them from a new session, 0 applies them without a rollback
+		PF_ROLLBACK_MINUTES="${PATCHFILES_ROLLBACK_MINUTES:-{{.RollbackMinutes}}}"
+		PF_ROLLBACK_DIR="${PATCHFILES_ROOT}{{.RollbackDir}}"
+		PF_ROLLBACK_SCHEDULED=""
+		# PATCHFILES_CONFIRM_COMMAND names the command confirming the risky patches where patch.sh is not
+		# stored on the host, e.g. when it is streamed by 'patchfiles apply -hosts'
+		PF_CONFIRM_COMMAND="${PATCHFILES_CONFIRM_COMMAND:-./patch.sh confirm}"
+
+		# pf_risky_selected prints the selected patches marked risky.
+		function pf_risky_selected() {
+			local name
+			local -a risky=()
+
+			for name in "${PF_SELECTED[@]}"; do
+				[[ -n "${PF_RISKY[$name]}" ]] && risky+=("$name")
+			done
+
+			echo "${risky[*]}"
+		}
+
+		# pf_invoking_user prints the user who ran the script, the one behind sudo when there is one.
+		function pf_invoking_user() {
+			echo "${SUDO_USER:-$(id -un)}"
+		}
+
+		# pf_authorized_keys reports whether the invoking user has at least one key in authorized_keys
+		# or authorized_keys2, so a patch turning off passwords does not lock them out.
+		function pf_authorized_keys() {
+			local user home file
+
+			user="$(pf_invoking_user)"
+			home="$(getent passwd "$user" 2>/dev/null | cut -d: -f6)"
+			home="${home:-$HOME}"
+
+			for file in "${PATCHFILES_ROOT}$home/.ssh/authorized_keys" "${PATCHFILES_ROOT}$home/.ssh/authorized_keys2"; do
+				grep -qE '^[^#[:space:]]' "$file" 2>/dev/null && return 0
+			done
+
+			return 1
+		}
+
+		# pf_schedule_rollback writes the embedded revert script with a rollback.sh reverting the given
+		# patches to PF_ROLLBACK_DIR and schedules it after PF_ROLLBACK_MINUTES with systemd-run, or at
+		# when systemd-run is missing or fails. It runs before anything is changed.
+		function pf_schedule_rollback() {
+			local job=""
+
+			mkdir -p "$PF_ROLLBACK_DIR" || return 1
+			echo "$PF_ROLLBACK_SCRIPT" | base64 -d - > "$PF_ROLLBACK_DIR/revert.sh" || return 1
+			echo "$*" > "$PF_ROLLBACK_DIR/patches"
+			echo "$SSH_CONNECTION" > "$PF_ROLLBACK_DIR/session"
+			{
+				echo "#!/usr/bin/env bash"
+				echo "# reverts the risky patches of the run at $(date -u +%Y-%m-%dT%H:%M:%SZ) unless 'patch.sh confirm' cancels it"
+				printf 'export PATCHFILES_ROOT=%q PATCHFILES_ALLOW_NONROOT=%q PATCHFILES_LOG_DIR=%q PATCHFILES_SYSLOG=%q\n' \
+					"$PATCHFILES_ROOT" "$PF_ALLOW_NONROOT" "$PF_LOG_DIR" "$PF_SYSLOG"
+				printf 'bash %q rollback $(cat %q)\n' "$PF_ROLLBACK_DIR/revert.sh" "$PF_ROLLBACK_DIR/patches"
+				printf 'rm -rf %q\n' "$PF_ROLLBACK_DIR"
+			} > "$PF_ROLLBACK_DIR/rollback.sh"
+
+			if command -v systemd-run >/dev/null && systemd-run --unit=patchfiles-rollback --on-active="${PF_ROLLBACK_MINUTES}m" \
+				--collect bash "$PF_ROLLBACK_DIR/rollback.sh" >/dev/null 2>&1; then
+				job="systemd"
+			elif command -v at >/dev/null; then
+				job="$(echo "bash $(printf %q "$PF_ROLLBACK_DIR/rollback.sh")" | at now + "$PF_ROLLBACK_MINUTES" minutes 2>&1 | awk '$1 == "job" { print "at " $2 }')"
+			fi
+
+			if [[ -z "$job" ]]; then
+				rm -rf "$PF_ROLLBACK_DIR"
+				return 1
+			fi
+
+			echo "$job" > "$PF_ROLLBACK_DIR/job"
+			PF_ROLLBACK_SCHEDULED=1
+			pf_log "rollback state=scheduled job=$job minutes=$PF_ROLLBACK_MINUTES patches=$*"
+		}
+
+		# pf_cancel_rollback cancels the scheduled rollback and removes PF_ROLLBACK_DIR.
+		function pf_cancel_rollback() {
+			local job code=0
+
+			job="$(cat "$PF_ROLLBACK_DIR/job" 2>/dev/null)"
+			case "$job" in
+				systemd) systemctl stop patchfiles-rollback.timer; code=$? ;;
+				at\ *) atrm "${job#at }"; code=$? ;;
+			esac
+			if [[ "$code" -ne 0 ]]; then
+				echo "Warning: cannot cancel the rollback job '$job', remove it by hand" >&2
+			fi
+
+			rm -rf "$PF_ROLLBACK_DIR"
+		}
+
+		# pf_arm_rollback narrows the scheduled rollback to the risky patches this run wrote, or cancels
+		# it when there are none, and tells the operator how to keep them.
+		function pf_arm_rollback() {
+			local name
+			local -a written=()
+
+			for name in $(pf_risky_selected); do
+				case "${PF_DECISIONS[$name]}" in
+					applied|reapplied) written+=("$name") ;;
+				esac
+			done
+
+			if [[ "${#written[@]}" -eq 0 ]]; then
+				pf_cancel_rollback
+				pf_log "rollback state=cancelled reason=nothing-written"
+				return
+			fi
+
+			echo "${written[*]}" > "$PF_ROLLBACK_DIR/patches"
+			echo "The risky patches ${written[*]} are reverted in $PF_ROLLBACK_MINUTES minute(s) unless you log in from a new session and run '$PF_CONFIRM_COMMAND'."
+			pf_log "rollback state=armed patches=${written[*]}"
+		}
+
+		# pf_confirm keeps the risky patches of the last run by cancelling their rollback. It refuses
+		# to run from the SSH connection that applied them, only a new login proves it still works.
+		function pf_confirm() {
+			if ! test -f "$PF_ROLLBACK_DIR/job"; then
+				echo "No rollback is pending."
+				return 0
+			fi
+
+			if [[ -n "$SSH_CONNECTION" && "$SSH_CONNECTION" == "$(cat "$PF_ROLLBACK_DIR/session" 2>/dev/null)" ]]; then
+				echo "Error: run confirm from a new SSH session, logging in again proves the risky patches did not lock you out." >&2
+				return 1
+			fi
+
+			local patches="$(cat "$PF_ROLLBACK_DIR/patches" 2>/dev/null)"
+			pf_cancel_rollback
+			echo "Confirmed $patches, the rollback is cancelled."
+			pf_log "rollback state=confirmed patches=$patches"
+		}
+
+		# pf_high_risk leaves the high-risk patches out of all, unless --include-risky or --yes is given,
+		# and lists what the remaining ones do before asking to apply or reapply them, unless --yes is
+		# given. It returns 1 when the operator declines or cannot be asked.
+		function pf_high_risk() {
+			local name answer
+			local -a kept=() excluded=() high=()
+
+			for name in "${PF_SELECTED[@]}"; do
+				if [[ -z "${PF_HIGH_RISK[$name]+set}" ]]; then
+					kept+=("$name")
+				elif [[ "$category" == "all" && "$PF_INCLUDE_RISKY" != "1" ]]; then
+					excluded+=("$name")
+					pf_decision skipped-condition "$name" "risk=high"
+				else
+					kept+=("$name")
+					high+=("$name")
+				fi
+			done
+			PF_SELECTED=("${kept[@]}")
+
+			if [[ "${#excluded[@]}" -gt 0 ]]; then
+				echo "Leaving out the high-risk patches ${excluded[*]}, pass --include-risky to select them."
+			fi
+			# check and verify change nothing, there is nothing to confirm
+			if [[ "${#high[@]}" -eq 0 || "$PF_YES" == "1" || ( "$action" != "apply" && "$action" != "reapply" ) ]]; then
+				return 0
+			fi
+
+			echo "The high-risk patches ${high[*]} will:"
+			for name in "${high[@]}"; do
+				echo "  $name: ${PF_DESCRIPTION[$name]}"
+				while IFS= read -r answer; do
+					echo "    * $answer"
+				done <<< "${PF_HIGH_RISK[$name]}"
+			done
+
+			if [[ ! -t 0 ]]; then
+				echo "Error: high-risk patches are applied after a confirmation on a terminal, pass --yes to apply them without one." >&2
+				return 1
+			fi
+			read -r -p "Apply the high-risk patches? [y/N] " answer || return 1
+			[[ "$answer" == "y" || "$answer" == "Y" || "$answer" == "yes" ]]
+		}
+
+		# check, reapply and verify take the selector as the second argument, confirm and resume take none
+		if [[ "$category" == "check" || "$category" == "reapply" || "$category" == "verify" ]]; then
+			action="$category"
+			category="${args[1]:-all}"
+		elif [[ "$category" == "confirm" || "$category" == "resume" ]]; then
+			action="$category"
+		fi
+
+		if [[ "$action" == "apply" ]] && test -f "${PATCHFILES_ROOT}{{.PatchFilesControlFile}}"; then
 			echo "System already patched exiting"
+			pf_log "exit reason=already-patched"
 			exit 0
 		fi
+
+		PF_DRIFTED=0
+
+		# pf_diff shows how a patch changes its target: the whole file in overwrite mode, the file
+		# with this patch's block replaced in append mode, or the diff itself in diff mode, which is
+		# passed as "diff" in place of the block markers. Lines and merge mode pass "edit" and the
+		# editor function of the patch in place of the markers.
+		function pf_diff() {
+			local output="$1" payload="$2" prefix="$3" end="$4" current="$1"
+
+			if [[ "$prefix" == "diff" ]]; then
+				if pf_diff_applied "$output" "$payload"; then
+					echo "$output carries the diff already"
+				else
+					echo "$payload" | base64 -d -
+				fi
+				return
+			fi
+
+			if ! command -v diff >/dev/null; then
+				echo "diff is not installed, cannot show the changes to $output"
+				return
+			fi
+			test -f "$output" || current="/dev/null"
+
+			if [[ "$prefix" == "edit" ]]; then
+				diff -u --label "$output" --label "$output (patched)" "$current" <("$end" "$current")
+				return
+			fi
+
+			if [[ -z "$prefix" ]]; then
+				diff -u --label "$output" --label "$output (patched)" "$current" <(echo "$payload" | base64 -d -)
+			else
+				diff -u --label "$output" --label "$output (patched)" "$current" \
+					<(pf_without_block "$current" "$prefix" "$end"; echo "$payload" | base64 -d -)
+			fi
+		}
+
+		# pf_interactive lets the user pick the patches to apply on a terminal: by number from a list
+		# with descriptions and categories, or by answering y/n for each patch. A diff of any patch is
+		# shown on request. It returns 1 when stdin is not a terminal or the user quits.
+		function pf_interactive() {
+			local i name answer number
+
+			if [[ ! -t 0 ]]; then
+				echo "Error: the interactive selector needs a terminal on stdin, pass a patch or category instead." >&2
+				return 1
+			fi
+
+			echo "Available patches:"
+			for i in "${!PF_NAMES[@]}"; do
+				name="${PF_NAMES[$i]}"
+				echo "  $((i + 1))) $name [${PF_CATEGORIES[$name]}]"
+				echo "      ${PF_DESCRIPTION[$name]}"
+			done
+
+			while true; do
+				echo
+				read -r -p "Patch numbers to apply (e.g. '1 3'), 'all', 'd <number>' for a diff, enter to decide one by one, 'q' to quit: " answer || return 1
+
+				case "$answer" in
+					q|Q)
+						return 1
+						;;
+					d\ *|D\ *)
+						number="${answer#* }"
+						if [[ "$number" =~ ^[0-9]+$ ]] && (( number >= 1 && number <= ${#PF_NAMES[@]} )); then
+							"pf_patch_${PF_NAMES[$((number - 1))]}" diff
+						else
+							echo "No patch number $number."
+						fi
+						;;
+					"")
+						for name in "${PF_NAMES[@]}"; do
+							while true; do
+								read -r -p "Apply '$name'? [y/n/d=diff/q] " answer || return 1
+								case "$answer" in
+									y|Y|yes) PF_SELECTED+=("$name"); break ;;
+									n|N|no) break ;;
+									d|D|diff) "pf_patch_$name" diff ;;
+									q|Q) return 1 ;;
+								esac
+							done
+						done
+						break
+						;;
+					all)
+						PF_SELECTED=("${PF_NAMES[@]}")
+						break
+						;;
+					*)
+						PF_SELECTED=()
+						for number in $answer; do
+							if [[ ! "$number" =~ ^[0-9]+$ ]] || (( number < 1 || number > ${#PF_NAMES[@]} )); then
+								echo "No patch number $number."
+								PF_SELECTED=()
+								continue 2
+							fi
+							PF_SELECTED+=("${PF_NAMES[$((number - 1))]}")
+						done
+						break
+						;;
+				esac
+			done
+
+			if [[ "${#PF_SELECTED[@]}" -eq 0 ]]; then
+				return 0
+			fi
+
+			echo
+			read -r -p "Apply ${PF_SELECTED[*]}? [y/N] " answer || return 1
+			[[ "$answer" == "y" || "$answer" == "Y" || "$answer" == "yes" ]]
+		}
+
+		# pf_current prints the part of the target file a patch manages: the whole file
+		# in overwrite mode, or only the lines between the markers in append mode.
+		function pf_current() {
+			local output="$1" start="$2" end="$3"
+
+			if [[ -z "$start" ]]; then
+				cat "$output" 2>/dev/null
+				return
+			fi
+
+			PF_START="$start" PF_END="$end" awk '
+				$0 == ENVIRON["PF_START"] { found = 1 }
+				found { print }
+				found && $0 == ENVIRON["PF_END"] { exit }
+			' "$output" 2>/dev/null
+		}
+
+		# pf_check compares the managed part of the target file against the expected
+		# base64 encoded content and reports the result. In diff mode, passed as "diff" in place of
+		# the start marker, the target must carry the diff. In lines and merge mode, passed as "edit"
+		# and the editor function in place of the markers, the editor must not change the target. It
+		# returns 1 on drift.
+		function pf_check() {
+			local name="$1" output="$2" expected="$3" start="$4" end="$5" state=1
+
+			if [[ "$start" == "diff" ]]; then
+				pf_diff_applied "$output" "$expected" && state=0
+			elif [[ "$start" == "edit" ]]; then
+				cmp -s "$output" <("$end" "$output") && state=0
+			elif cmp -s <(pf_current "$output" "$start" "$end") <(echo "$expected" | base64 -d -); then
+				state=0
+			fi
+
+			if [[ "$state" -eq 0 ]]; then
+				echo "OK     $name $output"
+				pf_log "check patch=$name state=ok"
+				return 0
+			fi
+
+			echo "DRIFT  $name $output"
+			pf_log "check patch=$name state=drift"
+			PF_DRIFTED=$((PF_DRIFTED + 1))
+			return 1
+		}
 	{{ end }}	
 
 	{{ if eq .ScriptFor "REVERTING" }}
-		if test ! -f "{{.PatchFilesControlFile}}"; then
+		# pf_restore_backup puts back the target saved by pf_take_backup, or removes a target
+		# that did not exist before patching. It returns 2 when there is neither, the patch was not
+		# applied then.
+		function pf_restore_backup() {
+			local output="$1"
+
+			if test -e "$output.oldpatchfile"; then
+				mv "$output.oldpatchfile" "$output"
+			elif test -e "$output.newpatchfile"; then
+				rm -f "$output" "$output.newpatchfile"
+			else
+				return 2
+			fi
+		}
+
+		# pf_revert_diff applies the base64 encoded unified diff in reverse, only when every hunk
+		# matches the target. It returns 2 when the diff applies forward, the target does not carry it.
+		function pf_revert_diff() {
+			local output="$1" payload="$2"
+
+			if ! pf_patch_file "$output" "$payload" --dry-run -R >/dev/null 2>&1 && pf_patch_file "$output" "$payload" --dry-run >/dev/null 2>&1; then
+				return 2
+			fi
+
+			if ! pf_patch_file "$output" "$payload" --dry-run -R >&2; then
+				echo "Error: the diff does not apply in reverse to '$output', its hunks do not match. The file is left unchanged." >&2
+				return 1
+			fi
+
+			pf_patch_file "$output" "$payload" -R
+		}
+
+		# rollback takes the patches to revert as the following arguments. The patch script schedules
+		# it for risky patches, it runs whether or not the control file exists.
+		if [[ "$category" == "rollback" ]]; then
+			action="rollback"
+			category="${args[*]:1}"
+			PF_ONLY="$category"
+		elif [[ "$category" == "resume" || "$category" == "interrupted" ]]; then
+			action="$category"
+		fi
+
+		# resume and interrupted finish a run that may have stopped before the control file was written or removed
+		if [[ "$action" != "rollback" && "$action" != "resume" && "$action" != "interrupted" ]] && test ! -f "${PATCHFILES_ROOT}{{.PatchFilesControlFile}}"; then
 			echo "System is not patched. Exiting."
+			pf_log "exit reason=not-patched"
 			exit 0
 		fi
 	{{ end }}	
@@ -51,34 +1229,67 @@ type Header struct {
 	Environment           string // Environment name (dev, prod, etc.)
 	Built                 string // Build timestamp in UTC
 	PatchFilesControlFile string // Path to control file that tracks patch status
+	LogDir                string // Default directory of the run logs, below PATCHFILES_ROOT
+	Syslog                bool   // Whether run logs are copied to syslog by default
+	ValueFunctions        string // Bash functions reading the host facts and computing values, see valueFunctions
+	RollbackMinutes       int    // Default minutes after which risky patches are reverted unless confirmed
+	RollbackDir           string // Directory of the scheduled rollback, below PATCHFILES_ROOT
+	LockFile              string // Lock file taken by every run, below PATCHFILES_ROOT
+	JournalFile           string // Journal of the running or interrupted run, below PATCHFILES_ROOT
 }
 
-// writeHeader generates and writes the bash script header to the given file descriptor.
-// It creates a header with script metadata (author, version, environment, build time)
-// and includes logic to check if the system is already patched (for PATCHING) or not patched (for REVERTING).
-func (generator *Generator) writeHeader(fd *os.File, scriptFor string) (err error) {
+// writeHeader generates and writes the bash script header to the given writer.
+// It creates a header with script metadata (author, version, environment, build time), the helpers
+// the patches and the footer call, and logic to check if the system is already patched or not.
+func (generator *Generator) writeHeader(w io.Writer, scriptFor string) (err error) {
 	logger := generator.Log.WithOptions(zap.Fields())
 	logger.Debug("attempt to write header",
 		zap.String("scriptFor", scriptFor),
 	)
 
-	built := time.Now().UTC().Format("2006-01-02 15:04:05 -07:00")
+	built := generator.Built
+	if built.IsZero() {
+		built = time.Now()
+	}
 
-	author := os.Getenv("AUTHOR")
+	author := generator.Author
+	if author == "" {
+		author = os.Getenv("AUTHOR")
+	}
 	author = strings.ToLower(author)
 	author = strings.Trim(author, " ")
 
-	version := os.Getenv("VERSION")
+	version := generator.Version
+	if version == "" {
+		version = os.Getenv("VERSION")
+	}
 	version = strings.ToLower(version)
 	version = strings.Trim(version, " ")
 
+	logDir := generator.LogDir
+	if logDir == "" {
+		logDir = DefaultLogDir
+	}
+
+	rollbackMinutes := generator.RollbackMinutes
+	if rollbackMinutes == 0 {
+		rollbackMinutes = DefaultRollbackMinutes
+	}
+
 	data := Header{
 		Author:                author,
 		Version:               version,
-		Built:                 built,
+		Built:                 built.UTC().Format("2006-01-02 15:04:05 -07:00"),
 		ScriptFor:             scriptFor,
 		Environment:           generator.Environment,
-		PatchFilesControlFile: patchFilesControlFile,
+		PatchFilesControlFile: ControlFile,
+		LogDir:                logDir,
+		Syslog:                generator.Syslog,
+		ValueFunctions:        valueFunctions,
+		RollbackMinutes:       rollbackMinutes,
+		RollbackDir:           RollbackDir,
+		LockFile:              LockFile,
+		JournalFile:           JournalFile,
 	}
 
 	buf := new(bytes.Buffer)
@@ -94,8 +1305,7 @@ func (generator *Generator) writeHeader(fd *os.File, scriptFor string) (err erro
 	res := buf.String()
 	res = strings.ReplaceAll(res, "\t", "")
 
-	fd.WriteString(res)
-	fd.Sync()
+	_, err = io.WriteString(w, res)
 
 	return
 }
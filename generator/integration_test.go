@@ -0,0 +1,1266 @@
+package generator_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"patchfiles/generator"
+	"patchfiles/parser"
+
+	"go.uber.org/zap"
+)
+
+// originals are the target files that exist on the fake root filesystem before patching.
+var originals = map[string]string{
+	"etc/app/app.conf":           "listen = 127.0.0.1:80\n",
+	"etc/app/extra.ini":          "[main]\nname = app", // no trailing newline on purpose
+	"etc/net.conf":               "tcp_sack = 1\n",
+	"etc/docker/daemon.json":     "{\n  \"log-driver\": \"json-file\",\n  \"log-opts\": {\"max-size\": \"10m\"}\n}\n",
+	"proc/sys/net/ipv4/tcp_sack": "1\n",
+	"proc/sys/net/ipv4/tcp_rmem": "4096\t131072\t6291456\n",
+	// host facts of values: 8000000 kB of memory, 6 CPUs, a 10 Gbit/s NIC and an NVMe disk
+	"proc/meminfo":                       "MemTotal:        8000000 kB\nMemFree:         4000000 kB\n",
+	"proc/cpuinfo":                       "processor\t: 0\nprocessor\t: 1\nprocessor\t: 2\nprocessor\t: 3\nprocessor\t: 4\nprocessor\t: 5\n",
+	"sys/class/net/eth0/device/vendor":   "0x8086\n",
+	"sys/class/net/eth0/speed":           "10000\n",
+	"sys/block/nvme0n1/device/model":     "test\n",
+	"sys/block/nvme0n1/queue/rotational": "0\n",
+	"sys/block/loop0/queue/rotational":   "1\n",
+}
+
+// harness is a fake root filesystem with generated scripts and stubbed system tools.
+type harness struct {
+	t    *testing.T
+	dir  string // directory holding patch.sh, revert.sh and stub binaries
+	root string // fake root filesystem, passed as PATCHFILES_ROOT
+}
+
+// newHarness generates scripts from the fixture patches in testdata and prepares a fake root.
+func newHarness(t *testing.T) *harness {
+	t.Helper()
+
+	return newHarnessDir(t, "patches")
+}
+
+// newHarnessDir is newHarness with the fixture patches from another directory of testdata.
+func newHarnessDir(t *testing.T, dir string) *harness {
+	t.Helper()
+
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not available")
+	}
+
+	h := &harness{
+		t:    t,
+		dir:  t.TempDir(),
+		root: t.TempDir(),
+	}
+
+	results, errs := parser.LoadDir(zap.NewNop(), os.DirFS("testdata"), dir)
+	if len(errs) > 0 {
+		t.Fatalf("parsing fixtures: %v", errs[0].Error)
+	}
+
+	gen := generator.Generator{
+		Log:         zap.NewNop(),
+		Environment: "test",
+	}
+	patch, revert, err := gen.Render(results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.write(filepath.Join(h.dir, "patch.sh"), string(patch), 0o755)
+	h.write(filepath.Join(h.dir, "revert.sh"), string(revert), 0o755)
+
+	// stub tools record their invocation instead of touching the host
+	bin := filepath.Join(h.dir, "bin")
+	for _, name := range []string{"systemctl", "sysctl", "udevadm", "systemd-run"} {
+		stub := "#!/usr/bin/env bash\necho \"$(basename \"$0\") $*\" >> \"$STUB_LOG\"\n"
+		h.write(filepath.Join(bin, name), stub, 0o755)
+	}
+
+	for name, body := range originals {
+		h.write(filepath.Join(h.root, name), body, 0o644)
+	}
+
+	return h
+}
+
+// write creates a file with all parent directories.
+func (h *harness) write(fileLoc, body string, mode os.FileMode) {
+	h.t.Helper()
+
+	err := os.MkdirAll(filepath.Dir(fileLoc), 0o755)
+	if err == nil {
+		err = os.WriteFile(fileLoc, []byte(body), mode)
+	}
+	if err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// run executes a generated script with bash and returns its output and exit code.
+func (h *harness) run(script string, args ...string) (string, int) {
+	h.t.Helper()
+
+	cmd := exec.Command("bash", append([]string{filepath.Join(h.dir, script)}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"PATCHFILES_ROOT="+h.root,
+		"PATH="+filepath.Join(h.dir, "bin")+":"+os.Getenv("PATH"),
+		"STUB_LOG="+filepath.Join(h.dir, "stub.log"),
+		"PATCHFILES_LOG_DIR="+filepath.Join(h.dir, "log"),
+		"PATCHFILES_ALLOW_NONROOT=1",
+	)
+
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return string(out), exitErr.ExitCode()
+	}
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	return string(out), 0
+}
+
+// runTerminal executes a generated script on a pseudo-terminal with the input typed in, using
+// script(1) from util-linux, and returns its output and exit code.
+func (h *harness) runTerminal(input, script string, args ...string) (string, int) {
+	h.t.Helper()
+
+	if _, err := exec.LookPath("script"); err != nil {
+		h.t.Skip("script is not available")
+	}
+
+	command := "bash " + filepath.Join(h.dir, script) + " " + strings.Join(args, " ")
+	cmd := exec.Command("script", "-qec", command, "/dev/null")
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Env = append(os.Environ(),
+		"PATCHFILES_ROOT="+h.root,
+		"PATH="+filepath.Join(h.dir, "bin")+":"+os.Getenv("PATH"),
+		"STUB_LOG="+filepath.Join(h.dir, "stub.log"),
+		"PATCHFILES_LOG_DIR="+filepath.Join(h.dir, "log"),
+		"PATCHFILES_ALLOW_NONROOT=1",
+	)
+
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return string(out), exitErr.ExitCode()
+	}
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	return string(out), 0
+}
+
+// read returns the content of a file on the fake root, or "<missing>" when it does not exist.
+func (h *harness) read(name string) string {
+	h.t.Helper()
+
+	body, err := os.ReadFile(filepath.Join(h.root, name))
+	if os.IsNotExist(err) {
+		return "<missing>"
+	}
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	return string(body)
+}
+
+// snapshot returns the content of every file on the fake root keyed by its relative path. The lock
+// file every run takes is left out, it names the process of the last run.
+func (h *harness) snapshot() map[string]string {
+	h.t.Helper()
+
+	lock := strings.TrimPrefix(generator.LockFile, "/")
+	files := make(map[string]string)
+	filepath.WalkDir(h.root, func(fileLoc string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			name, _ := filepath.Rel(h.root, fileLoc)
+			if name != lock {
+				files[name] = h.read(name)
+			}
+		}
+		return err
+	})
+
+	return files
+}
+
+// expect fails the test when a file on the fake root does not have the wanted content.
+func (h *harness) expect(name, want string) {
+	h.t.Helper()
+
+	if got := h.read(name); got != want {
+		h.t.Errorf("%s:\ngot:\n%s\nwant:\n%s", name, got, want)
+	}
+}
+
+func TestPatchRepatchRevert(t *testing.T) {
+	h := newHarness(t)
+
+	out, code := h.run("patch.sh", "all")
+	if code != 0 {
+		t.Fatalf("patch exited with %d:\n%s", code, out)
+	}
+
+	h.expect("etc/app/app.conf", "listen = 0.0.0.0:8080\nworkers = 4\n\n")
+	h.expect("etc/app/app.conf.oldpatchfile", originals["etc/app/app.conf"])
+	h.expect("etc/app/extra.ini", "[main]\nname = app\n"+
+		"; PATCHFILES START app_2 "+hashOf("[limits]\nopen_files = 65535\n")+"\n[limits]\nopen_files = 65535\n\n; PATCHFILES END app_2\n"+
+		"; PATCHFILES START app_3 "+hashOf("[cache]\nsize = 128m\n")+"\n[cache]\nsize = 128m\n\n; PATCHFILES END app_3\n")
+	h.expect("etc/net.conf", "tcp_sack = 1\n"+
+		"// PATCHFILES START net_1 "+hashOf("tcp_fastopen = 3\n")+"\ntcp_fastopen = 3\n\n// PATCHFILES END net_1\n")
+	h.expect("etc/udev/rules.d/60-test.rules", "ACTION==\"add|change\", KERNEL==\"sd*[!0-9]\", ATTR{queue/scheduler}=\"none\"\n\n")
+	h.expect("patchfile", "1\n")
+
+	stubs, _ := os.ReadFile(filepath.Join(h.dir, "stub.log"))
+	want := "systemctl stop app\nsystemctl start app\nsysctl -p\nudevadm control --reload\nudevadm trigger\n"
+	if string(stubs) != want {
+		t.Errorf("stub calls:\ngot:\n%s\nwant:\n%s", stubs, want)
+	}
+
+	// re-patch exits early on the control file and, without it, skips every applied patch
+	patched := h.snapshot()
+	out, code = h.run("patch.sh", "all")
+	if code != 0 || !strings.Contains(out, "System already patched") {
+		t.Fatalf("re-patch exited with %d:\n%s", code, out)
+	}
+
+	os.Remove(filepath.Join(h.root, "patchfile"))
+	out, code = h.run("patch.sh", "all")
+	if code != 0 {
+		t.Fatalf("re-patch without control file exited with %d:\n%s", code, out)
+	}
+	for name, body := range patched {
+		h.expect(name, body)
+	}
+
+	os.Remove(filepath.Join(h.dir, "stub.log"))
+	out, code = h.run("revert.sh", "all")
+	if code != 0 {
+		t.Fatalf("revert exited with %d:\n%s", code, out)
+	}
+
+	// revert runs its own commands, not the commands after applying
+	stubs, _ = os.ReadFile(filepath.Join(h.dir, "stub.log"))
+	want = "systemctl stop app\nsystemctl start app\nsysctl -p\nudevadm control --reload\n"
+	if string(stubs) != want {
+		t.Errorf("stub calls of revert:\ngot:\n%s\nwant:\n%s", stubs, want)
+	}
+
+	want = "[main]\nname = app\n" // the missing trailing newline is added before appending
+	h.expect("etc/app/extra.ini", want)
+	h.expect("etc/app/app.conf", originals["etc/app/app.conf"])
+	h.expect("etc/net.conf", originals["etc/net.conf"])
+	h.expect("etc/udev/rules.d/60-test.rules", "<missing>")
+	if files := h.snapshot(); len(files) != len(originals) {
+		t.Errorf("revert left extra files behind: %v", files)
+	}
+}
+
+func TestRevertKeepsOtherBlocks(t *testing.T) {
+	h := newHarness(t)
+
+	h.run("patch.sh", "all")
+
+	// net_1 and app_2/app_3 append to different files, app_2 and app_3 share one
+	out, code := h.run("revert.sh", "networking")
+	if code != 0 {
+		t.Fatalf("revert exited with %d:\n%s", code, out)
+	}
+
+	h.expect("etc/net.conf", originals["etc/net.conf"])
+	if got := h.read("etc/app/extra.ini"); !strings.Contains(got, "PATCHFILES END app_3") {
+		t.Errorf("revert of networking removed app blocks:\n%s", got)
+	}
+}
+
+func TestSystemdUnit(t *testing.T) {
+	h := newHarnessDir(t, "units")
+
+	out, code := h.run("patch.sh", "all")
+	if code != 0 {
+		t.Fatalf("patch exited with %d:\n%s", code, out)
+	}
+
+	h.expect("etc/systemd/system/backup.service", "[Service]\nType=oneshot\nExecStart=/usr/bin/true\n\n")
+	h.expect("etc/systemd/system/backup.timer", "[Timer]\nOnCalendar=daily\n")
+
+	// the timer, not the service, is enabled and started
+	stubs, _ := os.ReadFile(filepath.Join(h.dir, "stub.log"))
+	want := "systemctl daemon-reload\nsystemctl enable backup.timer\nsystemctl restart backup.timer\n"
+	if string(stubs) != want {
+		t.Errorf("stub calls:\ngot:\n%s\nwant:\n%s", stubs, want)
+	}
+
+	os.Remove(filepath.Join(h.dir, "stub.log"))
+	out, code = h.run("revert.sh", "all")
+	if code != 0 {
+		t.Fatalf("revert exited with %d:\n%s", code, out)
+	}
+
+	stubs, _ = os.ReadFile(filepath.Join(h.dir, "stub.log"))
+	want = "systemctl disable --now backup.timer backup.service\nsystemctl daemon-reload\n"
+	if string(stubs) != want {
+		t.Errorf("stub calls of revert:\ngot:\n%s\nwant:\n%s", stubs, want)
+	}
+	if files := h.snapshot(); len(files) != len(originals) {
+		t.Errorf("revert left unit files behind: %v", files)
+	}
+
+	// a unit that was never installed is not disabled, which would fail the revert
+	os.Remove(filepath.Join(h.dir, "stub.log"))
+	h.write(filepath.Join(h.root, "patchfile"), "1\n", 0o644)
+	out, code = h.run("revert.sh", "all")
+	if code != 0 {
+		t.Fatalf("revert of a unit that was never installed exited with %d:\n%s", code, out)
+	}
+	if stubs, _ = os.ReadFile(filepath.Join(h.dir, "stub.log")); strings.Contains(string(stubs), "disable") {
+		t.Errorf("revert disabled a unit that was never installed:\n%s", stubs)
+	}
+}
+
+func TestDiffMode(t *testing.T) {
+	if _, err := exec.LookPath("patch"); err != nil {
+		t.Skip("patch is not available")
+	}
+	h := newHarnessDir(t, "diffs")
+
+	out, code := h.run("patch.sh", "all")
+	if code != 0 {
+		t.Fatalf("patch exited with %d:\n%s", code, out)
+	}
+	h.expect("etc/net.conf", "tcp_sack = 0\ntcp_timestamps = 0\n")
+
+	out, code = h.run("patch.sh", "check", "all")
+	if code != 0 || !strings.Contains(out, "OK     net_1") {
+		t.Fatalf("check after patch exited with %d:\n%s", code, out)
+	}
+
+	// the diff applies in reverse, so a second run skips it
+	os.Remove(filepath.Join(h.root, "patchfile"))
+	h.run("patch.sh", "all")
+	h.expect("etc/net.conf", "tcp_sack = 0\ntcp_timestamps = 0\n")
+
+	out, code = h.run("revert.sh", "all")
+	if code != 0 {
+		t.Fatalf("revert exited with %d:\n%s", code, out)
+	}
+	h.expect("etc/net.conf", originals["etc/net.conf"])
+	if files := h.snapshot(); len(files) != len(originals) {
+		t.Errorf("patch left files behind: %v", files)
+	}
+}
+
+func TestDiffMismatch(t *testing.T) {
+	if _, err := exec.LookPath("patch"); err != nil {
+		t.Skip("patch is not available")
+	}
+	h := newHarnessDir(t, "diffs")
+
+	// a file changed by hand no longer matches the hunks
+	h.write(filepath.Join(h.root, "etc/net.conf"), "tcp_sack = 2\nkeep = me\n", 0o644)
+
+	out, code := h.run("patch.sh", "all")
+	if code != 1 || !strings.Contains(out, "its hunks do not match") {
+		t.Fatalf("patch of a changed file exited with %d:\n%s", code, out)
+	}
+	h.expect("etc/net.conf", "tcp_sack = 2\nkeep = me\n")
+	if files := h.snapshot(); len(files) != len(originals) {
+		t.Errorf("failed patch left files behind: %v", files)
+	}
+
+	out, code = h.run("patch.sh", "check", "all")
+	if code != 1 || !strings.Contains(out, "DRIFT  net_1") {
+		t.Errorf("check of a changed file exited with %d:\n%s", code, out)
+	}
+}
+
+func TestLinesMode(t *testing.T) {
+	if _, err := exec.LookPath("patch"); err != nil {
+		t.Skip("patch is not available")
+	}
+	h := newHarnessDir(t, "lines")
+
+	out, code := h.run("patch.sh", "all")
+	if code != 0 {
+		t.Fatalf("patch exited with %d:\n%s", code, out)
+	}
+	h.expect("etc/app/extra.ini", "[main]\nname = patched\nsize\t= 64m\n")
+	h.expect("etc/net.conf", "tcp_timestamps = 0\n")
+	h.expect("etc/app/app.conf", "#listen = 127.0.0.1:80\n")
+
+	out, code = h.run("patch.sh", "check", "all")
+	if code != 0 || !strings.Contains(out, "No drift detected") {
+		t.Fatalf("check after patch exited with %d:\n%s", code, out)
+	}
+
+	// the records exist, so a second run skips every patch
+	os.Remove(filepath.Join(h.root, "patchfile"))
+	out, _ = h.run("patch.sh", "all")
+	if strings.Count(out, "appears to be already patched") != 3 {
+		t.Errorf("second run did not skip the patches:\n%s", out)
+	}
+
+	// reapply starts from the original lines again
+	h.write(filepath.Join(h.root, "etc/net.conf"), "tcp_timestamps = 1\n", 0o644)
+	out, code = h.run("patch.sh", "reapply", "net")
+	if code != 0 {
+		t.Fatalf("reapply exited with %d:\n%s", code, out)
+	}
+	h.expect("etc/net.conf", "tcp_timestamps = 0\n")
+
+	out, code = h.run("revert.sh", "all")
+	if code != 0 {
+		t.Fatalf("revert exited with %d:\n%s", code, out)
+	}
+	for name, body := range originals {
+		h.expect(name, body)
+	}
+	if files := h.snapshot(); len(files) != len(originals) {
+		t.Errorf("revert left files behind: %v", files)
+	}
+}
+
+func TestLinesCompliant(t *testing.T) {
+	if _, err := exec.LookPath("patch"); err != nil {
+		t.Skip("patch is not available")
+	}
+	h := newHarnessDir(t, "lines")
+	h.write(filepath.Join(h.root, "etc/net.conf"), "tcp_timestamps = 0\n", 0o644)
+
+	out, code := h.run("patch.sh", "net")
+	if code != 0 || !strings.Contains(out, "'net_1' complies already") {
+		t.Fatalf("patch of a compliant file exited with %d:\n%s", code, out)
+	}
+	h.expect("etc/net.conf.net_1.linespatchfile", "<missing>")
+	if stubs, _ := os.ReadFile(filepath.Join(h.dir, "stub.log")); len(stubs) > 0 {
+		t.Errorf("commands after ran for a compliant file: %s", stubs)
+	}
+
+	logs := h.logs()
+	if len(logs) != 1 || !strings.Contains(logs[0], " decision=skipped-already-patched patch=net_1 reason=compliant") {
+		t.Errorf("run log does not record the compliant file:\n%v", logs)
+	}
+}
+
+func TestMergeMode(t *testing.T) {
+	if exec.Command("python3", "-c", "import yaml").Run() != nil {
+		t.Skip("python3 with the yaml module is not available")
+	}
+	h := newHarnessDir(t, "merge")
+
+	out, code := h.run("patch.sh", "all")
+	if code != 0 {
+		t.Fatalf("patch exited with %d:\n%s", code, out)
+	}
+	h.expect("etc/docker/daemon.json", "{\n  \"log-driver\": \"json-file\",\n  \"log-opts\": {\n    \"max-size\": \"10m\",\n    \"max-file\": \"3\"\n  },\n  \"live-restore\": true\n}\n")
+	h.expect("etc/app/extra.ini", "[main]\nname = merged\n\n[cache]\nsize = 64m\n")
+	h.expect("etc/app/app.yaml", "server:\n  port: 8080\n  hosts:\n  - a.example.com\n  - b.example.com\n  tls: 'off'\n  timeout: 1.0\n  ratio: 2.5\nversion: '1.10'\n")
+	h.expect("etc/app/tool.toml", "title = \"tool\"\n\n[server]\nports = [\n  8080,\n  8081,\n]\n")
+
+	out, code = h.run("patch.sh", "check", "all")
+	if code != 0 || !strings.Contains(out, "No drift detected") {
+		t.Fatalf("check after patch exited with %d:\n%s", code, out)
+	}
+
+	// a setting changed by hand is merged again, the other settings stay
+	h.write(filepath.Join(h.root, "etc/app/extra.ini"), "[main]\nname = edited\nowner = ops\n\n[cache]\nsize = 64m\n", 0o644)
+	out, code = h.run("patch.sh", "reapply", "extra")
+	if code != 0 {
+		t.Fatalf("reapply exited with %d:\n%s", code, out)
+	}
+	h.expect("etc/app/extra.ini", "[main]\nname = merged\nowner = ops\n\n[cache]\nsize = 64m\n")
+	h.expect("etc/app/extra.ini.oldpatchfile", originals["etc/app/extra.ini"])
+
+	out, code = h.run("revert.sh", "all")
+	if code != 0 {
+		t.Fatalf("revert exited with %d:\n%s", code, out)
+	}
+	for name, body := range originals {
+		h.expect(name, body)
+	}
+	if files := h.snapshot(); len(files) != len(originals) {
+		t.Errorf("revert left files behind: %v", files)
+	}
+}
+
+func TestMergeInvalidTarget(t *testing.T) {
+	if exec.Command("python3", "-c", "import yaml").Run() != nil {
+		t.Skip("python3 with the yaml module is not available")
+	}
+	h := newHarnessDir(t, "merge")
+	h.write(filepath.Join(h.root, "etc/docker/daemon.json"), "{broken\n", 0o644)
+
+	out, code := h.run("patch.sh", "docker")
+	if code != 1 || !strings.Contains(out, "cannot merge into") {
+		t.Fatalf("patch of a broken file exited with %d:\n%s", code, out)
+	}
+	h.expect("etc/docker/daemon.json", "{broken\n")
+	h.expect("etc/docker/daemon.json.oldpatchfile", "<missing>")
+
+	logs := h.logs()
+	if len(logs) != 1 || !strings.Contains(logs[0], " decision=failed patch=docker_1 reason=merge") {
+		t.Errorf("run log does not record the failure:\n%v", logs)
+	}
+}
+
+func TestSysctlKind(t *testing.T) {
+	h := newHarnessDir(t, "sysctl")
+	stubLog := filepath.Join(h.dir, "stub.log")
+	record := "etc/sysctl.d/90-net.conf.net_1.sysctlpatchfile"
+
+	out, code := h.run("patch.sh", "all")
+	if code != 0 {
+		t.Fatalf("patch exited with %d:\n%s", code, out)
+	}
+	h.expect("etc/sysctl.d/90-net.conf", "net.ipv4.tcp_sack = 0\nnet.ipv4.tcp_rmem = 4096 262144 16777216\nnet.ipv4.tcp_congestion_control = bbr\n")
+	h.expect(record, "net.ipv4.tcp_sack=1\nnet.ipv4.tcp_rmem=4096\t131072\t6291456\n")
+	if !strings.Contains(out, "the running kernel has no sysctl 'net.ipv4.tcp_congestion_control', skipped") {
+		t.Errorf("the unsupported key is not reported:\n%s", out)
+	}
+
+	stubs, _ := os.ReadFile(stubLog)
+	want := "sysctl -w net.ipv4.tcp_sack=0\nsysctl -w net.ipv4.tcp_rmem=4096 262144 16777216\n"
+	if string(stubs) != want {
+		t.Errorf("stub calls of patch:\ngot:\n%s\nwant:\n%s", stubs, want)
+	}
+
+	// reapply keeps the values recorded by the first run
+	h.write(filepath.Join(h.root, "proc/sys/net/ipv4/tcp_sack"), "0\n", 0o644)
+	h.write(filepath.Join(h.root, "etc/sysctl.d/90-net.conf"), "edited\n", 0o644)
+	out, code = h.run("patch.sh", "reapply", "all")
+	if code != 0 {
+		t.Fatalf("reapply exited with %d:\n%s", code, out)
+	}
+	h.expect(record, "net.ipv4.tcp_sack=1\nnet.ipv4.tcp_rmem=4096\t131072\t6291456\n")
+
+	os.Remove(stubLog)
+	out, code = h.run("revert.sh", "all")
+	if code != 0 {
+		t.Fatalf("revert exited with %d:\n%s", code, out)
+	}
+	stubs, _ = os.ReadFile(stubLog)
+	want = "sysctl -w net.ipv4.tcp_sack=1\nsysctl -w net.ipv4.tcp_rmem=4096\t131072\t6291456\n"
+	if string(stubs) != want {
+		t.Errorf("stub calls of revert:\ngot:\n%s\nwant:\n%s", stubs, want)
+	}
+	h.expect("etc/sysctl.d/90-net.conf", "<missing>")
+	h.expect(record, "<missing>")
+}
+
+func TestValues(t *testing.T) {
+	h := newHarnessDir(t, "values")
+	stubLog := filepath.Join(h.dir, "stub.log")
+
+	out, code := h.run("patch.sh", "all")
+	if code != 0 {
+		t.Fatalf("patch exited with %d:\n%s", code, out)
+	}
+
+	// 6 CPUs give 5 workers, 7812 MB of memory a cache of 976 MB, below the limit of 5 * 512
+	h.expect("etc/app/app.conf", "listen = 127.0.0.1:80\nworkers = 5\ncache = 976m\n\n")
+	if got := h.read("etc/net.conf"); !strings.Contains(got, "\nrx_queues = 6\nread_ahead_kb = 128\nnvme_poll = 1\n") {
+		t.Errorf("net.conf does not carry the values:\n%s", got)
+	}
+	h.expect("etc/sysctl.d/90-tune.conf", "net.netfilter.nf_conntrack_max = 524288\nnet.ipv4.tcp_rmem = 4096 131072 7999488\n")
+
+	stubs, _ := os.ReadFile(stubLog)
+	want := "systemctl set-property app.service CPUQuota=500%\nsysctl -w net.ipv4.tcp_rmem=4096 131072 7999488\n"
+	if string(stubs) != want {
+		t.Errorf("stub calls of patch:\ngot:\n%s\nwant:\n%s", stubs, want)
+	}
+
+	out, code = h.run("patch.sh", "check", "all")
+	if code != 0 {
+		t.Fatalf("check after patch exited with %d:\n%s", code, out)
+	}
+
+	// the values follow the host, twice the memory drifts the patches sized by it
+	h.write(filepath.Join(h.root, "proc/meminfo"), "MemTotal:       16000000 kB\n", 0o644)
+	out, code = h.run("patch.sh", "check", "all")
+	if code != 1 {
+		t.Fatalf("check after a memory upgrade exited with %d:\n%s", code, out)
+	}
+	for _, line := range []string{"DRIFT  app_1", "OK     net_1", "DRIFT  tune_1"} {
+		if !strings.Contains(out, line) {
+			t.Errorf("check output is missing %q:\n%s", line, out)
+		}
+	}
+
+	out, code = h.run("patch.sh", "reapply", "all")
+	if code != 0 {
+		t.Fatalf("reapply exited with %d:\n%s", code, out)
+	}
+	h.expect("etc/app/app.conf", "listen = 127.0.0.1:80\nworkers = 5\ncache = 1953m\n\n")
+	h.expect("etc/sysctl.d/90-tune.conf", "net.netfilter.nf_conntrack_max = 1048576\nnet.ipv4.tcp_rmem = 4096 131072 16000000\n")
+
+	out, code = h.run("revert.sh", "all")
+	if code != 0 {
+		t.Fatalf("revert exited with %d:\n%s", code, out)
+	}
+	h.expect("etc/app/app.conf", originals["etc/app/app.conf"])
+	h.expect("etc/net.conf", originals["etc/net.conf"])
+	h.expect("etc/sysctl.d/90-tune.conf", "<missing>")
+}
+
+func TestHandlers(t *testing.T) {
+	h := newHarnessDir(t, "handlers")
+	stubLog := filepath.Join(h.dir, "stub.log")
+
+	out, code := h.run("patch.sh", "all")
+	if code != 0 {
+		t.Fatalf("patch exited with %d:\n%s", code, out)
+	}
+
+	// handlers run once, after all patches, in the order of parser.Handlers
+	stubs, _ := os.ReadFile(stubLog)
+	want := "systemctl set-property app.service TasksMax=4096\nsystemctl daemon-reload\nsysctl --system\nsystemctl restart app\n"
+	if string(stubs) != want {
+		t.Errorf("stub calls of patch:\ngot:\n%s\nwant:\n%s", stubs, want)
+	}
+
+	// only the handlers of the patches written again run
+	os.Remove(stubLog)
+	h.write(filepath.Join(h.root, "etc/sysctl.d/90-net.conf"), "edited\n", 0o644)
+	out, code = h.run("patch.sh", "reapply", "all")
+	if code != 0 {
+		t.Fatalf("reapply exited with %d:\n%s", code, out)
+	}
+	stubs, _ = os.ReadFile(stubLog)
+	if string(stubs) != "sysctl --system\n" {
+		t.Errorf("stub calls of reapply:\n%s", stubs)
+	}
+
+	os.Remove(stubLog)
+	out, code = h.run("revert.sh", "all")
+	if code != 0 {
+		t.Fatalf("revert exited with %d:\n%s", code, out)
+	}
+	stubs, _ = os.ReadFile(stubLog)
+	want = "systemctl daemon-reload\nsysctl --system\nsystemctl restart app\n"
+	if string(stubs) != want {
+		t.Errorf("stub calls of revert:\ngot:\n%s\nwant:\n%s", stubs, want)
+	}
+	h.expect("etc/app/app.conf", originals["etc/app/app.conf"])
+	h.expect("etc/sysctl.d/90-net.conf", "<missing>")
+}
+
+func TestRevertNotPatched(t *testing.T) {
+	h := newHarnessDir(t, "handlers")
+	stubLog := filepath.Join(h.dir, "stub.log")
+
+	out, code := h.run("patch.sh", "services")
+	if code != 0 {
+		t.Fatalf("patch exited with %d:\n%s", code, out)
+	}
+
+	// net_1 was left out, it is skipped without the handler it notifies
+	os.Remove(stubLog)
+	out, code = h.run("revert.sh", "all")
+	if code != 0 || !strings.Contains(out, "'net_1' is not patched, nothing to revert") {
+		t.Fatalf("revert exited with %d:\n%s", code, out)
+	}
+	stubs, _ := os.ReadFile(stubLog)
+	want := "systemctl daemon-reload\nsystemctl restart app\n"
+	if string(stubs) != want {
+		t.Errorf("stub calls of revert:\ngot:\n%s\nwant:\n%s", stubs, want)
+	}
+	logs := h.logs()
+	if !strings.Contains(logs[len(logs)-1], "decision=skipped-not-patched patch=net_1") {
+		t.Errorf("log of revert:\n%s", logs[len(logs)-1])
+	}
+	h.expect("patchfile", "<missing>")
+}
+
+func TestVerify(t *testing.T) {
+	h := newHarnessDir(t, "verify")
+
+	// the running kernel still selects acks, so the assertion of net_1 fails the run
+	out, code := h.run("patch.sh", "all")
+	if code != 1 {
+		t.Fatalf("patch exited with %d, want 1:\n%s", code, out)
+	}
+	for _, line := range []string{"PASS   app_1", "FAIL   net_1", "printed '1', want '0'", "failed: net_1"} {
+		if !strings.Contains(out, line) {
+			t.Errorf("patch output is missing %q:\n%s", line, out)
+		}
+	}
+	h.expect("etc/net.conf", "tcp_sack = 0\n\n")
+	if h.read("patchfile") == "<missing>" {
+		t.Error("control file was not written after the patches were applied")
+	}
+
+	// check compares the targets only
+	out, code = h.run("patch.sh", "check", "all")
+	if code != 0 || strings.Contains(out, "PASS") || strings.Contains(out, "FAIL") {
+		t.Errorf("check exited with %d:\n%s", code, out)
+	}
+
+	out, code = h.run("patch.sh", "verify", "app")
+	if code != 0 || !strings.Contains(out, "All 2 assertion(s) passed.") {
+		t.Errorf("verify app exited with %d:\n%s", code, out)
+	}
+
+	// verify runs only the assertions, it writes nothing
+	h.write(filepath.Join(h.root, "proc/sys/net/ipv4/tcp_sack"), "0\n", 0o644)
+	before := h.snapshot()
+	out, code = h.run("patch.sh", "verify", "all")
+	if code != 0 || !strings.Contains(out, "All 3 assertion(s) passed.") {
+		t.Errorf("verify all exited with %d:\n%s", code, out)
+	}
+	after := h.snapshot()
+	for name, body := range after {
+		if before[name] != body {
+			t.Errorf("verify changed %s", name)
+		}
+	}
+}
+
+func TestRiskyRollback(t *testing.T) {
+	h := newHarnessDir(t, "risky")
+	stubLog := filepath.Join(h.dir, "stub.log")
+	rollback := filepath.Join(h.root, generator.RollbackDir)
+
+	// without a key in authorized_keys the risky patch could lock the operator out
+	out, code := h.run("patch.sh", "all")
+	if code != 1 || !strings.Contains(out, "no key in the authorized_keys") {
+		t.Fatalf("patch without a key exited with %d:\n%s", code, out)
+	}
+	h.expect("etc/app/app.conf", originals["etc/app/app.conf"])
+
+	current, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.write(filepath.Join(h.root, current.HomeDir, ".ssh/authorized_keys"), "ssh-ed25519 AAAA test\n", 0o600)
+
+	out, code = h.run("patch.sh", "all")
+	if code != 0 || !strings.Contains(out, "The risky patches ssh_1 are reverted in 10 minute(s)") {
+		t.Fatalf("patch exited with %d:\n%s", code, out)
+	}
+	stubs, _ := os.ReadFile(stubLog)
+	want := "systemd-run --unit=patchfiles-rollback --on-active=10m --collect bash " + filepath.Join(rollback, "rollback.sh") + "\n"
+	if string(stubs) != want {
+		t.Errorf("stub calls of patch:\ngot:\n%s\nwant:\n%s", stubs, want)
+	}
+	h.expect(filepath.Join(generator.RollbackDir, "patches"), "ssh_1\n")
+
+	// the timer fires: only the risky patch is reverted
+	if out, err := exec.Command("bash", filepath.Join(rollback, "rollback.sh")).CombinedOutput(); err != nil {
+		t.Fatalf("rollback failed: %v\n%s", err, out)
+	}
+	h.expect("etc/ssh/sshd_config", "<missing>")
+	h.expect("etc/app/app.conf", "listen = 0.0.0.0:8080\n\n")
+	h.expect(generator.RollbackDir, "<missing>")
+
+	// confirm from a new session cancels the rollback and keeps the patch
+	os.Remove(stubLog)
+	out, code = h.run("patch.sh", "all")
+	if code != 0 {
+		t.Fatalf("patch after rollback exited with %d:\n%s", code, out)
+	}
+	out, code = h.run("patch.sh", "confirm")
+	if code != 0 || !strings.Contains(out, "Confirmed ssh_1") {
+		t.Fatalf("confirm exited with %d:\n%s", code, out)
+	}
+	stubs, _ = os.ReadFile(stubLog)
+	if !strings.HasSuffix(string(stubs), "systemctl stop patchfiles-rollback.timer\n") {
+		t.Errorf("stub calls of confirm:\n%s", stubs)
+	}
+	h.expect("etc/ssh/sshd_config", "PasswordAuthentication no\n\n")
+	h.expect(generator.RollbackDir, "<missing>")
+
+	out, code = h.run("patch.sh", "confirm")
+	if code != 0 || !strings.Contains(out, "No rollback is pending.") {
+		t.Errorf("second confirm exited with %d:\n%s", code, out)
+	}
+}
+
+func TestHighRisk(t *testing.T) {
+	h := newHarnessDir(t, "risk")
+
+	out, _ := h.run("patch.sh", "help")
+	if !strings.Contains(out, "* ssh_1 (risk: high)") || !strings.Contains(out, "* app_1 (risk: low)") {
+		t.Errorf("help does not show the risk levels:\n%s", out)
+	}
+
+	// all leaves out the high-risk patch
+	out, code := h.run("patch.sh", "all")
+	if code != 0 || !strings.Contains(out, "Leaving out the high-risk patches ssh_1") {
+		t.Fatalf("patch all exited with %d:\n%s", code, out)
+	}
+	h.expect("etc/app/app.conf", "listen = 0.0.0.0:8080\n\n")
+	h.expect("etc/ssh/sshd_config", "<missing>")
+
+	// selected by name, it lists what it does and needs a confirmation, which a pipe cannot give
+	h = newHarnessDir(t, "risk")
+	out, code = h.run("patch.sh", "ssh")
+	if code != 1 || !strings.Contains(out, "* write /etc/ssh/sshd_config (overwrite)") || !strings.Contains(out, "* notify restart sshd") {
+		t.Fatalf("patch ssh exited with %d:\n%s", code, out)
+	}
+	h.expect("etc/ssh/sshd_config", "<missing>")
+
+	out, code = h.run("patch.sh", "ssh", "--yes")
+	if code != 0 {
+		t.Fatalf("patch ssh --yes exited with %d:\n%s", code, out)
+	}
+	h.expect("etc/ssh/sshd_config", "PasswordAuthentication no\n\n")
+
+	// --include-risky keeps it in all and asks on the terminal
+	h = newHarnessDir(t, "risk")
+	out, code = h.runTerminal("y\n", "patch.sh", "all", "--include-risky")
+	if code != 0 || !strings.Contains(out, "Apply the high-risk patches?") {
+		t.Fatalf("patch all --include-risky exited with %d:\n%s", code, out)
+	}
+	h.expect("etc/ssh/sshd_config", "PasswordAuthentication no\n\n")
+	h.expect("etc/app/app.conf", "listen = 0.0.0.0:8080\n\n")
+
+	// check and reapply of all leave it out too, its drift shows with --include-risky
+	h.write(filepath.Join(h.root, "etc/ssh/sshd_config"), "PasswordAuthentication yes\n", 0o644)
+	out, code = h.run("patch.sh", "check", "all")
+	if code != 0 || !strings.Contains(out, "Leaving out the high-risk patches ssh_1") || strings.Contains(out, "ssh_1 "+h.root) {
+		t.Errorf("check all exited with %d:\n%s", code, out)
+	}
+	out, code = h.run("patch.sh", "check", "all", "--include-risky")
+	if code != 1 || !strings.Contains(out, "DRIFT  ssh_1") {
+		t.Errorf("check all --include-risky exited with %d:\n%s", code, out)
+	}
+	out, code = h.run("patch.sh", "reapply", "all")
+	if code != 0 || !strings.Contains(out, "Leaving out the high-risk patches ssh_1") {
+		t.Errorf("reapply all exited with %d:\n%s", code, out)
+	}
+	h.expect("etc/ssh/sshd_config", "PasswordAuthentication yes\n")
+}
+
+func TestInterruptedRun(t *testing.T) {
+	h := newHarnessDir(t, "journal")
+	stubLog := filepath.Join(h.dir, "stub.log")
+	journal := strings.TrimPrefix(generator.JournalFile, "/")
+
+	// net_1 kills the run after writing its target, before its commands after and the handlers
+	h.write(filepath.Join(h.root, "crash"), "", 0o644)
+	out, code := h.run("patch.sh", "all")
+	if code == 0 {
+		t.Fatalf("patch was not interrupted:\n%s", out)
+	}
+	if body := h.read(journal); !strings.Contains(body, "start app_1\nnotify restart app\ndone app_1 applied\nstart net_1\n") || strings.Contains(body, "done net_1") {
+		t.Fatalf("journal of the interrupted run:\n%s", body)
+	}
+	h.expect("etc/sysctl.d/90-net.conf", "net.ipv4.tcp_sack = 0\n\n")
+	h.expect("etc/app/extra.ini", originals["etc/app/extra.ini"])
+	h.expect("patchfile", "<missing>")
+
+	// other runs that change targets refuse to start, check does not
+	os.Remove(filepath.Join(h.root, "crash"))
+	out, code = h.run("patch.sh", "all")
+	if code != 1 || !strings.Contains(out, "interrupted at 'net_1'") || !strings.Contains(out, "./patch.sh resume") {
+		t.Errorf("patch after the interrupted run exited with %d:\n%s", code, out)
+	}
+	out, code = h.run("revert.sh", "all")
+	if code != 0 || !strings.Contains(out, "System is not patched") {
+		t.Errorf("revert after the interrupted run exited with %d:\n%s", code, out)
+	}
+	if out, code = h.run("patch.sh", "check", "all"); code != 0 || !strings.Contains(out, "SKIP   web_1") {
+		t.Errorf("check after the interrupted run exited with %d, want web_1 reported as not applied:\n%s", code, out)
+	}
+
+	// resume keeps app_1, runs the commands after net_1 again, applies web_1 and the handlers of all three
+	os.Remove(stubLog)
+	out, code = h.run("patch.sh", "resume")
+	if code != 0 || !strings.Contains(out, "Resuming 'net_1'") {
+		t.Fatalf("resume exited with %d:\n%s", code, out)
+	}
+	stubs, _ := os.ReadFile(stubLog)
+	want := "sysctl -w net.ipv4.tcp_sack=0\nsysctl --system\nsystemctl restart app\n"
+	if string(stubs) != want {
+		t.Errorf("stub calls of resume:\ngot:\n%s\nwant:\n%s", stubs, want)
+	}
+	h.expect("etc/app/app.conf", "listen = 0.0.0.0:8080\n\n")
+	if !strings.Contains(h.read("etc/app/extra.ini"), "open_files = 65535") {
+		t.Errorf("resume did not apply web_1:\n%s", h.read("etc/app/extra.ini"))
+	}
+	h.expect(journal, "<missing>")
+	if h.read("patchfile") == "<missing>" {
+		t.Error("control file was not written after resuming")
+	}
+	logs := h.logs()
+	for _, line := range []string{"decision=applied patch=app_1 reason=interrupted-run", "decision=reapplied patch=net_1 reason=resumed", "decision=applied patch=web_1"} {
+		if !strings.Contains(logs[len(logs)-1], line) {
+			t.Errorf("log of resume is missing %q:\n%s", line, logs[len(logs)-1])
+		}
+	}
+
+	out, code = h.run("patch.sh", "resume")
+	if code != 0 || !strings.Contains(out, "No run was interrupted") {
+		t.Errorf("second resume exited with %d:\n%s", code, out)
+	}
+
+	// interrupted reverts the patches the interrupted run started, without a control file
+	h = newHarnessDir(t, "journal")
+	h.write(filepath.Join(h.root, "crash"), "", 0o644)
+	h.run("patch.sh", "all")
+	os.Remove(filepath.Join(h.root, "crash"))
+	out, code = h.run("revert.sh", "interrupted")
+	if code != 0 || !strings.Contains(out, "Reverting the patches app_1 net_1") {
+		t.Fatalf("revert interrupted exited with %d:\n%s", code, out)
+	}
+	for name, body := range originals {
+		h.expect(name, body)
+	}
+	h.expect("etc/sysctl.d/90-net.conf", "<missing>")
+	h.expect(journal, "<missing>")
+	if out, code = h.run("patch.sh", "all"); code != 0 {
+		t.Errorf("patch after reverting the interrupted run exited with %d:\n%s", code, out)
+	}
+
+	// resuming an interrupted reapply runs the commands after the compliant target and its handlers
+	h.write(filepath.Join(h.root, "etc/sysctl.d/90-net.conf"), "net.ipv4.tcp_sack = 1\n", 0o644)
+	h.write(filepath.Join(h.root, "crash"), "", 0o644)
+	if out, code = h.run("patch.sh", "reapply", "net"); code == 0 {
+		t.Fatalf("reapply was not interrupted:\n%s", out)
+	}
+	os.Remove(filepath.Join(h.root, "crash"))
+	stubLog = filepath.Join(h.dir, "stub.log")
+	os.Remove(stubLog)
+	out, code = h.run("patch.sh", "resume")
+	if code != 0 || strings.Contains(out, "Skipping") {
+		t.Fatalf("resume of reapply exited with %d:\n%s", code, out)
+	}
+	stubs, _ = os.ReadFile(stubLog)
+	if want := "sysctl -w net.ipv4.tcp_sack=0\nsysctl --system\n"; string(stubs) != want {
+		t.Errorf("stub calls of resuming reapply:\ngot:\n%s\nwant:\n%s", stubs, want)
+	}
+	if logs = h.logs(); !strings.Contains(logs[len(logs)-1], "decision=reapplied patch=net_1 reason=resumed") {
+		t.Errorf("log of resuming reapply:\n%s", logs[len(logs)-1])
+	}
+}
+
+func TestLock(t *testing.T) {
+	if _, err := exec.LookPath("flock"); err != nil {
+		t.Skip("flock is not available")
+	}
+	h := newHarnessDir(t, "journal")
+
+	// another run holds the lock
+	lockFile := filepath.Join(h.root, generator.LockFile)
+	h.write(lockFile, "pid=1 script=patch action=apply selector=all\n", 0o644)
+	fd, err := os.Open(lockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	if err := syscall.Flock(int(fd.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+
+	before := h.snapshot()
+	out, code := h.run("patch.sh", "all")
+	if code != 1 || !strings.Contains(out, "another run holds") || !strings.Contains(out, "pid=1 script=patch") {
+		t.Errorf("patch while locked exited with %d:\n%s", code, out)
+	}
+	for name, body := range h.snapshot() {
+		if before[name] != body {
+			t.Errorf("patch while locked changed %s", name)
+		}
+	}
+
+	// PATCHFILES_LOCK_TIMEOUT waits for it
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		syscall.Flock(int(fd.Fd()), syscall.LOCK_UN)
+	}()
+	t.Setenv("PATCHFILES_LOCK_TIMEOUT", "10")
+	if out, code = h.run("patch.sh", "all"); code != 0 {
+		t.Errorf("patch waiting for the lock exited with %d:\n%s", code, out)
+	}
+	if body := h.read(strings.TrimPrefix(generator.LockFile, "/")); !strings.Contains(body, "script=patch action=apply selector=all") || strings.HasPrefix(body, "pid=1 ") {
+		t.Errorf("lock file does not name the run: %s", body)
+	}
+}
+
+func TestCommandBeforeFails(t *testing.T) {
+	h := newHarness(t)
+
+	// stopping the service fails, app_1 is left alone and its commands after are not run
+	h.write(filepath.Join(h.dir, "bin", "systemctl"), "#!/usr/bin/env bash\n[[ \"$1\" != stop ]]\n", 0o755)
+
+	out, code := h.run("patch.sh", "services")
+	if code != 1 {
+		t.Fatalf("patch with a failing command before exited with %d:\n%s", code, out)
+	}
+	if !strings.Contains(out, "a command before 'app_1' failed") {
+		t.Errorf("output does not name the failed patch:\n%s", out)
+	}
+	h.expect("etc/app/app.conf", originals["etc/app/app.conf"])
+	h.expect("etc/app/app.conf.oldpatchfile", "<missing>")
+	h.expect("patchfile", "<missing>")
+	if got := h.read("etc/app/extra.ini"); !strings.Contains(got, "PATCHFILES END app_3") {
+		t.Errorf("other patches were not applied:\n%s", got)
+	}
+
+	logs := h.logs()
+	if len(logs) != 1 || !strings.Contains(logs[0], " decision=failed patch=app_1 reason=commands-before") {
+		t.Errorf("run log does not record the failure:\n%v", logs)
+	}
+}
+
+func TestCheckAndReapply(t *testing.T) {
+	h := newHarness(t)
+
+	// patches that were never applied do not drift, reapply leaves them to apply
+	out, code := h.run("patch.sh", "check", "all")
+	if code != 0 || !strings.Contains(out, "SKIP   app_1") || strings.Contains(out, "DRIFT") {
+		t.Fatalf("check before patch exited with %d:\n%s", code, out)
+	}
+	out, code = h.run("patch.sh", "reapply", "all")
+	if code != 0 || strings.Contains(out, "Reapplying") {
+		t.Fatalf("reapply before patch exited with %d:\n%s", code, out)
+	}
+	for name, body := range originals {
+		h.expect(name, body)
+	}
+	if files := h.snapshot(); len(files) != len(originals) {
+		t.Errorf("reapply before patch left files behind: %v", files)
+	}
+
+	h.run("patch.sh", "all")
+
+	out, code = h.run("patch.sh", "check", "all")
+	if code != 0 || !strings.Contains(out, "No drift detected") {
+		t.Fatalf("check after patch exited with %d:\n%s", code, out)
+	}
+
+	h.write(filepath.Join(h.root, "etc/app/app.conf"), "edited by hand\n", 0o644)
+	extra := strings.Replace(h.read("etc/app/extra.ini"), "size = 128m", "size = 1g", 1)
+	h.write(filepath.Join(h.root, "etc/app/extra.ini"), extra, 0o644)
+
+	out, code = h.run("patch.sh", "check", "all")
+	if code != 1 {
+		t.Fatalf("check after drift exited with %d:\n%s", code, out)
+	}
+	for _, line := range []string{"DRIFT  app_1", "DRIFT  app_3", "OK     app_2", "OK     net_1"} {
+		if !strings.Contains(out, line) {
+			t.Errorf("check output is missing %q:\n%s", line, out)
+		}
+	}
+
+	out, code = h.run("patch.sh", "reapply", "all")
+	if code != 0 {
+		t.Fatalf("reapply exited with %d:\n%s", code, out)
+	}
+
+	out, code = h.run("patch.sh", "check", "all")
+	if code != 0 {
+		t.Fatalf("check after reapply exited with %d:\n%s", code, out)
+	}
+
+	// reapply must not replace the backup taken by the first run
+	h.expect("etc/app/app.conf.oldpatchfile", originals["etc/app/app.conf"])
+	if strings.Count(h.read("etc/app/extra.ini"), "PATCHFILES START app_3") != 1 {
+		t.Errorf("reapply duplicated the block:\n%s", h.read("etc/app/extra.ini"))
+	}
+}
+
+func TestRunLog(t *testing.T) {
+	h := newHarness(t)
+
+	// the stubbed sysctl fails, which is logged but does not fail the run
+	h.write(filepath.Join(h.dir, "bin", "sysctl"), "#!/usr/bin/env bash\nexit 3\n", 0o755)
+
+	out, code := h.run("patch.sh", "app")
+	if code != 0 {
+		t.Fatalf("patch exited with %d:\n%s", code, out)
+	}
+	os.Remove(filepath.Join(h.root, "patchfile"))
+	h.run("patch.sh", "networking")
+	os.Remove(filepath.Join(h.root, "patchfile"))
+	h.run("patch.sh", "app")
+
+	logs := h.logs()
+	if len(logs) != 3 {
+		t.Fatalf("got %d run logs, want 3:\n%v", len(logs), logs)
+	}
+
+	for i, lines := range [][]string{
+		{
+			"start action=apply selector=app ",
+			"decision=applied patch=app_1",
+			"command patch=app_1 exit=0 command=systemctl stop app",
+			"command patch=app_1 exit=0 command=systemctl start app",
+			"decision=applied patch=app_3",
+			"decision=skipped-condition patch=net_1 reason=selector=app",
+			"summary action=apply selector=app done=3 skipped=2 failed=0 commands_failed=0 drifted=0",
+		},
+		{
+			"command patch=net_1 exit=3 command=sysctl -p",
+			"summary action=apply selector=networking done=1 skipped=4 failed=0 commands_failed=1 drifted=0",
+		},
+		{
+			"decision=skipped-already-patched patch=app_1",
+			"decision=skipped-already-patched patch=app_2",
+			"summary action=apply selector=app done=0 skipped=5 failed=0 commands_failed=0 drifted=0",
+		},
+	} {
+		for _, line := range lines {
+			if !strings.Contains(logs[i], " "+line) {
+				t.Errorf("log of run %d is missing %q:\n%s", i+1, line, logs[i])
+			}
+		}
+	}
+
+	// a failed write is logged, fails the run and does not mark the system as patched
+	os.Remove(filepath.Join(h.root, "patchfile"))
+	h.write(filepath.Join(h.root, "etc/udev/rules.d/60-test.rules", "keep"), "", 0o644)
+
+	out, code = h.run("patch.sh", "rules")
+	if code != 1 {
+		t.Fatalf("patch with a directory as target exited with %d:\n%s", code, out)
+	}
+	h.expect("patchfile", "<missing>")
+
+	logs = h.logs()
+	if !strings.Contains(logs[3], " decision=failed patch=rules_1 reason=write") {
+		t.Errorf("log of the failed run is missing the failure:\n%s", logs[3])
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	h := newHarness(t)
+
+	if _, err := exec.LookPath("udevadm"); err == nil {
+		t.Skip("udevadm is installed on this host")
+	}
+	os.Remove(filepath.Join(h.dir, "bin", "udevadm"))
+	os.MkdirAll(filepath.Join(h.root, "etc/udev/rules.d/60-test.rules.oldpatchfile"), 0o755)
+	before := h.snapshot()
+
+	// rules_1 needs udevadm, app_1 is fine, the run is refused as a whole
+	out, code := h.run("patch.sh", "all")
+	if code != 1 {
+		t.Fatalf("patch without udevadm exited with %d:\n%s", code, out)
+	}
+	if !strings.Contains(out, "Preflight failed") || !strings.Contains(out, "missing command 'udevadm' needed by 'rules_1'") {
+		t.Errorf("preflight output:\n%s", out)
+	}
+	for name, body := range before {
+		h.expect(name, body)
+	}
+	if after := h.snapshot(); len(after) != len(before) {
+		t.Errorf("preflight changed files: %v", after)
+	}
+
+	// patches that do not need udevadm still apply
+	out, code = h.run("patch.sh", "app")
+	if code != 0 {
+		t.Fatalf("patch of app exited with %d:\n%s", code, out)
+	}
+
+	os.Remove(filepath.Join(h.root, "patchfile"))
+	out, code = h.run("patch.sh", "nothing")
+	if code != 1 || !strings.Contains(out, "No patch matches 'nothing'") {
+		t.Errorf("unknown selector exited with %d:\n%s", code, out)
+	}
+}
+
+func TestInteractive(t *testing.T) {
+	h := newHarness(t)
+
+	out, code := h.run("patch.sh", "interactive")
+	if code != 1 || !strings.Contains(out, "needs a terminal") {
+		t.Fatalf("interactive without a terminal exited with %d:\n%s", code, out)
+	}
+
+	// show the diff of app_1, pick app_1 and net_1 by number and confirm
+	out, code = h.runTerminal("d 1\n1 4\ny\n", "patch.sh", "interactive")
+	if code != 0 {
+		t.Fatalf("interactive exited with %d:\n%s", code, out)
+	}
+	for _, want := range []string{"1) app_1 [services]", "4) net_1 [networking]", "+listen = 0.0.0.0:8080", "-listen = 127.0.0.1:80"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output is missing %q:\n%s", want, out)
+		}
+	}
+
+	h.expect("etc/app/app.conf", "listen = 0.0.0.0:8080\nworkers = 4\n\n")
+	h.expect("etc/app/extra.ini", originals["etc/app/extra.ini"])
+	if !strings.Contains(h.read("etc/net.conf"), "PATCHFILES END net_1") {
+		t.Errorf("net_1 was not applied:\n%s", h.read("etc/net.conf"))
+	}
+
+	// one by one: yes to app_2, diff and no for the rest
+	os.Remove(filepath.Join(h.root, "patchfile"))
+	out, code = h.runTerminal("\nn\ny\nd\nn\nn\nn\ny\n", "patch.sh", "interactive")
+	if code != 0 {
+		t.Fatalf("interactive one by one exited with %d:\n%s", code, out)
+	}
+	if !strings.Contains(out, "+; PATCHFILES START app_3") {
+		t.Errorf("append diff is missing:\n%s", out)
+	}
+	if got := h.read("etc/app/extra.ini"); !strings.Contains(got, "PATCHFILES END app_2") || strings.Contains(got, "app_3") {
+		t.Errorf("only app_2 should be applied:\n%s", got)
+	}
+
+	// quitting changes nothing
+	os.Remove(filepath.Join(h.root, "patchfile"))
+	before := h.snapshot()
+	out, code = h.runTerminal("q\n", "patch.sh", "interactive")
+	if code != 1 || !strings.Contains(out, "Nothing was changed") {
+		t.Errorf("quitting exited with %d:\n%s", code, out)
+	}
+	for name, body := range before {
+		h.expect(name, body)
+	}
+}
+
+// logs returns the content of the run logs in the order they were written.
+func (h *harness) logs() (logs []string) {
+	h.t.Helper()
+
+	entries, err := os.ReadDir(filepath.Join(h.dir, "log"))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	type runLog struct {
+		modified int64
+		body     string
+	}
+	runs := make([]runLog, 0)
+	for _, entry := range entries {
+		info, _ := entry.Info()
+		body, _ := os.ReadFile(filepath.Join(h.dir, "log", entry.Name()))
+		runs = append(runs, runLog{info.ModTime().UnixNano(), string(body)})
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].modified < runs[j].modified
+	})
+
+	for _, run := range runs {
+		logs = append(logs, run.body)
+	}
+
+	return
+}
+
+// hashOf returns the hash carried by the start marker of a block with the given body.
+func hashOf(body string) string {
+	sum := sha256.Sum256([]byte(body))
+
+	return hex.EncodeToString(sum[:])[:12]
+}
@@ -0,0 +1,94 @@
+package generator
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"patchfiles/parser"
+)
+
+// LinesRecord returns the file a lines mode patch records its change in, next to the target. It
+// holds the unified diff from the original to the patched target, so revert restores the original
+// lines exactly by applying it in reverse.
+func LinesRecord(p *parser.Result) string {
+	return p.Patch.Output + "." + p.Name + ".linespatchfile"
+}
+
+// EditLines returns text with the rules of a lines mode patch applied, like pf_lines in the patch
+// script. Every line is run through the rules in order: a present rule replaces its first match
+// with its line and drops further matches, an absent rule drops matches and a commented rule puts
+// the comment character in front of matches that are not commented out yet. Lines of present rules
+// that matched nothing are appended. Every line of the result ends with a newline, like awk prints.
+func EditLines(p *parser.Result, text string) (string, error) {
+	rules := p.Patch.Rules
+	matches := make([]*regexp.Regexp, len(rules))
+	for i, rule := range rules {
+		match, err := regexp.CompilePOSIX(rule.Match)
+		if err != nil {
+			return "", err
+		}
+		matches[i] = match
+	}
+
+	comment := p.Patch.CommentCharacter
+	done := make([]bool, len(rules))
+	var out strings.Builder
+
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	if text == "" {
+		lines = nil
+	}
+
+	for _, line := range lines {
+		keep := true
+		for i, rule := range rules {
+			switch {
+			case rule.State == "commented":
+				if !strings.HasPrefix(line, comment) && matches[i].MatchString(line) {
+					line = comment + line
+				}
+			case !matches[i].MatchString(line):
+			case rule.State == "absent" || done[i]:
+				keep = false
+			default:
+				line = rule.Line
+				done[i] = true
+			}
+			if !keep {
+				break
+			}
+		}
+
+		if keep {
+			out.WriteString(line + "\n")
+		}
+	}
+
+	for i, rule := range rules {
+		if (rule.State == "" || rule.State == "present") && !done[i] {
+			out.WriteString(rule.Line + "\n")
+		}
+	}
+
+	return out.String(), nil
+}
+
+// LinesPayload returns the rules of a lines mode patch as text, one rule per line, for show and
+// the resolved form of the patch: the state, the quoted regular expression and the quoted line.
+func LinesPayload(p *parser.Result) string {
+	var out strings.Builder
+	for _, rule := range p.Patch.Rules {
+		state := rule.State
+		if state == "" {
+			state = "present"
+		}
+		fmt.Fprintf(&out, "%-9s %q", state, rule.Match)
+		if state == "present" {
+			fmt.Fprintf(&out, " %q", rule.Line)
+		}
+		out.WriteString("\n")
+	}
+
+	return out.String()
+}
@@ -2,33 +2,60 @@ package generator
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"strings"
 	"text/template"
 
+	"patchfiles/merge"
 	"patchfiles/parser"
+	"patchfiles/textdiff"
+	"patchfiles/values"
 
 	"go.uber.org/zap"
 )
 
 // PatchItem contains template data for generating a single patch command in the bash script.
 type PatchItem struct {
-	NameShort        string   // Short name of the patch (first part before underscore)
-	NameLong         string   // Full name of the patch
-	Description      string   // Human-readable description of the patch
-	Body             string   // Commented body content for display in generated script
-	Payload          string   // Base64-encoded payload to write to target file
-	WriteMode        string   // Bash write mode: ">" for overwrite, ">>" for append
-	Output           string   // Target file path where patch will be applied
-	Categories       []string // List of categories this patch belongs to
-	CategoriesIfCase string   // Generated if-case string for category matching
-	CommandsAfter    []string // Commands to execute after applying the patch
+	NameShort        string             // Short name of the patch (first part before underscore)
+	NameLong         string             // Full name of the patch
+	Description      string             // Human-readable description of the patch
+	Body             string             // Commented body content for display in generated script
+	Payload          string             // Base64-encoded payload to write to target file
+	Mode             string             // Patch mode: "overwrite", "append", "diff", "lines" or "merge"
+	WriteMode        string             // Bash write mode: ">" for overwrite and diff, ">>" for append
+	Output           string             // Target file path where patch will be applied
+	Target           string             // Output prefixed with the PATCHFILES_ROOT variable, used for file operations
+	Categories       []string           // List of categories this patch belongs to
+	CategoryList     string             // Space separated categories, used by the script to select patches
+	Tools            string             // Space separated external commands of CommandsBefore and CommandsAfter, checked before patching
+	CommandsBefore   []string           // Commands to execute before applying the patch
+	CommandsAfter    []string           // Commands to execute after applying the patch
+	MarkerStart      string             // Start marker of the appended block, empty in overwrite mode
+	MarkerPrefix     string             // Start marker without the hash, matches any version of this patch's block
+	MarkerEnd        string             // End marker of the appended block, empty in overwrite mode
+	Rules            []parser.Rule      // Line rules of lines mode
+	CommentCharacter string             // Comment character, used by commented line rules
+	Record           string             // File recording the change of lines mode, prefixed with PATCHFILES_ROOT
+	Format           string             // Format of the target in merge mode: "json", "yaml", "ini" or "toml"
+	Edits            bool               // The mode edits the target with the function pf_edit_<name>, lines and merge mode
+	ValuesFunction   string             // Function pf_values_<name> computing the values of the patch, empty without values
+	PayloadTemplate  string             // Base64-encoded payload with the placeholders of the values, Payload is then the rendered PF_PAYLOAD
+	Notify           []string           // Handlers notified after writing the patch, run once by the footer
+	Verify           []parser.Assertion // Assertions run by pf_verify_<name> after all patches and handlers
+	Risky            bool               // The patch can lock the operator out, its rollback is scheduled before writing it
+	Risk             string             // Risk level: "low", "medium" or "high"
+	Effects          string             // What applying the patch does, listed before high-risk patches are applied
 }
 
 const (
-	// patchFilesControlFile is the path to the control file that tracks whether the system has been patched.
-	patchFilesControlFile = "/patchfile"
+	// ControlFile is the path to the control file that tracks whether the system has been patched.
+	ControlFile = "/patchfile"
+	// rootPrefix is prepended to every path the scripts touch, so they can run against a fake root filesystem.
+	rootPrefix = "${PATCHFILES_ROOT}"
 	// templatePatchItem is the bash script template for a single patch command block.
 	templatePatchItem = `
 	#
@@ -42,43 +69,297 @@ const (
 	# body:
 	{{.Body}}
 	#
-	
-	if [[ "$category" == "all" || "$category" == "{{.NameShort}}" {{.CategoriesIfCase}} ]]; then
-		echo -e "\n\n\n";
-		echo "Patching '{{.NameLong}}'";
-		
-		SKIP_PATCH=0
-		{{ if eq .WriteMode ">>" }}
-		# Check if already patched (append mode)
-		if grep -q "PATCHFILES START" "{{.Output}}" 2>/dev/null; then
-			echo "Warning: '{{.NameLong}}' appears to be already patched. Skipping to avoid duplicates."
-			echo "If you want to re-apply, use revert first or manually remove PATCHFILES START/END blocks."
-			SKIP_PATCH=1
+	{{ if eq .Mode "lines" }}
+	# pf_edit_{{.NameLong}} prints a file with the line rules of '{{.NameLong}}' applied
+	function pf_edit_{{.NameLong}}() {
+		PF_RULES={{len .Rules}} PF_COMMENT={{cquote .CommentCharacter}} \
+		{{- range $i, $rule := .Rules }}
+		PF_MATCH_{{inc $i}}={{cquote $rule.Match}} PF_LINE_{{inc $i}}={{cquote $rule.Line}} PF_STATE_{{inc $i}}={{cquote (or $rule.State "present")}} \
+		{{- end }}
+		pf_lines "$1"
+	}
+	{{ else if eq .Mode "merge" }}
+	# pf_edit_{{.NameLong}} prints a file with the fragment of '{{.NameLong}}' merged into it
+	function pf_edit_{{.NameLong}}() {
+		pf_merge {{.Format}} "$1" "{{.Payload}}"
+	}
+	{{ end }}
+	{{- if .ValuesFunction }}
+	{{.ValuesFunction}}
+	{{ end }}
+	{{- if .Verify }}
+	# pf_verify_{{.NameLong}} runs the assertions of '{{.NameLong}}', the footer calls it after the handlers
+	function pf_verify_{{.NameLong}}() {
+		{{- range $assertion := .Verify }}
+		PF_OUTPUT=$(
+			{{$assertion.Command}}
+		)
+		pf_verified $? {{quote $.NameLong}} {{quote (oneline $assertion.Command)}} {{quote $assertion.Equals}} {{quote $assertion.Contains}}
+		{{- end }}
+	}
+	{{ end }}
+	function pf_patch_{{.NameLong}}() {
+		{{ if .ValuesFunction -}}
+		if ! pf_values_{{.NameLong}}; then
+			echo "Error: cannot compute the values of '{{.NameLong}}' on this host" >&2
+			[[ "$1" == "diff" ]] || pf_decision failed {{quote .NameLong}} values
+			return
 		fi
-		{{ else }}
-		# Check if already patched (overwrite mode)
-		if [ -f "{{.Output}}.oldpatchfile" ]; then
-			echo "Warning: '{{.NameLong}}' appears to be already patched (backup file exists). Skipping to avoid overwriting backup."
-			echo "If you want to re-apply, use revert first or manually remove {{.Output}}.oldpatchfile"
-			SKIP_PATCH=1
+		PF_PAYLOAD=$(pf_render '{{.PayloadTemplate}}')
+
+		{{ end -}}
+		if [[ "$1" == "diff" ]]; then
+			{{ if eq .Mode "diff" -}}
+			pf_diff "{{.Target}}" "{{.Payload}}" diff
+			{{- else if .Edits -}}
+			pf_diff "{{.Target}}" '' edit pf_edit_{{.NameLong}}
+			{{- else -}}
+			pf_diff "{{.Target}}" "{{.Payload}}" {{quote .MarkerPrefix}} {{quote .MarkerEnd}}
+			{{- end }}
+			return
 		fi
-		{{ end }}
-		
-		if [ "$SKIP_PATCH" -eq 0 ]; then
-			echo "{{.Payload}}" | base64 -d - {{.WriteMode}} {{.Output}}
 
-			{{ range $command := .CommandsAfter }}
-				{{$command}}
+		local written=applied
+		if [[ "$action" == "check" || "$action" == "reapply" ]]; then
+			# only a patch applied before can drift, reapply leaves the others to apply
+			if ! {{ template "applied" . }}; then
+				echo "SKIP   {{.NameLong}} {{.Target}}, not applied"
+				pf_log "check patch={{.NameLong}} state=not-applied"
+				[[ "$action" == "check" ]] || pf_decision skipped-not-patched {{quote .NameLong}}
+				return
+			fi
+
+			if pf_check {{quote .NameLong}} "{{.Target}}" "{{.Payload}}" {{ if eq .Mode "diff" }}diff ''{{ else if .Edits }}edit pf_edit_{{.NameLong}}{{ else }}{{quote .MarkerStart}} {{quote .MarkerEnd}}{{ end }}; then
+				if [[ "$action" == "reapply" && -n "${PF_RESUME[{{quote .NameLong}}]}" ]]; then
+					# the interrupted run wrote the target, it stopped before the commands after it finished
+					pf_decision reapplied {{quote .NameLong}} resumed
+					{{ template "after" . }}
+				fi
+				return
+			fi
+			[[ "$action" == "reapply" ]] || return
+
+			echo "Reapplying '{{.NameLong}}'";
+			written=reapplied
+			SKIP_PATCH=0
+		else
+			echo -e "\n\n\n";
+			echo "Patching '{{.NameLong}}'";
+
+			SKIP_PATCH=0
+			{{ if eq .WriteMode ">>" }}
+			# Check if already patched (append mode), only this patch's block counts
+			if grep -qxF {{quote .MarkerStart}} "{{.Target}}" 2>/dev/null; then
+				SKIP_WARNING="Warning: '{{.NameLong}}' appears to be already patched. Skipping to avoid duplicates."
+				SKIP_PATCH=1
+			elif grep -qF {{quote .MarkerPrefix}} "{{.Target}}" 2>/dev/null; then
+				SKIP_WARNING="Warning: '{{.NameLong}}' is patched with a different version. Skipping to avoid duplicates.
+If you want to update it, use './patch.sh reapply {{.NameShort}}'."
+				SKIP_PATCH=1
+			fi
+			{{ else if eq .Mode "lines" }}
+			# Check if already patched (lines mode), the record of the original lines exists then
+			if [ -f "{{.Record}}" ]; then
+				SKIP_WARNING="Warning: '{{.NameLong}}' appears to be already patched ({{.Record}} exists). Skipping."
+				SKIP_PATCH=1
+			fi
+			{{ else if eq .Mode "diff" }}
+			# Check if already patched (diff mode), the diff applies in reverse then
+			if pf_diff_applied "{{.Target}}" "{{.Payload}}"; then
+				SKIP_WARNING="Warning: '{{.NameLong}}' appears to be already patched (the diff applies in reverse). Skipping."
+				SKIP_PATCH=1
+			fi
+			{{ else }}
+			# Check if already patched (overwrite mode)
+			if [ -f "{{.Target}}.oldpatchfile" ] || [ -f "{{.Target}}.newpatchfile" ]; then
+				SKIP_WARNING="Warning: '{{.NameLong}}' appears to be already patched (backup file exists). Skipping to avoid overwriting backup.
+If you want to re-apply, use revert first or manually remove {{.Target}}.oldpatchfile"
+				SKIP_PATCH=1
+			fi
+			{{ end }}
+			if [ "$SKIP_PATCH" -eq 1 ]; then
+				# an interrupted run started this patch, it may have stopped halfway through writing it or
+				# before the commands after it, reapplying finishes either
+				if [[ -n "${PF_RESUME[{{quote .NameLong}}]}" ]]; then
+					echo "Resuming '{{.NameLong}}', the interrupted run started it"
+					action=reapply pf_patch_{{.NameLong}}
+					return
+				fi
+				echo "$SKIP_WARNING"
+				pf_decision skipped-already-patched {{quote .NameLong}}
+			fi
+		fi
+
+		{{ template "before" . }}
+
+		# reapply writes like apply, the backup and the record of the first run are kept
+		if [ "$SKIP_PATCH" -eq 0 ]; then
+			mkdir -p "$(dirname "{{.Target}}")"
+			{{ if eq .WriteMode ">>" }}
+			pf_remove_block "{{.Target}}" {{quote .MarkerPrefix}} {{quote .MarkerEnd}}
+			pf_ensure_newline "{{.Target}}"
+			if echo "{{.Payload}}" | base64 -d - {{.WriteMode}} "{{.Target}}"; then
+			{{ else if eq .Mode "diff" }}
+			if pf_apply_diff "{{.Target}}" "{{.Payload}}"; then
+			{{ else if eq .Mode "lines" }}
+			if pf_apply_lines "{{.Target}}" "{{.Record}}" pf_edit_{{.NameLong}}; then
+			{{ else if eq .Mode "merge" }}
+			if pf_apply_merge "{{.Target}}" pf_edit_{{.NameLong}}; then
+			{{ else }}
+			if { test -e "{{.Target}}.oldpatchfile" || test -e "{{.Target}}.newpatchfile" || pf_take_backup "{{.Target}}"; } && echo "{{.Payload}}" | base64 -d - {{.WriteMode}} "{{.Target}}"; then
 			{{ end }}
+				pf_decision "$written" {{quote .NameLong}}
+				{{ template "after" . }}
+			{{ if .Edits -}}
+			elif [ $? -eq 2 ]; then
+				echo "'{{.NameLong}}' complies already, nothing to change"
+				pf_decision skipped-already-patched {{quote .NameLong}} compliant
+			{{ end -}}
+			{{ if or (eq .Mode "diff") .Edits -}}
+			else
+				pf_decision failed {{quote .NameLong}} {{.Mode}}
+			{{- else -}}
+			else
+				echo "Error: failed to write '{{.Target}}'" >&2
+				pf_decision failed {{quote .NameLong}} write
+			{{- end }}
+			fi
 		fi
-	fi
+	}
+	pf_register {{quote .NameLong}} {{quote .NameShort}} {{quote .CategoryList}} {{quote .Description}} "{{.Target}}" {{quote .Tools}}
+	{{- if .Risky }}
+	PF_RISKY[{{quote .NameLong}}]=1
+	{{- end }}
+	{{- if eq .Risk "high" }}
+	PF_HIGH_RISK[{{quote .NameLong}}]={{cquote .Effects}}
+	{{- end }}
+	{{- define "applied" -}}
+		{{ if eq .WriteMode ">>" -}}
+		grep -qF {{quote .MarkerPrefix}} "{{.Target}}" 2>/dev/null
+		{{- else if eq .Mode "lines" -}}
+		[ -f "{{.Record}}" ]
+		{{- else if eq .Mode "diff" -}}
+		{ pf_diff_applied "{{.Target}}" "{{.Payload}}" || ! pf_patch_file "{{.Target}}" "{{.Payload}}" --dry-run >/dev/null 2>&1; }
+		{{- else -}}
+		{ [ -f "{{.Target}}.oldpatchfile" ] || [ -f "{{.Target}}.newpatchfile" ]; }
+		{{- end }}
+	{{- end }}
+	{{- define "before" }}
+		{{ range $command := .CommandsBefore }}
+			if [ "$SKIP_PATCH" -eq 0 ]; then
+				{{$command}}
+				if ! pf_command_done $? {{quote $.NameLong}} {{quote (oneline $command)}}; then
+					echo "Error: a command before '{{$.NameLong}}' failed, '{{$.Target}}' is left unchanged" >&2
+					pf_decision failed {{quote $.NameLong}} commands-before
+					SKIP_PATCH=1
+				fi
+			fi
+		{{ end }}
+	{{- end }}
+	{{- define "after" }}
+		{{ range $command := .CommandsAfter }}
+			{{$command}}
+			pf_command_done $? {{quote $.NameLong}} {{quote (oneline $command)}}
+		{{ end }}
+		{{- if .Notify }}
+			pf_notify {{ range $i, $handler := .Notify }}{{ if $i }} {{ end }}{{quote $handler}}{{ end }}
+		{{- end }}
+	{{- end }}
 `
 )
 
+// BlockMarkers returns the lines that surround an appended block. The start marker carries the patch
+// name and a hash of the body, so each patch owns exactly one block and a changed body is detected.
+// The prefix is the start marker without the hash and matches any version of the block.
+func BlockMarkers(p *parser.Result) (start, prefix, end string) {
+	sum := sha256.Sum256([]byte(p.Patch.Body))
+
+	prefix = fmt.Sprintf("%s PATCHFILES START %s ", p.Patch.CommentCharacter, p.Name)
+	start = prefix + hex.EncodeToString(sum[:])[:12]
+	end = fmt.Sprintf("%s PATCHFILES END %s", p.Patch.CommentCharacter, p.Name)
+
+	return
+}
+
+// Payload returns the content a patch writes: the whole file in overwrite mode, or the block
+// including its markers in append mode.
+func Payload(p *parser.Result) string {
+	switch p.Patch.Mode {
+	case "append":
+		start, _, end := BlockMarkers(p)
+		return fmt.Sprintf("%s\n%s\n%s\n", start, p.Patch.Body, end)
+	case "diff", "merge":
+		return p.Patch.Body
+	case "lines":
+		return LinesPayload(p)
+	}
+
+	return p.Patch.Body + "\n"
+}
+
+// Patched returns the content of the target file after applying the patch to its current content.
+// In append mode an existing block of the patch is replaced, as the reapply action does. In diff
+// mode a target that carries the diff already is returned unchanged, and a diff whose hunks do not
+// match fails with textdiff.ErrMismatch. In lines mode the rules are applied to the current lines,
+// in merge mode the fragment is merged into them. The placeholders of the patch's values are
+// replaced by the computed values, see ComputeValues.
+func Patched(p *parser.Result, current string, computed map[string]string) (string, error) {
+	switch p.Patch.Mode {
+	case "lines":
+		return EditLines(p, current)
+	case "merge":
+		return merge.Merge(p.Patch.Format, current, p.Patch.Body)
+	}
+	if p.Patch.Mode == "diff" {
+		if _, err := textdiff.Revert(current, p.Patch.Body); err == nil {
+			return current, nil
+		}
+		return textdiff.Apply(current, p.Patch.Body)
+	}
+	payload := values.Render(Payload(p), computed)
+	if p.Patch.Mode != "append" {
+		return payload, nil
+	}
+
+	_, prefix, end := BlockMarkers(p)
+	current = RemoveBlock(current, prefix, end)
+	if current != "" && !strings.HasSuffix(current, "\n") {
+		current += "\n"
+	}
+
+	return current + payload, nil
+}
+
+// RemoveBlock removes the lines from one starting with prefix up to the line equal to end, like
+// the pf_remove_block function of the generated scripts.
+func RemoveBlock(content, prefix, end string) string {
+	var out strings.Builder
+
+	skip := false
+	for _, line := range strings.SplitAfter(content, "\n") {
+		bare := strings.TrimSuffix(line, "\n")
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(bare, prefix) {
+			skip = true
+		}
+		if !skip {
+			out.WriteString(line)
+		}
+		if skip && bare == end {
+			skip = false
+		}
+	}
+
+	return out.String()
+}
+
 // writePatch generates a patch command block for the bash script from a parsed patch definition.
-// It encodes the patch body as base64, determines write mode (overwrite/append), creates backup for overwrite mode,
-// generates category matching logic, and writes the patch command template to the patch script file.
-func (generator *Generator) writePatch(p *parser.Result) (err error) {
+// It encodes the patch body as base64 and writes the function applying, checking and reapplying the
+// patch, registered with its categories, target and the tools it needs.
+func (generator *Generator) writePatch(w io.Writer, p *parser.Result) (err error) {
 	logger := generator.Log.WithOptions(zap.Fields(
 		zap.String("fileLoc", *p.FileLoc),
 		zap.String("name", p.Name),
@@ -94,51 +375,62 @@ func (generator *Generator) writePatch(p *parser.Result) (err error) {
 	bodyCommented = strings.Trim(bodyCommented, "\n")
 
 	// generate payload
+	markerStart, markerPrefix, markerEnd := "", "", ""
 	if p.Patch.Mode == "append" {
-		p.Patch.Body = fmt.Sprintf("\n%s PATCHFILES START\n%s\n%s PATCHFILES END\n", p.Patch.CommentCharacter, p.Patch.Body, p.Patch.CommentCharacter)
+		markerStart, markerPrefix, markerEnd = BlockMarkers(p)
 	}
-	payload := base64.StdEncoding.EncodeToString([]byte(p.Patch.Body + "\n"))
+	payload := base64.StdEncoding.EncodeToString([]byte(Payload(p)))
+	resolved := Resolve(p)
 
 	// write mode
-	commandsAfter := p.Patch.CommandsAfter
 	writeMode := ">"
 	if p.Patch.Mode == "append" {
 		writeMode = ">>"
-	} else {
-		command := fmt.Sprintf("cp -r %s %s.oldpatchfile", p.Patch.Output, p.Patch.Output)
-		commandsAfter = append(commandsAfter, command)
-	}
-
-	// prepare categories if case
-	categories := make([]string, 0)
-	for _, category := range p.Patch.Categories {
-		categories = append(categories, fmt.Sprintf("\"$category\" == \"%s\"", category))
-	}
-	categoriesIfCase := strings.Join(categories, " || ")
-	categoriesIfCase = strings.Trim(categoriesIfCase, " ")
-	if categoriesIfCase != "" {
-		categoriesIfCase = " || " + categoriesIfCase
 	}
 
 	buf := new(bytes.Buffer)
-	tpl, err := template.New("template").Parse(templatePatchItem)
+	tpl, err := template.New("template").Funcs(funcs).Parse(templatePatchItem)
 	if err != nil {
 		return
 	}
 
-	nameShort := strings.Split(p.Name, "_")[0]
+	nameShort := p.ShortName()
 
 	data := PatchItem{
 		NameLong:         p.Name,
 		NameShort:        nameShort,
 		Description:      p.Patch.Description,
 		Body:             bodyCommented,
+		Mode:             p.Patch.Mode,
+		Rules:            p.Patch.Rules,
+		CommentCharacter: p.Patch.CommentCharacter,
+		Record:           rootPrefix + LinesRecord(p),
+		Format:           p.Patch.Format,
+		Edits:            p.Patch.Mode == "lines" || p.Patch.Mode == "merge",
 		WriteMode:        writeMode,
 		Output:           p.Patch.Output,
+		Target:           rootPrefix + p.Patch.Output,
 		Payload:          payload,
-		CommandsAfter:    commandsAfter,
+		CommandsBefore:   resolved.CommandsBefore,
+		CommandsAfter:    resolved.CommandsAfter,
+		Notify:           p.Patch.Notify,
+		Verify:           p.Patch.Verify,
+		Risky:            p.Patch.Risky,
+		Risk:             p.Patch.RiskLevel(),
+		Effects:          Effects(p),
+		MarkerStart:      markerStart,
+		MarkerPrefix:     markerPrefix,
+		MarkerEnd:        markerEnd,
 		Categories:       p.Patch.Categories,
-		CategoriesIfCase: categoriesIfCase,
+		CategoryList:     strings.Join(p.Patch.Categories, " "),
+		Tools:            tools(p, false, resolved.CommandsBefore, resolved.CommandsAfter, verifyCommands(p)),
+	}
+
+	// the payload of a patch with values is rendered on the host, before anything uses it
+	if len(p.Patch.Values) > 0 {
+		data.ValuesFunction = valuesFunction(p)
+		data.PayloadTemplate = payload
+		data.Payload = "${PF_PAYLOAD}"
 	}
 
 	t := template.Must(tpl, err)
@@ -147,9 +439,9 @@ func (generator *Generator) writePatch(p *parser.Result) (err error) {
 		return
 	}
 
-	body := buf.String()
-	body = strings.ReplaceAll(body, "\t", "")
-	generator.fdPatch.WriteString(body + "\n")
-	generator.fdPatch.Sync()
+	res := buf.String()
+	res = strings.ReplaceAll(res, "\t", "")
+	_, err = io.WriteString(w, res+"\n")
+
 	return
 }
@@ -0,0 +1,100 @@
+package generator
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"patchfiles/parser"
+)
+
+// Resolved is a patch with everything the generated scripts derive from it spelled out:
+// the exact payload, the backup taken before writing and the revert command.
+type Resolved struct {
+	Name           string   `json:"name" yaml:"name"`                                 // Full name of the patch
+	ShortName      string   `json:"shortName" yaml:"shortName"`                       // Short name used as selector
+	FileLoc        string   `json:"fileLoc" yaml:"fileLoc"`                           // Location of the YAML definition
+	Kind           string   `json:"kind,omitempty" yaml:"kind,omitempty"`             // Patch kind, empty for files
+	Output         string   `json:"output" yaml:"output"`                             // Target file path
+	Mode           string   `json:"mode" yaml:"mode"`                                 // Write mode: "overwrite", "append", "diff", "lines" or "merge"
+	Format         string   `json:"format,omitempty" yaml:"format,omitempty"`         // Format of the target in merge mode
+	Categories     []string `json:"categories" yaml:"categories"`                     // Categories the patch belongs to
+	Risk           string   `json:"risk" yaml:"risk"`                                 // Risk level: "low", "medium" or "high"
+	Risky          bool     `json:"risky,omitempty" yaml:"risky,omitempty"`           // The patch script schedules a rollback of the patch unless confirmed
+	Description    string   `json:"description" yaml:"description"`                   // Human-readable description
+	Values         []string `json:"values,omitempty" yaml:"values,omitempty"`         // Values computed on the host, as "name = expr, min x, max y"
+	Payload        string   `json:"payload" yaml:"payload"`                           // Content written, including append markers, the rules in lines mode
+	Backup         string   `json:"backup,omitempty" yaml:"backup,omitempty"`         // Backup taken before overwriting
+	CommandsBefore []string `json:"commandsBefore" yaml:"commandsBefore"`             // Commands run before writing the payload
+	CommandsAfter  []string `json:"commandsAfter" yaml:"commandsAfter"`               // Commands run after writing the payload
+	RevertBefore   []string `json:"revertCommandsBefore" yaml:"revertCommandsBefore"` // Commands run before reverting
+	Revert         string   `json:"revert" yaml:"revert"`                             // Command in the revert script that undoes the write
+	RevertAfter    []string `json:"revertCommandsAfter" yaml:"revertCommandsAfter"`   // Commands run after reverting
+	Notify         []string `json:"notify,omitempty" yaml:"notify,omitempty"`         // Handlers run once after all patches are written or reverted, as "name: command"
+	Verify         []string `json:"verify,omitempty" yaml:"verify,omitempty"`         // Assertions run after all patches and handlers, as "command == output"
+}
+
+// Resolve returns the resolved form of a patch, as the patch and revert scripts execute it.
+// Paths carry the ${PATCHFILES_ROOT} prefix used by the scripts. The commands include those
+// derived from the patch kind, e.g. enabling a systemd unit.
+func Resolve(p *parser.Result) *Resolved {
+	target := rootPrefix + p.Patch.Output
+
+	r := Resolved{
+		Name:           p.Name,
+		ShortName:      p.ShortName(),
+		FileLoc:        *p.FileLoc,
+		Kind:           p.Patch.Kind,
+		Output:         p.Patch.Output,
+		Mode:           p.Patch.Mode,
+		Format:         p.Patch.Format,
+		Categories:     p.Patch.Categories,
+		Risk:           p.Patch.RiskLevel(),
+		Risky:          p.Patch.Risky,
+		Description:    p.Patch.Description,
+		Payload:        Payload(p),
+		CommandsBefore: p.Patch.CommandsBefore,
+	}
+
+	for _, v := range p.Patch.Values {
+		value := v.Name + " = " + v.Expr
+		if v.Min != "" {
+			value += ", min " + v.Min
+		}
+		if v.Max != "" {
+			value += ", max " + v.Max
+		}
+		r.Values = append(r.Values, value)
+	}
+
+	for _, handler := range orderHandlers(p.Patch.Notify) {
+		r.Notify = append(r.Notify, handler.Name+": "+handler.Command)
+	}
+
+	for _, assertion := range p.Patch.Verify {
+		r.Verify = append(r.Verify, assertion.String())
+	}
+
+	// the commands of the patch kind run first, so the patch's own commands find the unit in place
+	after, revertBefore, revertAfter := unitCommands(p)
+	sysctlAfter, sysctlRevertAfter := sysctlCommands(p)
+	after = append(after, sysctlAfter...)
+	revertAfter = append(revertAfter, sysctlRevertAfter...)
+	r.CommandsAfter = append(after, p.Patch.CommandsAfter...)
+	r.RevertBefore = append(revertBefore, p.Patch.CommandsBeforeRevert...)
+	r.RevertAfter = append(revertAfter, p.Patch.CommandsAfterRevert...)
+
+	switch p.Patch.Mode {
+	case "append":
+		_, prefix, end := BlockMarkers(p)
+		r.Revert = fmt.Sprintf("pf_remove_block \"%s\" %s %s", target, Quote(prefix), Quote(end))
+	case "lines":
+		r.Revert = fmt.Sprintf("pf_revert_lines \"%s\" \"%s\"", target, rootPrefix+LinesRecord(p))
+	case "diff":
+		r.Revert = fmt.Sprintf("pf_revert_diff \"%s\" '%s'", target, base64.StdEncoding.EncodeToString([]byte(r.Payload)))
+	default:
+		r.Backup = fmt.Sprintf("cp -a \"%s\" \"%s.oldpatchfile\"", target, target)
+		r.Revert = fmt.Sprintf("pf_restore_backup \"%s\"", target)
+	}
+
+	return &r
+}
@@ -2,7 +2,7 @@ package generator
 
 import (
 	"bytes"
-	"fmt"
+	"io"
 	"strings"
 	"text/template"
 
@@ -13,13 +13,17 @@ import (
 
 // RevertItem contains template data for generating a single revert command in the bash script.
 type RevertItem struct {
-	NameShort        string   // Short name of the patch (first part before underscore)
-	NameLong         string   // Full name of the patch
-	Description      string   // Human-readable description of the patch
-	Categories       []string // List of categories this patch belongs to
-	CategoriesIfCase string   // Generated if-case string for category matching
-	Command          string   // Bash command to revert the patch
-	CommandsAfter    []string // Commands to execute after reverting the patch
+	NameShort      string   // Short name of the patch (first part before underscore)
+	NameLong       string   // Full name of the patch
+	Description    string   // Human-readable description of the patch
+	Categories     []string // List of categories this patch belongs to
+	CategoryList   string   // Space separated categories, used by the script to select patches
+	Target         string   // Target file prefixed with the PATCHFILES_ROOT variable
+	Tools          string   // Space separated external commands of CommandsBefore and CommandsAfter, checked before reverting
+	CommandsBefore []string // Commands to execute before reverting the patch
+	Command        string   // Bash command to revert the patch
+	CommandsAfter  []string // Commands to execute after reverting the patch
+	Notify         []string // Handlers notified after reverting the patch, run once by the footer
 }
 
 const (
@@ -36,71 +40,79 @@ const (
 	#
 
 
-	if [[ "$category" == "all" || "$category" == "{{.NameShort}}" {{.CategoriesIfCase}} ]]; then
+	function pf_revert_{{.NameLong}}() {
 		echo -e "\n\n\n"
 		echo "Reverting '{{.NameLong}}'"
 
-		{{.Command}}
-		{{ range $command := .CommandsAfter }}
-			{{$command}}
+		SKIP_PATCH=0
+		{{ range $command := .CommandsBefore }}
+			if [ "$SKIP_PATCH" -eq 0 ]; then
+				{{$command}}
+				if ! pf_command_done $? {{quote $.NameLong}} {{quote (oneline $command)}}; then
+					echo "Error: a command before reverting '{{$.NameLong}}' failed, '{{$.Target}}' is left unchanged" >&2
+					pf_decision failed {{quote $.NameLong}} commands-before
+					SKIP_PATCH=1
+				fi
+			fi
 		{{ end }}
-	fi;
+
+		if [ "$SKIP_PATCH" -ne 0 ]; then
+			return
+		elif {{.Command}}; then
+			pf_decision reverted {{quote .NameLong}}
+
+			{{ range $command := .CommandsAfter }}
+				{{$command}}
+				pf_command_done $? {{quote $.NameLong}} {{quote (oneline $command)}}
+			{{ end }}
+			{{- if .Notify }}
+				pf_notify {{ range $i, $handler := .Notify }}{{ if $i }} {{ end }}{{quote $handler}}{{ end }}
+			{{- end }}
+		elif [ $? -eq 2 ]; then
+			echo "'{{.NameLong}}' is not patched, nothing to revert"
+			pf_decision skipped-not-patched {{quote .NameLong}}
+		else
+			echo "Error: failed to revert '{{.NameLong}}'" >&2
+			pf_decision failed {{quote .NameLong}} revert
+		fi
+	}
+	pf_register {{quote .NameLong}} {{quote .NameShort}} {{quote .CategoryList}} {{quote .Description}} "{{.Target}}" {{quote .Tools}}
 `
 )
 
 // writeRevert generates a revert command block for the bash script from a parsed patch definition.
-// For overwrite mode, it restores the backup file. For append mode, it removes the PATCHFILES START/END block.
-// It generates category matching logic and writes the revert command template to the revert script file.
-func (generator *Generator) writeRevert(p *parser.Result) (err error) {
+// For overwrite mode, it restores the backup file. For append mode, it removes this patch's PATCHFILES START/END block.
+// A patch that was not applied is skipped, without the commands after it and the handlers it notifies.
+// The block is a function registered with its categories, target and tools, run by the footer when selected.
+func (generator *Generator) writeRevert(w io.Writer, p *parser.Result) (err error) {
 	logger := generator.Log.WithOptions(zap.Fields(
 		zap.String("fileLoc", *p.FileLoc),
 		zap.String("name", p.Name),
 	))
 	logger.Debug("attempt to write revert")
 
-	// generate payload
-	start := fmt.Sprintf("%s PATCHFILES START", p.Patch.CommentCharacter)
-	end := fmt.Sprintf("%s PATCHFILES END", p.Patch.CommentCharacter)
-
-	// write mode
-	writeMode := ">"
-	if p.Patch.Mode == "append" {
-		writeMode = ">>"
-	}
-
-	command := ""
-	if writeMode == ">" {
-		command = fmt.Sprintf("mv %s.oldpatchfile %s", p.Patch.Output, p.Patch.Output)
-	} else {
-		command += fmt.Sprintf("sed -i -e '/%s/,/%s/c\\' %s", start, end, p.Patch.Output)
-	}
+	resolved := Resolve(p)
 
 	buf := new(bytes.Buffer)
-	tpl, err := template.New("template").Parse(templateRevertItem)
+	tpl, err := template.New("template").Funcs(funcs).Parse(templateRevertItem)
 	if err != nil {
 		return
 	}
 
-	nameShort := strings.Split(p.Name, "_")[0]
-
-	// prepare categories if case
-	categories := make([]string, 0)
-	for _, category := range p.Patch.Categories {
-		categories = append(categories, fmt.Sprintf("\"$category\" == \"%s\"", category))
-	}
-	categoriesIfCase := strings.Join(categories, " || ")
-	categoriesIfCase = strings.Trim(categoriesIfCase, " ")
-	if categoriesIfCase != "" {
-		categoriesIfCase = " || " + categoriesIfCase
-	}
+	nameShort := p.ShortName()
 
 	data := RevertItem{
-		NameLong:         p.Name,
-		NameShort:        nameShort,
-		Description:      p.Patch.Description,
-		Command:          command,
-		CommandsAfter:    p.Patch.CommandsAfter,
-		CategoriesIfCase: categoriesIfCase,
+		NameLong:       p.Name,
+		NameShort:      nameShort,
+		Description:    p.Patch.Description,
+		Command:        resolved.Revert,
+		CommandsBefore: resolved.RevertBefore,
+		CommandsAfter:  resolved.RevertAfter,
+		Notify:         p.Patch.Notify,
+		Categories:     p.Patch.Categories,
+		CategoryList:   strings.Join(p.Patch.Categories, " "),
+		Target:         rootPrefix + p.Patch.Output,
+		Tools:          tools(p, true, resolved.RevertBefore, resolved.RevertAfter),
 	}
 
 	t := template.Must(tpl, err)
@@ -111,8 +123,7 @@ func (generator *Generator) writeRevert(p *parser.Result) (err error) {
 
 	body := buf.String()
 	body = strings.ReplaceAll(body, "\t", "")
-	generator.fdRevert.WriteString(body + "\n")
-	generator.fdRevert.Sync()
+	_, err = io.WriteString(w, body+"\n")
 
 	return
 }
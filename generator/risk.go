@@ -0,0 +1,41 @@
+package generator
+
+import (
+	"fmt"
+	"strings"
+
+	"patchfiles/parser"
+)
+
+// Effects returns what applying a patch does on the host, one line per step, e.g. "write
+// /etc/ssh/sshd_config (overwrite)" and "notify restart sshd". The patch script lists the effects of
+// high-risk patches before asking to apply them.
+func Effects(p *parser.Result) string {
+	r := Resolve(p)
+	lines := make([]string, 0)
+
+	for _, command := range r.CommandsBefore {
+		lines = append(lines, "run "+oneline(command))
+	}
+	switch r.Mode {
+	case "diff":
+		lines = append(lines, fmt.Sprintf("apply a diff to %s", r.Output))
+	case "lines":
+		lines = append(lines, fmt.Sprintf("edit the lines of %s", r.Output))
+	case "merge":
+		lines = append(lines, fmt.Sprintf("merge into %s (%s)", r.Output, r.Format))
+	default:
+		lines = append(lines, fmt.Sprintf("write %s (%s)", r.Output, r.Mode))
+	}
+	for _, command := range r.CommandsAfter {
+		lines = append(lines, "run "+oneline(command))
+	}
+	for _, handler := range p.Patch.Notify {
+		lines = append(lines, "notify "+handler)
+	}
+	if r.Risky {
+		lines = append(lines, "schedule its own rollback, cancelled by './patch.sh confirm'")
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,39 @@
+package generator
+
+import (
+	"strings"
+	"text/template"
+)
+
+// funcs are the template functions available to all script templates.
+var funcs = template.FuncMap{
+	"quote":   Quote,
+	"cquote":  cquote,
+	"oneline": oneline,
+	"inc":     func(i int) int { return i + 1 },
+}
+
+// cEscapes escapes the characters that cquote spells out.
+var cEscapes = strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+// Quote wraps a string in single quotes so bash takes it literally, whatever characters it contains.
+func Quote(in string) string {
+	return "'" + strings.ReplaceAll(in, "'", `'\''`) + "'"
+}
+
+// cquote wraps a string in bash ANSI-C quotes, $'...', with tabs and newlines escaped. The scripts
+// are rendered with all tabs stripped, so values whose tabs matter are written with cquote.
+func cquote(in string) string {
+	return "$'" + cEscapes.Replace(in) + "'"
+}
+
+// oneline shortens a possibly multi-line command to its first non-empty line for log messages.
+func oneline(in string) string {
+	lines := strings.Split(strings.Trim(in, "\n "), "\n")
+	line := strings.Trim(lines[0], " ")
+	if len(lines) > 1 {
+		line += " ..."
+	}
+
+	return line
+}
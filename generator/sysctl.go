@@ -0,0 +1,64 @@
+package generator
+
+import (
+	"strings"
+
+	"patchfiles/parser"
+)
+
+// SysctlRecord returns the file a sysctl kind patch records the runtime values it replaced in, next
+// to the target. Every line is "key=value" as read from /proc/sys before the first apply.
+func SysctlRecord(p *parser.Result) string {
+	return p.Patch.Output + "." + p.Name + ".sysctlpatchfile"
+}
+
+// sysctlCommands returns the commands that set the parameters of a sysctl kind patch at runtime and
+// set them back. The file itself is the patch target. After writing it every parameter the running
+// kernel has in /proc/sys is recorded with its current value, unless recorded by an earlier run, and
+// set with sysctl -w; missing ones are skipped with a warning instead of failing like sysctl -p.
+// After restoring the file the recorded values are set back and the record is removed. The commands
+// are plain bash, so the native apply runs them as they are.
+func sysctlCommands(p *parser.Result) (after, revertAfter []string) {
+	if p.Patch.Kind != "sysctl" || len(p.Patch.Sysctl) == 0 {
+		return
+	}
+
+	record := "\"" + rootPrefix + SysctlRecord(p) + "\""
+
+	settings := make([]string, 0, len(p.Patch.Sysctl))
+	for _, key := range p.Patch.Sysctl {
+		settings = append(settings, shellWord(p, key.Key+"="+key.Value))
+	}
+
+	after = append(after, strings.Join([]string{
+		"( # set the parameters at runtime, recording the values they replace",
+		"rc=0",
+		"for setting in \\\n  " + strings.Join(settings, " \\\n  ") + "; do",
+		"  key=\"${setting%%=*}\"",
+		"  if [[ \"$key\" == */* ]]; then file=\"$key\"; else file=\"${key//.//}\"; fi",
+		"  file=\"" + rootPrefix + "/proc/sys/$file\"",
+		"  if [ ! -f \"$file\" ]; then",
+		"    echo \"Warning: the running kernel has no sysctl '$key', skipped\"",
+		"    continue",
+		"  fi",
+		"  cut -d= -f1 " + record + " 2>/dev/null | grep -qxF \"$key\" || echo \"$key=$(cat \"$file\")\" >> " + record,
+		"  sysctl -w \"$setting\" || rc=1",
+		"done",
+		"exit $rc",
+		")",
+	}, "\n"))
+
+	revertAfter = append(revertAfter, strings.Join([]string{
+		"( # set the recorded parameters back",
+		"test -f " + record + " || exit 0",
+		"rc=0",
+		"while IFS= read -r setting; do",
+		"  sysctl -w \"$setting\" || rc=1",
+		"done < " + record,
+		"[ \"$rc\" -eq 0 ] && rm -f " + record,
+		"exit $rc",
+		")",
+	}, "\n"))
+
+	return
+}
@@ -0,0 +1,47 @@
+package generator
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"patchfiles/parser"
+)
+
+// unitCommands returns the commands that install and remove the unit of a systemd kind patch. The
+// unit file itself is the patch target. After writing it the timer is installed, systemd is reloaded
+// and the unit, or its timer, is enabled and started. Before reverting the units are disabled and
+// stopped, only when the backup of the patch shows it was installed, as disabling a unit that is not
+// loaded fails. After restoring the unit file the timer is removed and systemd is reloaded.
+func unitCommands(p *parser.Result) (after, revertBefore, revertAfter []string) {
+	unit := p.Patch.Unit
+	if p.Patch.Kind != "systemd" || unit == nil {
+		return
+	}
+
+	units := []string{unit.Name}
+	active := unit.Name
+	if unit.Timer != "" {
+		timer := rootPrefix + unit.TimerPath()
+		// base64 like the payloads, the scripts strip tabs from everything else
+		payload := base64.StdEncoding.EncodeToString([]byte(unit.Timer))
+		after = append(after, "echo '"+payload+"' | base64 -d - > \""+timer+"\"")
+		revertAfter = append(revertAfter, "rm -f \""+timer+"\"")
+
+		units = append([]string{unit.TimerName()}, units...)
+		active = unit.TimerName()
+	}
+
+	after = append(after, "systemctl daemon-reload")
+	if unit.Enable {
+		after = append(after, "systemctl enable "+active)
+	}
+	if unit.Start {
+		after = append(after, "systemctl restart "+active)
+	}
+
+	target := rootPrefix + p.Patch.Output
+	revertBefore = append(revertBefore, "if test -e \""+target+".oldpatchfile\" || test -e \""+target+".newpatchfile\"; then systemctl disable --now "+strings.Join(units, " ")+"; fi")
+	revertAfter = append(revertAfter, "systemctl daemon-reload")
+
+	return
+}
@@ -0,0 +1,116 @@
+package generator
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+
+	"patchfiles/parser"
+)
+
+var (
+	// shellKeywords precede a command on the same line, e.g. "then systemctl restart sshd".
+	shellKeywords = []string{"!", "if", "then", "elif", "else", "while", "until", "do", "time", "{", "}"}
+	// shellSkipped are keywords and builtins whose line or segment calls no external command.
+	shellSkipped = []string{
+		"fi", "done", "esac", "for", "case", "in", "function", "[", "[[", "]]", "test",
+		"echo", "printf", "read", "local", "export", "declare", "set", "unset", "cd", "source", ".",
+		"true", "false", ":", "exit", "return", "break", "continue", "shift", "eval", "exec", "trap", "wait",
+	}
+	// hereDoc matches the start of a here-document and captures its delimiter.
+	hereDoc = regexp.MustCompile(`<<-?\s*['"]?([A-Za-z_][A-Za-z0-9_]*)['"]?`)
+	// commandSeparators split a line into simple commands.
+	commandSeparators = strings.NewReplacer("&&", ";", "||", ";", "|", ";", "$(", ";", "`", ";", "(", ";", ")", ";", "&", ";")
+	// assignment matches a variable assignment in front of or instead of a command.
+	assignment = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+)
+
+// Tools returns the external commands that shell commands call, sorted and without duplicates.
+// It takes the first word of every simple command, skipping comments, here-document bodies,
+// variable assignments, shell keywords and builtins. The result is used by the preflight check
+// of the generated scripts, so it errs on the side of fewer tools.
+func Tools(commands []string) (tools []string) {
+	for _, command := range commands {
+		delimiter := ""
+		for _, line := range strings.Split(command, "\n") {
+			line = strings.Trim(line, " \t")
+
+			if delimiter != "" {
+				if line == delimiter {
+					delimiter = ""
+				}
+				continue
+			}
+			if match := hereDoc.FindStringSubmatch(line); match != nil {
+				delimiter = match[1]
+			}
+
+			if strings.HasPrefix(line, "#") {
+				continue
+			}
+			line, _, _ = strings.Cut(line, " #")
+
+			for _, segment := range strings.Split(commandSeparators.Replace(line), ";") {
+				tool := firstCommand(strings.Fields(segment))
+				if tool != "" && !slices.Contains(tools, tool) {
+					tools = append(tools, tool)
+				}
+			}
+		}
+	}
+
+	slices.Sort(tools)
+	return
+}
+
+// firstCommand returns the command name of a simple command split into words, or an empty string.
+func firstCommand(words []string) string {
+	for len(words) > 0 && (slices.Contains(shellKeywords, words[0]) || assignment.MatchString(words[0])) {
+		words = words[1:]
+	}
+	if len(words) == 0 {
+		return ""
+	}
+
+	word := words[0]
+	if slices.Contains(shellSkipped, word) || strings.ContainsAny(word[:1], `$"'<>-0123456789`) {
+		return ""
+	}
+
+	return word
+}
+
+// tools returns the space separated external commands a patch needs in the patch or revert
+// script: those called by the given commands, e.g. the commands and assertions of the patch, and by
+// the handlers it notifies, patch(1) in diff and lines mode, diff(1) to record the change of lines
+// mode, python3 for the merge helper of merge mode and awk for values.
+func tools(p *parser.Result, revert bool, commands ...[]string) string {
+	list := Tools(slices.Concat(append(commands, handlerCommands(p))...))
+
+	var needs []string
+	switch p.Patch.Mode {
+	case "diff":
+		needs = []string{"patch"}
+	case "lines":
+		needs = []string{"patch"}
+		if !revert {
+			needs = append(needs, "diff")
+		}
+	case "merge":
+		if !revert {
+			needs = []string{"python3"}
+		}
+	}
+	// the facts and placeholders of values are read with awk
+	if len(p.Patch.Values) > 0 && !revert {
+		needs = append(needs, "awk")
+	}
+	for _, tool := range needs {
+		if !slices.Contains(list, tool) {
+			list = append(list, tool)
+		}
+	}
+	slices.Sort(list)
+
+	return strings.Join(list, " ")
+}
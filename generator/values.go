@@ -0,0 +1,153 @@
+package generator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"patchfiles/parser"
+	"patchfiles/values"
+)
+
+// valueFunctions are the bash functions that read the host facts and compute values. The patch
+// script defines them in its header, ComputeValues runs them for the native apply.
+const valueFunctions = `
+	# pf_facts reads the host facts values are computed from into PF_FACT_<name>, once per run.
+	# They are read below PATCHFILES_ROOT, so a fake root can describe any host.
+	function pf_facts() {
+		local dev speed
+
+		[[ -n "$PF_FACT_cpus" ]] && return 0
+
+		PF_FACT_mem_kb=$(awk '$1 == "MemTotal:" { print $2 }' "${PATCHFILES_ROOT}/proc/meminfo" 2>/dev/null)
+		[[ "$PF_FACT_mem_kb" =~ ^[0-9]+$ ]] || PF_FACT_mem_kb=0
+		PF_FACT_mem_mb=$(( PF_FACT_mem_kb / 1024 ))
+		PF_FACT_mem_gb=$(( (PF_FACT_mem_kb + 1048575) / 1048576 ))
+		[[ "$PF_FACT_mem_gb" -ge 1 ]] || PF_FACT_mem_gb=1
+
+		PF_FACT_cpus=$(grep -c '^processor' "${PATCHFILES_ROOT}/proc/cpuinfo" 2>/dev/null)
+		[[ "$PF_FACT_cpus" =~ ^[0-9]+$ && "$PF_FACT_cpus" -ge 1 ]] || PF_FACT_cpus=1
+
+		# only physical interfaces and disks have a device, the speed of a down interface is unknown
+		PF_FACT_nic_speed=0
+		for dev in "${PATCHFILES_ROOT}"/sys/class/net/*; do
+			[[ -e "$dev/device" ]] || continue
+			speed=$(cat "$dev/speed" 2>/dev/null)
+			if [[ "$speed" =~ ^[0-9]+$ ]] && [[ "$speed" -gt "$PF_FACT_nic_speed" ]]; then
+				PF_FACT_nic_speed=$speed
+			fi
+		done
+
+		PF_FACT_disk_rotational=0
+		PF_FACT_disk_nvme=0
+		for dev in "${PATCHFILES_ROOT}"/sys/block/*; do
+			[[ -e "$dev/device" ]] || continue
+			case "${dev##*/}" in
+				sr*|fd*) continue ;;
+				nvme*) PF_FACT_disk_nvme=1 ;;
+			esac
+			if [[ "$(cat "$dev/queue/rotational" 2>/dev/null)" == "1" ]]; then
+				PF_FACT_disk_rotational=1
+			fi
+		done
+
+		return 0
+	}
+
+	# pf_calc prints the value of a bash arithmetic expression, raised to the minimum and lowered
+	# to the maximum when they are given. An invalid expression, e.g. a division by zero, fails.
+	function pf_calc() {
+		local value
+		value=$(( $1 )) || return 1
+		if [[ -n "$2" ]] && (( value < ($2) )); then value=$(( $2 )); fi
+		if [[ -n "$3" ]] && (( value > ($3) )); then value=$(( $3 )); fi
+		echo "$value"
+	}
+`
+
+// valuesFunction returns the bash function pf_values_<name> that computes the values of a patch
+// in order into PF_VALUE_<name>, failing on the first one that cannot be computed.
+func valuesFunction(p *parser.Result) string {
+	lines := []string{
+		fmt.Sprintf("# pf_values_%s computes the values of '%s' from the host facts", p.Name, p.Name),
+		fmt.Sprintf("function pf_values_%s() {", p.Name),
+		"pf_facts",
+	}
+
+	names := make([]string, 0, len(p.Patch.Values))
+	for _, v := range p.Patch.Values {
+		min, max := "", ""
+		if v.Min != "" {
+			min = values.Compile(v.Min)
+		}
+		if v.Max != "" {
+			max = values.Compile(v.Max)
+		}
+		lines = append(lines, fmt.Sprintf("%s=$(pf_calc %s %s %s) || return 1", values.Variable(v.Name), Quote(values.Compile(v.Expr)), Quote(min), Quote(max)))
+		names = append(names, values.Variable(v.Name))
+	}
+
+	lines = append(lines, "export "+strings.Join(names, " "), "}")
+
+	return strings.Join(lines, "\n")
+}
+
+// ComputeValues computes the values of a patch on this host, with the facts read below root, by
+// running the same bash functions as the patch script. It returns the values by name.
+func ComputeValues(ctx context.Context, p *parser.Result, root string) (map[string]string, error) {
+	result := make(map[string]string)
+	if len(p.Patch.Values) == 0 {
+		return result, nil
+	}
+
+	script := []string{valueFunctions, valuesFunction(p), "pf_values_" + p.Name + " || exit 1"}
+	for _, v := range p.Patch.Values {
+		script = append(script, fmt.Sprintf("echo \"%s=$%s\"", v.Name, values.Variable(v.Name)))
+	}
+
+	stderr := new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, "bash", "-c", strings.Join(script, "\n"))
+	cmd.Env = append(os.Environ(), "PATCHFILES_ROOT="+strings.TrimSuffix(root, "/"))
+	cmd.Stderr = stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("cannot compute the values: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		name, value, _ := strings.Cut(line, "=")
+		result[name] = value
+	}
+
+	return result, nil
+}
+
+// ValuesEnv returns the values as PF_VALUE_<name>=<value> environment variables, which the
+// commands of a patch see like in the patch script.
+func ValuesEnv(p *parser.Result, computed map[string]string) (env []string) {
+	for _, v := range p.Patch.Values {
+		env = append(env, values.Variable(v.Name)+"="+computed[v.Name])
+	}
+
+	return
+}
+
+// shellWord returns a string as a single quoted bash word, with the placeholders of the patch's
+// values expanded from their PF_VALUE_<name> variables, e.g. 'fs.file-max='"${PF_VALUE_file_max}".
+func shellWord(p *parser.Result, s string) string {
+	word := Quote(s)
+	for _, v := range p.Patch.Values {
+		word = strings.ReplaceAll(word, "%{"+v.Name+"}", `'"${`+values.Variable(v.Name)+`}"'`)
+	}
+
+	// drop the empty quotes a placeholder at either end leaves behind
+	if trimmed := strings.TrimSuffix(strings.TrimPrefix(word, "''"), "''"); trimmed != "" {
+		word = trimmed
+	}
+
+	return word
+}
@@ -0,0 +1,36 @@
+package generator
+
+import (
+	"fmt"
+	"strings"
+
+	"patchfiles/parser"
+)
+
+// AssertionProblem returns why an assertion failed, like pf_verified of the patch script, or an
+// empty string when it passed. Output is what the command printed to stdout, code its exit code.
+func AssertionProblem(assertion parser.Assertion, code int, output string) string {
+	// command substitution in bash drops the trailing newlines
+	output = strings.TrimRight(output, "\n")
+
+	switch {
+	case code != 0:
+		return fmt.Sprintf("exited with %d", code)
+	case assertion.Equals != "" && output != assertion.Equals:
+		return fmt.Sprintf("printed '%s', want '%s'", output, assertion.Equals)
+	case assertion.Contains != "" && !strings.Contains(output, assertion.Contains):
+		return fmt.Sprintf("printed '%s', want it to contain '%s'", output, assertion.Contains)
+	}
+
+	return ""
+}
+
+// verifyCommands returns the commands of the assertions of a patch, so the preflight check covers
+// their tools.
+func verifyCommands(p *parser.Result) (commands []string) {
+	for _, assertion := range p.Patch.Verify {
+		commands = append(commands, assertion.Command)
+	}
+
+	return
+}
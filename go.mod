@@ -4,7 +4,12 @@ go 1.25.5
 
 require (
 	go.uber.org/zap v1.27.1
+	golang.org/x/crypto v0.44.0
 	gopkg.in/yaml.v2 v2.4.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-require go.uber.org/multierr v1.11.0 // indirect
+require (
+	go.uber.org/multierr v1.11.0 // indirect
+	golang.org/x/sys v0.38.0 // indirect
+)
@@ -0,0 +1,216 @@
+// Package sshtest provides an in-process SSH server for tests. It runs exec requests with the
+// local bash, so scripts streamed to it behave like on a real host.
+package sshtest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Server is an SSH server listening on a local port that accepts a single client key.
+type Server struct {
+	Addr     string   // Address with port the server listens on
+	Identity string   // File with the private key accepted by the server
+	Env      []string // Environment of the commands the server runs, os.Environ() when nil
+
+	mu          sync.Mutex
+	sessions    int      // Number of sessions running now
+	maxSessions int      // Highest number of sessions running at the same time
+	users       []string // Users that logged in
+	listener    net.Listener
+	config      *ssh.ServerConfig
+}
+
+// New starts a server that is closed when the test ends.
+func New(t *testing.T) *Server {
+	t.Helper()
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientPublic, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorized, err := ssh.NewPublicKey(clientPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := ssh.MarshalPrivateKey(clientKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := filepath.Join(t.TempDir(), "id_ed25519")
+	err = os.WriteFile(identity, pem.EncodeToMemory(block), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		Addr:     listener.Addr().String(),
+		Identity: identity,
+		listener: listener,
+	}
+	s.config = &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(authorized.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+
+			s.mu.Lock()
+			s.users = append(s.users, meta.User())
+			s.mu.Unlock()
+
+			return nil, nil
+		},
+	}
+	s.config.AddHostKey(hostSigner)
+
+	go s.serve()
+	t.Cleanup(func() {
+		listener.Close()
+	})
+
+	return s
+}
+
+// MaxSessions returns the highest number of sessions that ran at the same time.
+func (s *Server) MaxSessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.maxSessions
+}
+
+// Users returns the users that logged in, in order.
+func (s *Server) Users() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.users...)
+}
+
+// serve accepts connections until the listener is closed.
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.handle(conn)
+	}
+}
+
+// handle runs the SSH handshake and serves the session channels of a connection.
+func (s *Server) handle(conn net.Conn) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go s.session(channel, requests)
+	}
+}
+
+// session runs the command of the first exec request with bash and reports its exit status.
+func (s *Server) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	for req := range requests {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+
+		var payload struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			req.Reply(false, nil)
+			return
+		}
+		req.Reply(true, nil)
+
+		s.mu.Lock()
+		s.sessions++
+		s.maxSessions = max(s.maxSessions, s.sessions)
+		s.mu.Unlock()
+
+		code := s.exec(channel, payload.Command)
+
+		s.mu.Lock()
+		s.sessions--
+		s.mu.Unlock()
+
+		status := make([]byte, 4)
+		binary.BigEndian.PutUint32(status, uint32(code))
+		channel.SendRequest("exit-status", false, status)
+		return
+	}
+}
+
+// exec runs a command with the channel as stdin, stdout and stderr and returns its exit code.
+func (s *Server) exec(channel ssh.Channel, command string) int {
+	cmd := exec.Command("bash", "-c", command)
+	cmd.Env = s.Env
+	cmd.Stdout = channel
+	cmd.Stderr = channel.Stderr()
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return 255
+	}
+	if err := cmd.Start(); err != nil {
+		return 255
+	}
+	go func() {
+		io.Copy(stdin, channel)
+		stdin.Close()
+	}()
+
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		return 255
+	}
+
+	return 0
+}
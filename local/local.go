@@ -0,0 +1,772 @@
+// Package local applies and reverts patches on this host natively, with the same semantics as the
+// generated scripts: backups before overwriting, marked blocks when appending, commands run before
+// and after each patch, the handlers they notify, the assertions of the patches and the control
+// file that tracks whether the system has been patched.
+package local
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"patchfiles/generator"
+	"patchfiles/merge"
+	"patchfiles/parser"
+	"patchfiles/textdiff"
+	"patchfiles/values"
+
+	"go.uber.org/zap"
+)
+
+// Decision is what happened to a patch.
+type Decision string
+
+const (
+	// Applied means the patch was written.
+	Applied Decision = "applied"
+	// Reverted means the patch was undone.
+	Reverted Decision = "reverted"
+	// SkippedAlreadyPatched means the target already carries the patch or its backup exists.
+	SkippedAlreadyPatched Decision = "skipped-already-patched"
+	// SkippedNotPatched means revert found neither the patch nor its backup, so nothing was undone.
+	SkippedNotPatched Decision = "skipped-not-patched"
+	// Failed means writing or reverting the target failed.
+	Failed Decision = "failed"
+)
+
+var (
+	// ErrAlreadyPatched is returned by Apply when the control file exists.
+	ErrAlreadyPatched = errors.New("system already patched")
+	// ErrNotPatched is returned by Revert when the control file does not exist.
+	ErrNotPatched = errors.New("system is not patched")
+	// ErrLocked is returned by Apply and Revert when another run holds the lock file.
+	ErrLocked = errors.New("another run holds the lock")
+	// errNothingToRevert is returned by the revert helpers when the target does not carry the patch.
+	errNothingToRevert = errors.New("nothing to revert")
+	// ErrInterrupted is returned by Apply and Revert when a script run was interrupted, the script
+	// that started it resumes or reverts it.
+	ErrInterrupted = errors.New("a run was interrupted, resume it with the script that started it")
+)
+
+// CommandResult is the outcome of a command run before or after applying or reverting a patch.
+type CommandResult struct {
+	Command  string `json:"command" yaml:"command"`   // Command as written in the patch
+	ExitCode int    `json:"exitCode" yaml:"exitCode"` // Exit code, -1 when it could not be started
+	Output   string `json:"output" yaml:"output"`     // Combined stdout and stderr
+}
+
+// AssertionResult is the outcome of an assertion run after applying all patches.
+type AssertionResult struct {
+	Assertion string `json:"assertion" yaml:"assertion"`                 // Assertion in one line, e.g. "sysctl -n vm.swappiness == 1"
+	Problem   string `json:"problem,omitempty" yaml:"problem,omitempty"` // Why the assertion failed, empty when it passed
+}
+
+// Result is the outcome of applying or reverting a single patch.
+type Result struct {
+	Name     string            `json:"name" yaml:"name"`                         // Full name of the patch
+	Target   string            `json:"target" yaml:"target"`                     // Target file including the root
+	Decision Decision          `json:"decision" yaml:"decision"`                 // What happened to the patch
+	Reason   string            `json:"reason,omitempty" yaml:"reason,omitempty"` // Why the patch was skipped or failed
+	Commands []CommandResult   `json:"commands" yaml:"commands"`                 // Commands run before and after the patch
+	Verify   []AssertionResult `json:"verify,omitempty" yaml:"verify,omitempty"` // Assertions run after all patches and handlers
+}
+
+// CommandsFailed returns the number of commands that exited with a non-zero code.
+func (r *Result) CommandsFailed() (n int) {
+	for _, c := range r.Commands {
+		if c.ExitCode != 0 {
+			n++
+		}
+	}
+
+	return
+}
+
+// VerifyFailed returns the number of assertions that failed.
+func (r *Result) VerifyFailed() (n int) {
+	for _, a := range r.Verify {
+		if a.Problem != "" {
+			n++
+		}
+	}
+
+	return
+}
+
+// Patcher applies and reverts patches below a root directory.
+type Patcher struct {
+	Log  *zap.Logger // Logger instance for logging operations
+	Root string      // Root filesystem prefixed to every path, "/" when empty
+
+	// Stdout and Stderr receive the output of commands as they run, discarded when nil
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Apply applies the patches in order and runs the assertions of those that did not fail after the
+// handlers. It returns ErrAlreadyPatched without touching anything when the control file exists,
+// and creates the control file when no patch failed, even when an assertion failed. Like the
+// scripts, it holds the lock file while it runs.
+func (patcher *Patcher) Apply(ctx context.Context, patches []*parser.Result) (results []Result, err error) {
+	unlock, err := patcher.lock("apply")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	control := patcher.path(generator.ControlFile)
+	if _, err = os.Stat(control); err == nil {
+		return nil, ErrAlreadyPatched
+	}
+
+	failed := false
+	for _, p := range patches {
+		result := patcher.apply(ctx, p)
+		if result.Decision == Failed {
+			failed = true
+		}
+		results = append(results, result)
+	}
+	patcher.notify(ctx, patches, results, Applied)
+	patcher.verify(ctx, patches, results)
+
+	if failed {
+		return results, nil
+	}
+
+	err = os.WriteFile(control, []byte("1\n"), 0o644)
+	return
+}
+
+// Revert reverts the patches in order. It returns ErrNotPatched without touching anything when the
+// control file does not exist, and removes the control file when no patch failed.
+func (patcher *Patcher) Revert(ctx context.Context, patches []*parser.Result) (results []Result, err error) {
+	unlock, err := patcher.lock("revert")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	control := patcher.path(generator.ControlFile)
+	if _, err = os.Stat(control); err != nil {
+		return nil, ErrNotPatched
+	}
+
+	failed := false
+	for _, p := range patches {
+		result := patcher.revert(ctx, p)
+		if result.Decision == Failed {
+			failed = true
+		}
+		results = append(results, result)
+	}
+	patcher.notify(ctx, patches, results, Reverted)
+
+	if failed {
+		return results, nil
+	}
+
+	err = os.Remove(control)
+	return
+}
+
+// notify runs the handlers notified by the patches that were done, once each and in order, after
+// all patches, like the footer of the scripts. The result of a handler is added to the commands of
+// every patch that notified it.
+func (patcher *Patcher) notify(ctx context.Context, patches []*parser.Result, results []Result, done Decision) {
+	var notifying []*parser.Result
+	for i, p := range patches {
+		if results[i].Decision == done {
+			notifying = append(notifying, p)
+		}
+	}
+
+	for _, handler := range generator.Handlers(notifying) {
+		commands := patcher.run(ctx, []string{handler.Command}, false)
+		for i, p := range patches {
+			if results[i].Decision == done && slices.Contains(p.Patch.Notify, handler.Name) {
+				results[i].Commands = append(results[i].Commands, commands...)
+			}
+		}
+	}
+}
+
+// verify runs the assertions of the patches that did not fail, like pf_verify_<name> of the patch
+// script. Only stdout of a command is compared, stderr goes to the Stderr of the patcher.
+func (patcher *Patcher) verify(ctx context.Context, patches []*parser.Result, results []Result) {
+	for i, p := range patches {
+		if results[i].Decision == Failed {
+			continue
+		}
+
+		for _, assertion := range p.Patch.Verify {
+			output := new(bytes.Buffer)
+
+			cmd := exec.CommandContext(ctx, "bash", "-c", assertion.Command)
+			cmd.Env = append(os.Environ(), "PATCHFILES_ROOT="+strings.TrimSuffix(patcher.root(), "/"))
+			cmd.Stdout = output
+			cmd.Stderr = writers(io.Discard, patcher.Stderr)
+
+			code := 0
+			err := cmd.Run()
+			var exitErr *exec.ExitError
+			switch {
+			case err == nil:
+			case errors.As(err, &exitErr):
+				code = exitErr.ExitCode()
+			default:
+				code = -1
+			}
+
+			result := AssertionResult{
+				Assertion: assertion.String(),
+				Problem:   generator.AssertionProblem(assertion, code, output.String()),
+			}
+			patcher.Log.Debug("assertion is done",
+				zap.String("patch", p.Name),
+				zap.String("assertion", result.Assertion),
+				zap.String("problem", result.Problem),
+			)
+			results[i].Verify = append(results[i].Verify, result)
+		}
+	}
+}
+
+// apply writes a single patch like the patch script: append mode adds the marked block unless a
+// block of the patch exists, diff mode applies the diff unless it applies in reverse, overwrite
+// mode takes a backup unless one exists and writes the body.
+func (patcher *Patcher) apply(ctx context.Context, p *parser.Result) (result Result) {
+	logger := patcher.Log.WithOptions(zap.Fields(
+		zap.String("name", p.Name),
+	))
+
+	target := patcher.path(p.Patch.Output)
+	result = Result{
+		Name:     p.Name,
+		Target:   target,
+		Commands: make([]CommandResult, 0),
+	}
+
+	defer func() {
+		logger.Info("patch is done",
+			zap.String("decision", string(result.Decision)),
+			zap.String("reason", result.Reason),
+		)
+	}()
+
+	// values are computed first, like in the patch script
+	computed, err := generator.ComputeValues(ctx, p, patcher.root())
+	if err != nil {
+		result.Decision, result.Reason = Failed, "values: "+err.Error()
+		return
+	}
+	env := generator.ValuesEnv(p, computed)
+
+	skip, reason, err := patcher.patched(p, target)
+	if err != nil {
+		result.Decision, result.Reason = Failed, err.Error()
+		return
+	}
+	if skip {
+		result.Decision, result.Reason = SkippedAlreadyPatched, reason
+		return
+	}
+
+	resolved := generator.Resolve(p)
+	result.Commands = patcher.run(ctx, resolved.CommandsBefore, true, env...)
+	if result.CommandsFailed() > 0 {
+		result.Decision, result.Reason = Failed, "commands-before"
+		return
+	}
+
+	payload := values.Render(generator.Payload(p), computed)
+	err = os.MkdirAll(filepath.Dir(target), 0o755)
+	if err == nil {
+		switch p.Patch.Mode {
+		case "append":
+			err = appendBlock(target, payload)
+		case "diff":
+			err = applyDiff(target, p.Patch.Body, textdiff.Apply)
+		case "lines":
+			err = applyLines(p, target, patcher.path(generator.LinesRecord(p)))
+		case "merge":
+			err = applyMerge(p, target)
+		default:
+			err = takeBackup(target)
+			if err == nil {
+				err = writeFile(target, payload)
+			}
+		}
+	}
+	if err != nil {
+		result.Decision, result.Reason = Failed, err.Error()
+		return
+	}
+
+	result.Decision = Applied
+	result.Commands = append(result.Commands, patcher.run(ctx, resolved.CommandsAfter, false, env...)...)
+
+	return
+}
+
+// patched reports whether a patch must be skipped because the target already carries it.
+func (patcher *Patcher) patched(p *parser.Result, target string) (bool, string, error) {
+	if p.Patch.Mode == "diff" {
+		current, err := os.ReadFile(target)
+		if err != nil {
+			return false, "", err
+		}
+		if _, err := textdiff.Revert(string(current), p.Patch.Body); err == nil {
+			return true, "diff applies in reverse", nil
+		}
+
+		return false, "", nil
+	}
+
+	if p.Patch.Mode == "lines" {
+		record := patcher.path(generator.LinesRecord(p))
+		if _, err := os.Stat(record); err == nil {
+			return true, "record " + record + " exists", nil
+		}
+
+		current, err := os.ReadFile(target)
+		if err != nil {
+			return false, "", err
+		}
+		patched, err := generator.EditLines(p, string(current))
+		if err != nil {
+			return false, "", err
+		}
+		if patched == string(current) {
+			return true, "compliant", nil
+		}
+
+		return false, "", nil
+	}
+
+	if p.Patch.Mode != "append" {
+		for _, suffix := range []string{".oldpatchfile", ".newpatchfile"} {
+			if _, err := os.Stat(target + suffix); err == nil {
+				return true, "backup " + target + suffix + " exists", nil
+			}
+		}
+
+		if p.Patch.Mode == "merge" {
+			return mergedAlready(p, target)
+		}
+
+		return false, "", nil
+	}
+
+	current, err := os.ReadFile(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+
+	start, prefix, _ := generator.BlockMarkers(p)
+	for _, line := range strings.Split(string(current), "\n") {
+		if line == start {
+			return true, "block exists", nil
+		}
+		if strings.Contains(line, prefix) {
+			return true, "block of a different version exists, reapply to update it", nil
+		}
+	}
+
+	return false, "", nil
+}
+
+// revert undoes a single patch like the revert script: append mode removes the patch's block,
+// diff mode applies the diff in reverse, lines mode applies the recorded change in reverse, overwrite mode restores the backup or removes a target
+// that did not exist before.
+func (patcher *Patcher) revert(ctx context.Context, p *parser.Result) (result Result) {
+	logger := patcher.Log.WithOptions(zap.Fields(
+		zap.String("name", p.Name),
+	))
+
+	target := patcher.path(p.Patch.Output)
+	result = Result{
+		Name:     p.Name,
+		Target:   target,
+		Commands: make([]CommandResult, 0),
+	}
+
+	defer func() {
+		logger.Info("revert is done",
+			zap.String("decision", string(result.Decision)),
+			zap.String("reason", result.Reason),
+		)
+	}()
+
+	resolved := generator.Resolve(p)
+	result.Commands = patcher.run(ctx, resolved.RevertBefore, true)
+	if result.CommandsFailed() > 0 {
+		result.Decision, result.Reason = Failed, "commands-before"
+		return
+	}
+
+	var err error
+	switch p.Patch.Mode {
+	case "append":
+		err = removeBlock(p, target)
+	case "diff":
+		err = revertDiff(target, p.Patch.Body)
+	case "lines":
+		err = revertLines(target, patcher.path(generator.LinesRecord(p)))
+	default:
+		err = restoreBackup(target)
+	}
+	if errors.Is(err, errNothingToRevert) {
+		// like the scripts, the commands after and the handlers are left out
+		result.Decision = SkippedNotPatched
+		return
+	}
+	if err != nil {
+		result.Decision, result.Reason = Failed, err.Error()
+		return
+	}
+
+	result.Decision = Reverted
+	result.Commands = append(result.Commands, patcher.run(ctx, resolved.RevertAfter, false)...)
+
+	return
+}
+
+// run runs commands with bash, with PATCHFILES_ROOT and env set like in the generated scripts.
+// With stopOnFailure the remaining commands are skipped after the first failure, like the commands
+// before a patch in the scripts.
+func (patcher *Patcher) run(ctx context.Context, commands []string, stopOnFailure bool, env ...string) (results []CommandResult) {
+	results = make([]CommandResult, 0)
+
+	for _, command := range commands {
+		if stopOnFailure && len(results) > 0 && results[len(results)-1].ExitCode != 0 {
+			break
+		}
+
+		output := new(bytes.Buffer)
+
+		cmd := exec.CommandContext(ctx, "bash", "-c", command)
+		cmd.Env = append(os.Environ(), "PATCHFILES_ROOT="+strings.TrimSuffix(patcher.root(), "/"))
+		cmd.Env = append(cmd.Env, env...)
+		cmd.Stdout = writers(output, patcher.Stdout)
+		cmd.Stderr = writers(output, patcher.Stderr)
+
+		result := CommandResult{
+			Command: command,
+		}
+
+		err := cmd.Run()
+		var exitErr *exec.ExitError
+		switch {
+		case err == nil:
+		case errors.As(err, &exitErr):
+			result.ExitCode = exitErr.ExitCode()
+		default:
+			result.ExitCode = -1
+			fmt.Fprintln(output, err)
+		}
+		result.Output = output.String()
+
+		patcher.Log.Debug("command is done",
+			zap.String("command", command),
+			zap.Int("exitCode", result.ExitCode),
+		)
+		results = append(results, result)
+	}
+
+	return
+}
+
+// lock takes the lock file of the scripts without waiting and returns the function releasing it.
+// It returns ErrLocked when another run holds it, and ErrInterrupted when the journal of an
+// interrupted script run exists.
+func (patcher *Patcher) lock(action string) (unlock func(), err error) {
+	fileLoc := patcher.path(generator.LockFile)
+	err = os.MkdirAll(filepath.Dir(fileLoc), 0o755)
+	if err != nil {
+		return
+	}
+
+	fd, err := os.OpenFile(fileLoc, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return
+	}
+
+	err = syscall.Flock(int(fd.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		fd.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			err = ErrLocked
+		}
+		return nil, err
+	}
+
+	if _, statErr := os.Stat(patcher.path(generator.JournalFile)); statErr == nil {
+		fd.Close()
+		return nil, ErrInterrupted
+	}
+
+	fd.Truncate(0)
+	fmt.Fprintf(fd, "pid=%d script=native action=%s\n", os.Getpid(), action)
+
+	return func() { fd.Close() }, nil
+}
+
+// root returns the root filesystem, "/" when empty.
+func (patcher *Patcher) root() string {
+	if patcher.Root == "" {
+		return "/"
+	}
+
+	return patcher.Root
+}
+
+// path returns an absolute path below the root.
+func (patcher *Patcher) path(fileLoc string) string {
+	return filepath.Join(patcher.root(), fileLoc)
+}
+
+// writers returns a writer duplicating to w and, when set, to extra.
+func writers(w io.Writer, extra io.Writer) io.Writer {
+	if extra == nil {
+		return w
+	}
+
+	return io.MultiWriter(w, extra)
+}
+
+// appendBlock appends a block to the target, terminating its last line first, like pf_ensure_newline.
+func appendBlock(target, block string) error {
+	current, err := os.ReadFile(target)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(current) > 0 && !bytes.HasSuffix(current, []byte("\n")) {
+		block = "\n" + block
+	}
+
+	fd, err := os.OpenFile(target, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(fd, block)
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// removeBlock removes the patch's block from the target, keeping blocks of other patches. It returns
+// errNothingToRevert when the target carries no block of the patch.
+func removeBlock(p *parser.Result, target string) error {
+	current, err := os.ReadFile(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return errNothingToRevert
+	}
+	if err != nil {
+		return err
+	}
+
+	_, prefix, end := generator.BlockMarkers(p)
+	if !strings.Contains(string(current), prefix) {
+		return errNothingToRevert
+	}
+	reverted := generator.RemoveBlock(string(current), prefix, end)
+	if reverted == string(current) {
+		return nil
+	}
+
+	return writeFile(target, reverted)
+}
+
+// applyDiff applies a unified diff to the target, or reverts it, like pf_apply_diff and
+// pf_revert_diff: the target is only written when every hunk matches.
+func applyDiff(target, diff string, apply func(text, diff string) (string, error)) error {
+	current, err := os.ReadFile(target)
+	if err != nil {
+		return err
+	}
+
+	patched, err := apply(string(current), diff)
+	if err != nil {
+		return fmt.Errorf("the diff does not apply to %s, the file is left unchanged: %w", target, err)
+	}
+
+	return writeFile(target, patched)
+}
+
+// revertDiff reverts a unified diff applied to the target, like pf_revert_diff. It returns
+// errNothingToRevert when the diff applies forward, the target does not carry it then.
+func revertDiff(target, diff string) error {
+	current, err := os.ReadFile(target)
+	if err != nil {
+		return err
+	}
+
+	_, revertErr := textdiff.Revert(string(current), diff)
+	if _, applyErr := textdiff.Apply(string(current), diff); revertErr != nil && applyErr == nil {
+		return errNothingToRevert
+	}
+
+	return applyDiff(target, diff, textdiff.Revert)
+}
+
+// applyLines applies the rules of a lines mode patch to target, like pf_apply_lines. The change is
+// recorded as a unified diff first, so revertLines can restore the original lines.
+func applyLines(p *parser.Result, target, record string) error {
+	current, err := os.ReadFile(target)
+	if err != nil {
+		return err
+	}
+
+	patched, err := generator.EditLines(p, string(current))
+	if err != nil {
+		return err
+	}
+
+	name := p.Patch.Output
+	err = writeFile(record, textdiff.Unified(name, name, string(current), patched))
+	if err != nil {
+		return err
+	}
+
+	return writeFile(target, patched)
+}
+
+// mergedAlready reports whether merging the fragment of a merge mode patch leaves target unchanged.
+func mergedAlready(p *parser.Result, target string) (bool, string, error) {
+	current, err := os.ReadFile(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+
+	merged, err := merge.Merge(p.Patch.Format, string(current), p.Patch.Body)
+	if err != nil {
+		return false, "", fmt.Errorf("cannot merge into %s: %w", target, err)
+	}
+
+	return merged == string(current), "compliant", nil
+}
+
+// applyMerge merges the fragment of a merge mode patch into target, like pf_apply_merge, after
+// taking a backup. A missing target counts as empty.
+func applyMerge(p *parser.Result, target string) error {
+	current, err := os.ReadFile(target)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	merged, err := merge.Merge(p.Patch.Format, string(current), p.Patch.Body)
+	if err != nil {
+		return fmt.Errorf("cannot merge into %s, the file is left unchanged: %w", target, err)
+	}
+
+	err = takeBackup(target)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(target, merged)
+}
+
+// revertLines applies the change recorded by applyLines in reverse and removes the record, like
+// pf_revert_lines. A target without a record is left unchanged and errNothingToRevert returned.
+func revertLines(target, record string) error {
+	diff, err := os.ReadFile(record)
+	if errors.Is(err, os.ErrNotExist) {
+		return errNothingToRevert
+	}
+	if err != nil {
+		return err
+	}
+
+	err = applyDiff(target, string(diff), textdiff.Revert)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(record)
+}
+
+// writeFile replaces the content of a file in place, keeping the mode and owner of an existing file
+// like a shell redirection does.
+func writeFile(target, content string) error {
+	fd, err := os.OpenFile(target, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(fd, content)
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// takeBackup saves the target before it is overwritten like pf_take_backup: a copy with mode, owner
+// and times as .oldpatchfile, or an empty .newpatchfile marker when the target does not exist.
+func takeBackup(target string) error {
+	info, err := os.Stat(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return writeFile(target+".newpatchfile", "")
+	}
+	if err != nil {
+		return err
+	}
+
+	body, err := os.ReadFile(target)
+	if err != nil {
+		return err
+	}
+
+	backup := target + ".oldpatchfile"
+	err = os.WriteFile(backup, body, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	// os.WriteFile applies the umask, set the exact mode like cp -a
+	err = os.Chmod(backup, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		// only root can give files away, cp -a silently keeps the owner as well
+		os.Lchown(backup, int(stat.Uid), int(stat.Gid))
+	}
+
+	return os.Chtimes(backup, info.ModTime(), info.ModTime())
+}
+
+// restoreBackup puts back the target saved by takeBackup like pf_restore_backup. It returns
+// errNothingToRevert when there is no backup.
+func restoreBackup(target string) error {
+	if _, err := os.Stat(target + ".oldpatchfile"); err == nil {
+		return os.Rename(target+".oldpatchfile", target)
+	}
+
+	if _, err := os.Stat(target + ".newpatchfile"); err == nil {
+		err = os.Remove(target)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return os.Remove(target + ".newpatchfile")
+	}
+
+	return errNothingToRevert
+}
@@ -0,0 +1,442 @@
+package local
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"patchfiles/generator"
+	"patchfiles/parser"
+
+	"go.uber.org/zap"
+)
+
+// originals are the target files that exist on the fake root filesystems before patching,
+// the same as in the script integration tests.
+var originals = map[string]string{
+	"etc/app/app.conf":           "listen = 127.0.0.1:80\n",
+	"etc/app/extra.ini":          "[main]\nname = app",
+	"etc/net.conf":               "tcp_sack = 1\n",
+	"etc/docker/daemon.json":     "{\n  \"log-driver\": \"json-file\",\n  \"log-opts\": {\"max-size\": \"10m\"}\n}\n",
+	"proc/sys/net/ipv4/tcp_sack": "1\n",
+	"proc/sys/net/ipv4/tcp_rmem": "4096\t131072\t6291456\n",
+	// host facts of values: 8000000 kB of memory, 6 CPUs, a 10 Gbit/s NIC and an NVMe disk
+	"proc/meminfo":                       "MemTotal:        8000000 kB\nMemFree:         4000000 kB\n",
+	"proc/cpuinfo":                       "processor\t: 0\nprocessor\t: 1\nprocessor\t: 2\nprocessor\t: 3\nprocessor\t: 4\nprocessor\t: 5\n",
+	"sys/class/net/eth0/device/vendor":   "0x8086\n",
+	"sys/class/net/eth0/speed":           "10000\n",
+	"sys/block/nvme0n1/device/model":     "test\n",
+	"sys/block/nvme0n1/queue/rotational": "0\n",
+	"sys/block/loop0/queue/rotational":   "1\n",
+}
+
+// fixture prepares a fake root with the original files and stubbed system tools logging to stubLog.
+func fixture(t *testing.T) (patches []*parser.Result, root, stubLog string) {
+	t.Helper()
+
+	return fixtureDir(t, "patches")
+}
+
+// fixtureDir is fixture with the patches from another directory of the generator's testdata.
+func fixtureDir(t *testing.T, dir string) (patches []*parser.Result, root, stubLog string) {
+	t.Helper()
+
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not available")
+	}
+
+	patches, errs := parser.LoadDir(zap.NewNop(), os.DirFS("../generator/testdata"), dir)
+	if len(errs) > 0 {
+		t.Fatalf("parsing fixtures: %v", errs[0].Error)
+	}
+
+	root = t.TempDir()
+	for name, body := range originals {
+		write(t, filepath.Join(root, name), body, 0o644)
+	}
+
+	bin := t.TempDir()
+	stubLog = filepath.Join(t.TempDir(), "stub.log")
+	for _, name := range []string{"systemctl", "sysctl", "udevadm"} {
+		write(t, filepath.Join(bin, name), "#!/usr/bin/env bash\necho \"$(basename \"$0\") $*\" >> \""+stubLog+"\"\n", 0o755)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	return
+}
+
+// write creates a file with all parent directories.
+func write(t *testing.T, fileLoc, body string, mode os.FileMode) {
+	t.Helper()
+
+	err := os.MkdirAll(filepath.Dir(fileLoc), 0o755)
+	if err == nil {
+		err = os.WriteFile(fileLoc, []byte(body), mode)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// snapshot returns the content of every file below root keyed by its relative path, without the
+// lock file naming the process of the last run.
+func snapshot(t *testing.T, root string) map[string]string {
+	t.Helper()
+
+	lock := strings.TrimPrefix(generator.LockFile, "/")
+	files := make(map[string]string)
+	filepath.WalkDir(root, func(fileLoc string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			name, _ := filepath.Rel(root, fileLoc)
+			if name == lock {
+				return nil
+			}
+			body, _ := os.ReadFile(fileLoc)
+			files[name] = string(body)
+		}
+		return err
+	})
+
+	return files
+}
+
+// runScript runs a generated script against a root and returns the stub calls it made.
+func runScript(t *testing.T, script []byte, root, stubLog string) string {
+	t.Helper()
+
+	os.Remove(stubLog)
+	cmd := exec.Command("bash", "-s", "all")
+	cmd.Stdin = bytes.NewReader(script)
+	cmd.Env = append(os.Environ(), "PATCHFILES_ROOT="+root, "PATCHFILES_LOG_DIR="+t.TempDir(), "PATCHFILES_ALLOW_NONROOT=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("script failed: %v\n%s", err, out)
+	}
+
+	calls, _ := os.ReadFile(stubLog)
+	return string(calls)
+}
+
+// compare fails the test when two snapshots differ.
+func compare(t *testing.T, step string, native, script map[string]string) {
+	t.Helper()
+
+	for name, body := range script {
+		if native[name] != body {
+			t.Errorf("%s: %s differs:\nnative:\n%q\nscript:\n%q", step, name, native[name], body)
+		}
+	}
+	for name := range native {
+		if _, ok := script[name]; !ok {
+			t.Errorf("%s: native left %s the script does not", step, name)
+		}
+	}
+}
+
+func TestMatchesScripts(t *testing.T) {
+	for _, dir := range []string{"patches", "units", "diffs", "lines", "merge", "sysctl", "values", "handlers"} {
+		t.Run(dir, func(t *testing.T) {
+			matchesScripts(t, dir)
+		})
+	}
+}
+
+// matchesScripts applies and reverts the patches of a fixture directory natively and with the
+// scripts, and compares the files and the commands run.
+func matchesScripts(t *testing.T, dir string) {
+	if dir == "diffs" || dir == "lines" {
+		if _, err := exec.LookPath("patch"); err != nil {
+			t.Skip("patch is not available")
+		}
+	}
+	if dir == "merge" && exec.Command("python3", "-c", "import yaml").Run() != nil {
+		t.Skip("python3 with the yaml module is not available")
+	}
+	patches, scriptRoot, stubLog := fixtureDir(t, dir)
+
+	nativeRoot := t.TempDir()
+	for name, body := range originals {
+		write(t, filepath.Join(nativeRoot, name), body, 0o644)
+	}
+
+	gen := generator.Generator{
+		Log:         zap.NewNop(),
+		Environment: "test",
+	}
+	patchScript, revertScript, err := gen.Render(patches)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scriptCalls := runScript(t, patchScript, scriptRoot, stubLog)
+
+	os.Remove(stubLog)
+	patcher := Patcher{
+		Log:  zap.NewNop(),
+		Root: nativeRoot,
+	}
+	results, err := patcher.Apply(t.Context(), patches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nativeCalls, _ := os.ReadFile(stubLog)
+
+	for _, r := range results {
+		if r.Decision != Applied || r.CommandsFailed() > 0 {
+			t.Errorf("%s: %+v", r.Name, r)
+		}
+	}
+	compare(t, "apply", snapshot(t, nativeRoot), snapshot(t, scriptRoot))
+	if string(nativeCalls) != scriptCalls {
+		t.Errorf("commands of apply:\nnative:\n%s\nscript:\n%s", nativeCalls, scriptCalls)
+	}
+
+	if dir == "patches" {
+		info, _ := os.Stat(filepath.Join(nativeRoot, "etc/app/app.conf.oldpatchfile"))
+		if info == nil || info.Mode().Perm() != 0o644 {
+			t.Errorf("backup mode is not kept: %v", info)
+		}
+	}
+
+	scriptCalls = runScript(t, revertScript, scriptRoot, stubLog)
+	os.Remove(stubLog)
+	results, err = patcher.Revert(t.Context(), patches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nativeCalls, _ = os.ReadFile(stubLog)
+	if string(nativeCalls) != scriptCalls {
+		t.Errorf("commands of revert:\nnative:\n%s\nscript:\n%s", nativeCalls, scriptCalls)
+	}
+	for _, r := range results {
+		if r.Decision != Reverted {
+			t.Errorf("%s: %+v", r.Name, r)
+		}
+	}
+	compare(t, "revert", snapshot(t, nativeRoot), snapshot(t, scriptRoot))
+}
+
+func TestApplyTwice(t *testing.T) {
+	patches, root, _ := fixture(t)
+
+	patcher := Patcher{
+		Log:  zap.NewNop(),
+		Root: root,
+	}
+	if _, err := patcher.Apply(t.Context(), patches); err != nil {
+		t.Fatal(err)
+	}
+	patched := snapshot(t, root)
+
+	if _, err := patcher.Apply(t.Context(), patches); !errors.Is(err, ErrAlreadyPatched) {
+		t.Fatalf("second apply: %v", err)
+	}
+
+	// without the control file every patch is recognized as applied
+	os.Remove(filepath.Join(root, generator.ControlFile))
+	results, err := patcher.Apply(t.Context(), patches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.Decision != SkippedAlreadyPatched || len(r.Commands) > 0 {
+			t.Errorf("%s: %+v", r.Name, r)
+		}
+	}
+	compare(t, "apply twice", snapshot(t, root), patched)
+}
+
+func TestRevertNotPatched(t *testing.T) {
+	for _, dir := range []string{"handlers", "diffs", "lines"} {
+		t.Run(dir, func(t *testing.T) {
+			if dir == "diffs" || dir == "lines" {
+				if _, err := exec.LookPath("patch"); err != nil {
+					t.Skip("patch is not available")
+				}
+			}
+			patches, root, stubLog := fixtureDir(t, dir)
+			write(t, filepath.Join(root, generator.ControlFile), "1\n", 0o644)
+			before := snapshot(t, root)
+
+			patcher := Patcher{
+				Log:  zap.NewNop(),
+				Root: root,
+			}
+			results, err := patcher.Revert(t.Context(), patches)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range results {
+				if r.Decision != SkippedNotPatched || len(r.Commands) > 0 {
+					t.Errorf("%s: %+v", r.Name, r)
+				}
+			}
+			if stubs, _ := os.ReadFile(stubLog); len(stubs) > 0 {
+				t.Errorf("revert ran commands for patches that were not applied:\n%s", stubs)
+			}
+			delete(before, strings.TrimPrefix(generator.ControlFile, "/"))
+			compare(t, "revert", snapshot(t, root), before)
+		})
+	}
+}
+
+func TestLock(t *testing.T) {
+	patches, root, _ := fixture(t)
+
+	patcher := Patcher{
+		Log:  zap.NewNop(),
+		Root: root,
+	}
+
+	// a script run holding the lock keeps native runs out
+	lockFile := filepath.Join(root, generator.LockFile)
+	write(t, lockFile, "", 0o644)
+	fd, err := os.Open(lockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Flock(int(fd.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+	before := snapshot(t, root)
+	if _, err := patcher.Apply(t.Context(), patches); !errors.Is(err, ErrLocked) {
+		t.Fatalf("apply while locked: %v", err)
+	}
+	fd.Close()
+	for name, body := range snapshot(t, root) {
+		if before[name] != body {
+			t.Errorf("apply while locked changed %s", name)
+		}
+	}
+
+	// so does the journal of an interrupted script run
+	write(t, filepath.Join(root, generator.JournalFile), "run patch apply all 2024-01-02T03:04:05Z\n", 0o644)
+	if _, err := patcher.Apply(t.Context(), patches); !errors.Is(err, ErrInterrupted) {
+		t.Fatalf("apply after an interrupted run: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, generator.ControlFile)); err == nil {
+		t.Error("apply after an interrupted run wrote the control file")
+	}
+
+	os.Remove(filepath.Join(root, generator.JournalFile))
+	if _, err := patcher.Apply(t.Context(), patches); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCommandBeforeFails(t *testing.T) {
+	patches, root, _ := fixture(t)
+
+	bin := t.TempDir()
+	write(t, filepath.Join(bin, "systemctl"), "#!/usr/bin/env bash\n[[ \"$1\" != stop ]]\n", 0o755)
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	patcher := Patcher{
+		Log:  zap.NewNop(),
+		Root: root,
+	}
+	results, err := patcher.Apply(t.Context(), patches)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range results {
+		if r.Name != "app_1" {
+			continue
+		}
+		if r.Decision != Failed || len(r.Commands) != 1 || r.Commands[0].Command != "systemctl stop app" {
+			t.Errorf("%s: %+v", r.Name, r)
+		}
+	}
+	if got := snapshot(t, root)["etc/app/app.conf"]; got != originals["etc/app/app.conf"] {
+		t.Errorf("app.conf was written after the command before failed:\n%s", got)
+	}
+}
+
+func TestFailedPatch(t *testing.T) {
+	patches, root, _ := fixture(t)
+
+	// a directory in place of the target cannot be overwritten, even by root
+	write(t, filepath.Join(root, "etc/udev/rules.d/60-test.rules/keep"), "", 0o644)
+
+	patcher := Patcher{
+		Log:  zap.NewNop(),
+		Root: root,
+	}
+	results, err := patcher.Apply(t.Context(), patches)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range results {
+		want := Applied
+		if r.Name == "rules_1" {
+			want = Failed
+		}
+		if r.Decision != want {
+			t.Errorf("%s: decision %s, want %s (%s)", r.Name, r.Decision, want, r.Reason)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, generator.ControlFile)); err == nil {
+		t.Error("control file was written after a failed patch")
+	}
+
+	if _, err := patcher.Revert(t.Context(), patches); !errors.Is(err, ErrNotPatched) {
+		t.Errorf("revert without control file: %v", err)
+	}
+}
+
+func TestDiffMismatch(t *testing.T) {
+	patches, root, _ := fixtureDir(t, "diffs")
+	write(t, filepath.Join(root, "etc/net.conf"), "tcp_sack = 2\n", 0o644)
+
+	patcher := Patcher{
+		Log:  zap.NewNop(),
+		Root: root,
+	}
+	results, err := patcher.Apply(t.Context(), patches)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 || results[0].Decision != Failed || !strings.Contains(results[0].Reason, "does not match") {
+		t.Errorf("results: %+v", results)
+	}
+	if got := snapshot(t, root)["etc/net.conf"]; got != "tcp_sack = 2\n" {
+		t.Errorf("net.conf was changed: %q", got)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	patches, root, _ := fixtureDir(t, "verify")
+
+	patcher := Patcher{
+		Log:  zap.NewNop(),
+		Root: root,
+	}
+	results, err := patcher.Apply(t.Context(), patches)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the running kernel still selects acks, like in the script integration test
+	for _, r := range results {
+		want := 0
+		if r.Name == "net_1" {
+			want = 1
+		}
+		if r.Decision != Applied || len(r.Verify) == 0 || r.VerifyFailed() != want {
+			t.Errorf("%s: decision %s, assertions %+v", r.Name, r.Decision, r.Verify)
+		}
+	}
+	if results[1].Verify[0].Problem != "printed '1', want '0'" {
+		t.Errorf("problem of net_1: %q", results[1].Verify[0].Problem)
+	}
+	if _, err := os.Stat(filepath.Join(root, generator.ControlFile)); err != nil {
+		t.Error("control file was not written after the patches were applied")
+	}
+}
@@ -2,24 +2,64 @@
 package logger
 
 import (
+	"fmt"
+
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
-// Setup returns an instance of zap logger configuration, configured to be verbose or to use JSON formatting.
-func Setup(verbose bool) (logger *zap.Logger, err error) {
+// Options configures the logger returned by Setup. Zero values select the defaults.
+type Options struct {
+	Level       string   // Minimum level: debug, info, warn or error (default info)
+	Encoding    string   // Log format: console or json (default console)
+	OutputPaths []string // Files, or "stdout"/"stderr", the logs are written to (default stderr)
+	Caller      bool     // Whether to include the caller in each entry
+}
+
+// Setup returns an instance of zap logger configured from the options, writing either
+// human readable console lines or JSON entries.
+func Setup(options Options) (logger *zap.Logger, err error) {
 	level := zapcore.InfoLevel
-	if verbose {
-		level = zapcore.DebugLevel
+	if options.Level != "" {
+		level, err = zapcore.ParseLevel(options.Level)
+		if err != nil {
+			return
+		}
+	}
+
+	encoding := options.Encoding
+	if encoding == "" {
+		encoding = "console"
+	}
+	if encoding != "console" && encoding != "json" {
+		return nil, fmt.Errorf("unknown log encoding %q", encoding)
+	}
+
+	outputPaths := options.OutputPaths
+	if len(outputPaths) == 0 {
+		outputPaths = []string{"stderr"}
+	}
+
+	encodeLevel := zapcore.CapitalLevelEncoder
+	encodeCaller := zapcore.ShortCallerEncoder
+	if encoding == "console" {
+		encodeCaller = func(caller zapcore.EntryCaller, enc zapcore.PrimitiveArrayEncoder) {
+			callerName := caller.TrimmedPath()
+			callerName = minWidth(callerName, " ", 20)
+
+			enc.AppendString(callerName)
+		}
+	} else {
+		encodeLevel = zapcore.LowercaseLevelEncoder
 	}
 
 	config := zap.Config{
 		Level:             zap.NewAtomicLevelAt(level),
 		Development:       false,
-		DisableCaller:     false,
+		DisableCaller:     !options.Caller,
 		DisableStacktrace: false,
 		Sampling:          nil,
-		Encoding:          "console",
+		Encoding:          encoding,
 		EncoderConfig: zapcore.EncoderConfig{
 			MessageKey:     "message",
 			LevelKey:       "level",
@@ -28,19 +68,14 @@ func Setup(verbose bool) (logger *zap.Logger, err error) {
 			CallerKey:      "go",
 			StacktraceKey:  "trace",
 			LineEnding:     "\n",
-			EncodeLevel:    zapcore.CapitalLevelEncoder,
+			EncodeLevel:    encodeLevel,
 			EncodeTime:     zapcore.ISO8601TimeEncoder,
 			EncodeDuration: zapcore.StringDurationEncoder,
-			EncodeCaller: func(caller zapcore.EntryCaller, enc zapcore.PrimitiveArrayEncoder) {
-				callerName := caller.TrimmedPath()
-				callerName = minWidth(callerName, " ", 20)
-
-				enc.AppendString(callerName)
-			},
-			EncodeName: zapcore.FullNameEncoder,
+			EncodeCaller:   encodeCaller,
+			EncodeName:     zapcore.FullNameEncoder,
 		},
-		OutputPaths:      []string{"stdout"},
-		ErrorOutputPaths: nil,
+		OutputPaths:      outputPaths,
+		ErrorOutputPaths: []string{"stderr"},
 		InitialFields:    nil,
 	}
 
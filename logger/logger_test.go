@@ -0,0 +1,56 @@
+package logger
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetupJSONToFile(t *testing.T) {
+	fileLoc := filepath.Join(t.TempDir(), "patchfiles.log")
+
+	log, err := Setup(Options{
+		Level:       "warn",
+		Encoding:    "json",
+		OutputPaths: []string{fileLoc},
+		Caller:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log.Info("dropped below the level")
+	log.Warn("kept")
+	log.Sync()
+
+	body, err := os.ReadFile(fileLoc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entry map[string]any
+	if err := json.Unmarshal(body, &entry); err != nil {
+		t.Fatalf("log is not a single JSON entry: %v\n%s", err, body)
+	}
+	if entry["message"] != "kept" || entry["level"] != "warn" || entry["go"] == nil {
+		t.Errorf("unexpected entry: %v", entry)
+	}
+}
+
+func TestSetupRejectsInvalidOptions(t *testing.T) {
+	for _, options := range []Options{{Level: "loud"}, {Encoding: "xml"}} {
+		if _, err := Setup(options); err == nil {
+			t.Errorf("Setup(%+v) accepted invalid options", options)
+		}
+	}
+}
+
+func TestMinWidth(t *testing.T) {
+	if got := minWidth("ab", ".", 4); got != "ab.." {
+		t.Errorf("minWidth() = %q", got)
+	}
+	if got := minWidth("abcdef", ".", 4); got != "abcdef" {
+		t.Errorf("minWidth() = %q", got)
+	}
+}
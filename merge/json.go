@@ -0,0 +1,266 @@
+package merge
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// member is a key of a JSON object with its value.
+type member struct {
+	key   string
+	value any
+}
+
+// object is a JSON object that keeps the order of its keys, like a Python dict.
+type object []member
+
+// get returns the value of key, or nil.
+func (o object) get(key string) any {
+	for _, m := range o {
+		if m.key == key {
+			return m.value
+		}
+	}
+
+	return nil
+}
+
+// set replaces the value of key in place, or adds key at the end.
+func (o object) set(key string, value any) object {
+	for i, m := range o {
+		if m.key == key {
+			o[i].value = value
+			return o
+		}
+	}
+
+	return append(o, member{key, value})
+}
+
+// mergeJSON merges a JSON fragment into text and writes the result like Python's
+// json.dumps(indent=2, ensure_ascii=False) with a trailing newline.
+func mergeJSON(text, fragment string) (string, error) {
+	src, err := decodeJSON(fragment)
+	if err != nil {
+		return "", fmt.Errorf("fragment: %w", err)
+	}
+
+	dst := any(object{})
+	if strings.TrimSpace(text) != "" {
+		dst, err = decodeJSON(text)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if _, ok := src.(object); !ok {
+		return "", errors.New("fragment: not a JSON object")
+	}
+	if _, ok := dst.(object); !ok {
+		return "", errors.New("not a JSON object")
+	}
+
+	var out strings.Builder
+	writeJSON(&out, mergeValues(dst, src), "")
+	out.WriteString("\n")
+
+	return out.String(), nil
+}
+
+// mergeValues merges src into dst when both are objects, otherwise src replaces dst.
+func mergeValues(dst, src any) any {
+	d, ok := dst.(object)
+	s, ok2 := src.(object)
+	if !ok || !ok2 {
+		return src
+	}
+
+	for _, m := range s {
+		d = d.set(m.key, mergeValues(d.get(m.key), m.value))
+	}
+
+	return d
+}
+
+// decodeJSON decodes a single JSON value, with objects as object and numbers as json.Number.
+func decodeJSON(text string) (any, error) {
+	dec := json.NewDecoder(strings.NewReader(text))
+	dec.UseNumber()
+
+	value, err := decodeValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid JSON: data after the top level value")
+	}
+
+	return value, nil
+}
+
+// decodeValue decodes the next value from dec.
+func decodeValue(dec *json.Decoder) (any, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	delim, ok := token.(json.Delim)
+	if !ok {
+		return token, nil
+	}
+
+	switch delim {
+	case '{':
+		o := object{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, fmt.Errorf("invalid JSON: %w", err)
+			}
+			value, err := decodeValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			o = o.set(key.(string), value)
+		}
+		_, err = dec.Token()
+		return o, err
+	case '[':
+		list := make([]any, 0)
+		for dec.More() {
+			value, err := decodeValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		_, err = dec.Token()
+		return list, err
+	}
+
+	return nil, fmt.Errorf("invalid JSON: unexpected %v", delim)
+}
+
+// writeJSON writes a value indented by two spaces per level.
+func writeJSON(out *strings.Builder, value any, indent string) {
+	switch v := value.(type) {
+	case object:
+		if len(v) == 0 {
+			out.WriteString("{}")
+			return
+		}
+		out.WriteString("{")
+		for i, m := range v {
+			if i > 0 {
+				out.WriteString(",")
+			}
+			out.WriteString("\n" + indent + "  " + quoteJSON(m.key) + ": ")
+			writeJSON(out, m.value, indent+"  ")
+		}
+		out.WriteString("\n" + indent + "}")
+	case []any:
+		if len(v) == 0 {
+			out.WriteString("[]")
+			return
+		}
+		out.WriteString("[")
+		for i, item := range v {
+			if i > 0 {
+				out.WriteString(",")
+			}
+			out.WriteString("\n" + indent + "  ")
+			writeJSON(out, item, indent+"  ")
+		}
+		out.WriteString("\n" + indent + "]")
+	case string:
+		out.WriteString(quoteJSON(v))
+	case json.Number:
+		out.WriteString(formatNumber(v))
+	case bool:
+		out.WriteString(strconv.FormatBool(v))
+	case nil:
+		out.WriteString("null")
+	}
+}
+
+// quoteJSON quotes a string like Python's json module with ensure_ascii=False: only quotes,
+// backslashes and control characters are escaped.
+func quoteJSON(s string) string {
+	var out strings.Builder
+	out.WriteString(`"`)
+	for _, r := range s {
+		switch r {
+		case '"':
+			out.WriteString(`\"`)
+		case '\\':
+			out.WriteString(`\\`)
+		case '\b':
+			out.WriteString(`\b`)
+		case '\f':
+			out.WriteString(`\f`)
+		case '\n':
+			out.WriteString(`\n`)
+		case '\r':
+			out.WriteString(`\r`)
+		case '\t':
+			out.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(&out, `\u%04x`, r)
+			} else {
+				out.WriteRune(r)
+			}
+		}
+	}
+	out.WriteString(`"`)
+
+	return out.String()
+}
+
+// formatNumber writes a number like Python does after parsing it: integers as they are, other
+// numbers as the shortest float repr, e.g. "1.0", "0.0001" or "1e-05".
+func formatNumber(n json.Number) string {
+	s := string(n)
+	if !strings.ContainsAny(s, ".eE") {
+		if s == "-0" {
+			return "0"
+		}
+		return s
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	switch {
+	case err != nil && math.IsInf(f, 1):
+		return "Infinity"
+	case err != nil && math.IsInf(f, -1):
+		return "-Infinity"
+	case err != nil:
+		return s
+	}
+
+	return reprFloat(f)
+}
+
+// reprFloat writes a finite float like Python's repr: the shortest digits that read back, with a
+// ".0" for whole numbers.
+func reprFloat(f float64) string {
+	// Python switches to the exponent form outside 1e-4 <= |f| < 1e16
+	scientific := strconv.FormatFloat(f, 'e', -1, 64)
+	_, exp, _ := strings.Cut(scientific, "e")
+	if e, _ := strconv.Atoi(exp); f != 0 && (e < -4 || e >= 16) {
+		return scientific
+	}
+
+	fixed := strconv.FormatFloat(f, 'f', -1, 64)
+	if !strings.Contains(fixed, ".") {
+		fixed += ".0"
+	}
+
+	return fixed
+}
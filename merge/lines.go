@@ -0,0 +1,217 @@
+package merge
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// item is a section header or a key of an INI or TOML file, spanning lines start to end.
+type item struct {
+	section bool   // Section header, e.g. "[Service]", instead of a key
+	name    string // Section name without brackets or key without its value
+	start   int    // First line
+	end     int    // Line after the last line, values of TOML keys can span lines
+}
+
+// mergeLines merges an INI or TOML fragment into text by section and key. A key of the fragment
+// replaces the first line of the same key in the same section of text and drops later ones, or is
+// added after the last key of the section. Keys before the first section belong to the top of the
+// file. A missing section is appended with its keys, after an empty line. Lines of the fragment
+// are written as they are, other lines of text are kept, comments included.
+func mergeLines(text, fragment string, toml bool) (string, error) {
+	lines := splitLines(text)
+	frag := splitLines(fragment)
+
+	items, err := parseLines(frag, toml, true)
+	if err != nil {
+		return "", fmt.Errorf("fragment: %w", err)
+	}
+
+	section, header := "", ""
+	top := true
+	for _, it := range items {
+		if it.section {
+			section, header, top = it.name, strings.TrimSpace(frag[it.start]), false
+			lines = ensureSection(lines, section, header, toml)
+			continue
+		}
+		lines = setKey(lines, section, top, it.name, frag[it.start:it.end], toml)
+	}
+
+	var out strings.Builder
+	for _, line := range lines {
+		out.WriteString(line + "\n")
+	}
+
+	return out.String(), nil
+}
+
+// splitLines splits text into lines without their newlines.
+func splitLines(text string) []string {
+	lines := strings.Split(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines
+}
+
+// parseLines returns the section headers and keys of lines. Empty lines, comments and, unless
+// strict, lines that are neither are skipped.
+func parseLines(lines []string, toml, strict bool) (items []item, err error) {
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+			continue
+		case line[0] == '[':
+			name := sectionName(line)
+			if strict && toml && strings.HasPrefix(name, "[[") {
+				return nil, fmt.Errorf("line %d: arrays of tables cannot be merged", i+1)
+			}
+			items = append(items, item{section: true, name: name, start: i, end: i + 1})
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			if strict {
+				return nil, fmt.Errorf("line %d: %q is neither a section nor a key", i+1, lines[i])
+			}
+			continue
+		}
+
+		end := i + 1
+		if toml {
+			quote, depth := scanValue(value, "", 0)
+			for (quote != "" || depth > 0) && end < len(lines) {
+				quote, depth = scanValue(lines[end], quote, depth)
+				end++
+			}
+		}
+
+		items = append(items, item{name: strings.TrimSpace(key), start: i, end: end})
+		i = end - 1
+	}
+
+	return
+}
+
+// sectionName returns the name of a section header: "Service" for "[Service]" and "[servers]" for
+// the TOML array of tables "[[servers]]".
+func sectionName(line string) string {
+	if strings.HasPrefix(line, "[[") {
+		name, _, _ := strings.Cut(line[2:], "]]")
+		return "[[" + strings.TrimSpace(name) + "]]"
+	}
+
+	name, _, _ := strings.Cut(line[1:], "]")
+	return strings.TrimSpace(name)
+}
+
+// scanValue scans a line of a TOML value and returns the multi-line string it leaves open, if any,
+// and the depth of open arrays and inline tables. It starts inside quote at depth.
+func scanValue(line, quote string, depth int) (string, int) {
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+
+		switch {
+		case quote == `"""` || quote == "'''":
+			if strings.HasPrefix(line[i:], quote) {
+				quote = ""
+				i += 2
+			} else if quote == `"""` && c == '\\' {
+				i++
+			}
+		case quote == `"`:
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				quote = ""
+			}
+		case quote == "'":
+			if c == '\'' {
+				quote = ""
+			}
+		case strings.HasPrefix(line[i:], `"""`) || strings.HasPrefix(line[i:], "'''"):
+			quote = line[i : i+3]
+			i += 2
+		case c == '"' || c == '\'':
+			quote = string(c)
+		case c == '#':
+			return "", depth
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		}
+	}
+
+	// basic and literal strings end with the line
+	if len(quote) != 3 {
+		quote = ""
+	}
+
+	return quote, depth
+}
+
+// findSection returns the line of the header of section, -1 for the top of the file or when the
+// section is missing, its keys and whether it exists.
+func findSection(lines []string, section string, top, toml bool) (header int, keys []item, found bool) {
+	items, _ := parseLines(lines, toml, false)
+
+	header, found = -1, top
+	for _, it := range items {
+		switch {
+		case it.section && found:
+			return
+		case it.section && it.name == section:
+			header, found = it.start, true
+		case !it.section && found:
+			keys = append(keys, it)
+		}
+	}
+
+	return
+}
+
+// ensureSection appends section with its header line when lines has no such section.
+func ensureSection(lines []string, section, header string, toml bool) []string {
+	if _, _, found := findSection(lines, section, false, toml); found {
+		return lines
+	}
+
+	if len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) != "" {
+		lines = append(lines, "")
+	}
+
+	return append(lines, header)
+}
+
+// setKey sets key of section to the lines of entry.
+func setKey(lines []string, section string, top bool, key string, entry []string, toml bool) []string {
+	header, keys, _ := findSection(lines, section, top, toml)
+
+	var matches []item
+	for _, it := range keys {
+		if it.name == key {
+			matches = append(matches, it)
+		}
+	}
+
+	if len(matches) == 0 {
+		at := header + 1
+		if len(keys) > 0 {
+			at = keys[len(keys)-1].end
+		}
+		return slices.Concat(lines[:at], entry, lines[at:])
+	}
+
+	for i := len(matches) - 1; i > 0; i-- {
+		lines = slices.Concat(lines[:matches[i].start], lines[matches[i].end:])
+	}
+
+	return slices.Concat(lines[:matches[0].start], entry, lines[matches[0].end:])
+}
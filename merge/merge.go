@@ -0,0 +1,48 @@
+// Package merge deep merges structured fragments into JSON, YAML, INI and TOML files, the same
+// way the pf_merge helper of the generated patch scripts does with Python's json module and
+// PyYAML, so both write identical files. YAML is read with the rules of PyYAML, YAML 1.1, and
+// written like its safe_dump, see mergeYAML.
+package merge
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+var (
+	// Formats are the file formats a fragment can be merged into.
+	Formats = []string{"json", "yaml", "ini", "toml"}
+	// ErrFormat is returned for a format that is not one of Formats.
+	ErrFormat = errors.New("unknown merge format")
+)
+
+// Merge returns text with fragment deep merged into it. JSON objects and YAML mappings are merged
+// key by key, recursively, and any other value of the fragment replaces the one in text, lists
+// included. Keys keep their position, new keys are added at the end. INI and TOML files are merged
+// by section and key with their comments and the order of their lines kept, see mergeLines. An
+// empty text counts as an empty file of the format.
+func Merge(format, text, fragment string) (string, error) {
+	switch format {
+	case "json":
+		return mergeJSON(text, fragment)
+	case "yaml":
+		return mergeYAML(text, fragment)
+	case "ini", "toml":
+		return mergeLines(text, fragment, format == "toml")
+	}
+
+	return "", fmt.Errorf("%w %q, must be one of %s", ErrFormat, format, strings.Join(Formats, ", "))
+}
+
+// Check returns an error when fragment cannot be merged as format: JSON and YAML fragments must be
+// an object or mapping, INI and TOML fragments must consist of sections and keys.
+func Check(format, fragment string) error {
+	if !slices.Contains(Formats, format) {
+		return fmt.Errorf("%w %q, must be one of %s", ErrFormat, format, strings.Join(Formats, ", "))
+	}
+
+	_, err := Merge(format, "", fragment)
+	return err
+}
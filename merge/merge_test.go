@@ -0,0 +1,152 @@
+package merge
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	cases := []struct {
+		name     string
+		format   string
+		text     string
+		fragment string
+		want     string
+	}{
+		{
+			name:     "json deep merge keeps the order of keys",
+			format:   "json",
+			text:     `{"b": 1, "a": {"x": [1, 2], "y": "old"}}`,
+			fragment: `{"a": {"y": "new", "z": null}, "c": []}`,
+			want:     "{\n  \"b\": 1,\n  \"a\": {\n    \"x\": [\n      1,\n      2\n    ],\n    \"y\": \"new\",\n    \"z\": null\n  },\n  \"c\": []\n}\n",
+		},
+		{
+			name:     "json lists and scalars are replaced",
+			format:   "json",
+			text:     `{"list": [1, 2, 3], "map": {"k": 1}}`,
+			fragment: `{"list": [4], "map": "flat"}`,
+			want:     "{\n  \"list\": [\n    4\n  ],\n  \"map\": \"flat\"\n}\n",
+		},
+		{
+			name:     "json numbers and strings are written like python",
+			format:   "json",
+			text:     "",
+			fragment: `{"f": 1.50, "e": 1e3, "s": 1e-05, "big": 1e16, "i": -0, "q": "a\"b\\c\tü\u0001"}`,
+			want:     "{\n  \"f\": 1.5,\n  \"e\": 1000.0,\n  \"s\": 1e-05,\n  \"big\": 1e+16,\n  \"i\": 0,\n  \"q\": \"a\\\"b\\\\c\\tü\\u0001\"\n}\n",
+		},
+		{
+			name:     "yaml deep merge",
+			format:   "yaml",
+			text:     "# dropped\nserver:\n  port: 80\n  tls: false\nname: app\n",
+			fragment: "server:\n  port: 8080\n  hosts: [a]\n",
+			want:     "server:\n  port: 8080\n  tls: false\n  hosts:\n  - a\nname: app\n",
+		},
+		{
+			name:     "yaml scalars are read and written like pyyaml",
+			format:   "yaml",
+			text:     "port: \"8080\"\nratio: 1.0\ny: 1\ncount: 017\nbig: 1e16\nwhen: 2001-12-14t21:59:43.10-05:00\n",
+			fragment: "timeout: 2.50\nname: \"yes\"\n",
+			want:     "port: '8080'\nratio: 1.0\ny: 1\ncount: 15\nbig: 1e16\nwhen: 2001-12-14 21:59:43.100000-05:00\ntimeout: 2.5\nname: 'yes'\n",
+		},
+		{
+			name:     "yaml aliases and merge keys are expanded",
+			format:   "yaml",
+			text:     "base: &b\n  x: 1\nref: *b\nother:\n  <<: *b\n  z: 2\n",
+			fragment: "ref:\n  y: 2\n",
+			want:     "base:\n  x: 1\nref:\n  x: 1\n  y: 2\nother:\n  x: 1\n  z: 2\n",
+		},
+		{
+			name:     "ini keys are replaced in place and added after the last key",
+			format:   "ini",
+			text:     "; comment\ntop = 1\n[main]\n# keep\nname = app\nname = dup\nsize = 1\n\n[other]\nx = 1\n",
+			fragment: "top = 2\nnew = 3\n[main]\nname = patched\nextra = yes\n",
+			want:     "; comment\ntop = 2\nnew = 3\n[main]\n# keep\nname = patched\nsize = 1\nextra = yes\n\n[other]\nx = 1\n",
+		},
+		{
+			name:     "ini missing section is appended",
+			format:   "ini",
+			text:     "[main]\nname = app",
+			fragment: "[ cache ]\nsize = 64m\n",
+			want:     "[main]\nname = app\n\n[ cache ]\nsize = 64m\n",
+		},
+		{
+			name:     "ini top keys go to the start of a file without them",
+			format:   "ini",
+			text:     "[main]\nname = app\n",
+			fragment: "debug = true\n",
+			want:     "debug = true\n[main]\nname = app\n",
+		},
+		{
+			name:     "toml multi-line values are replaced as a whole",
+			format:   "toml",
+			text:     "title = \"x\"\n[server]\nports = [\n  80, # http\n  443,\n]\nmotd = \"\"\"\n[not a section]\n\"\"\"\nhost = \"a\"\n",
+			fragment: "[server]\nports = [8080]\nmotd = '''\nhello ]\n'''\n",
+			want:     "title = \"x\"\n[server]\nports = [8080]\nmotd = '''\nhello ]\n'''\nhost = \"a\"\n",
+		},
+		{
+			name:     "toml strings with brackets and hashes",
+			format:   "toml",
+			text:     "a = \"[#\"\nb = 1\n",
+			fragment: "b = '{'\n",
+			want:     "a = \"[#\"\nb = '{'\n",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := Merge(c.format, c.text, c.fragment)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, c.want)
+			}
+
+			// merging again changes nothing, which is how the scripts detect a compliant target
+			again, err := Merge(c.format, got, c.fragment)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again != got {
+				t.Errorf("second merge changed the result:\n%s", again)
+			}
+		})
+	}
+}
+
+func TestMergeErrors(t *testing.T) {
+	cases := []struct {
+		name     string
+		format   string
+		text     string
+		fragment string
+		want     string
+	}{
+		{"unknown format", "xml", "", "<a/>", "unknown merge format"},
+		{"json fragment is a list", "json", "", "[1]", "fragment: not a JSON object"},
+		{"json target is broken", "json", "{broken", `{"a": 1}`, "invalid JSON"},
+		{"json trailing data", "json", `{} {}`, `{"a": 1}`, "data after the top level value"},
+		{"yaml fragment is a list", "yaml", "", "- a\n", "fragment:"},
+		{"yaml target is a comment", "yaml", "# empty\n", "a: 1\n", "not a YAML mapping"},
+		{"yaml unknown tag", "yaml", "", "a: !secret x\n", "could not determine a constructor"},
+		{"ini fragment line without key", "ini", "", "[main]\njunk\n", `line 2: "junk" is neither a section nor a key`},
+		{"toml array of tables", "toml", "", "[[servers]]\nname = 'a'\n", "arrays of tables cannot be merged"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := Merge(c.format, c.text, c.fragment)
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("error %v, want %q", err, c.want)
+			}
+		})
+	}
+
+	if err := Check("xml", "<a/>"); !errors.Is(err, ErrFormat) {
+		t.Errorf("check of an unknown format: %v", err)
+	}
+	if err := Check("toml", "[server]\nport = 1\n"); err != nil {
+		t.Errorf("check of a valid fragment: %v", err)
+	}
+}
@@ -0,0 +1,997 @@
+package merge
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// pair is a key of a YAML mapping with its value.
+type pair struct {
+	key, value any
+}
+
+// mapping is a YAML mapping that keeps the order of its keys, like a Python dict.
+type mapping []pair
+
+// get returns the value of key, or nil.
+func (m mapping) get(key any) any {
+	for _, p := range m {
+		if sameKey(p.key, key) {
+			return p.value
+		}
+	}
+
+	return nil
+}
+
+// set replaces the value of key in place, or adds key at the end.
+func (m mapping) set(key, value any) mapping {
+	for i, p := range m {
+		if sameKey(p.key, key) {
+			m[i].value = value
+			return m
+		}
+	}
+
+	return append(m, pair{key, value})
+}
+
+// sameKey reports whether two scalars are the same mapping key. Like in a Python dict, numbers
+// are equal by value, and true and false equal 1 and 0.
+func sameKey(a, b any) bool {
+	x, ok := number(a)
+	y, ok2 := number(b)
+	if ok && ok2 {
+		return x.Cmp(y) == 0
+	}
+
+	return a == b
+}
+
+// number returns the value of a bool, an integer or a float that is not NaN.
+func number(value any) (*big.Float, bool) {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return big.NewFloat(1), true
+		}
+		return big.NewFloat(0), true
+	case *big.Int:
+		return new(big.Float).SetInt(v), true
+	case float64:
+		if !math.IsNaN(v) {
+			return big.NewFloat(v), true
+		}
+	}
+
+	return nil, false
+}
+
+// timestamp is a date or a date and time, written like Python's isoformat.
+type timestamp string
+
+// mergeYAML merges a YAML fragment into text and writes the result like PyYAML's safe_dump with
+// default_flow_style=False, sort_keys=False and allow_unicode=True. Comments are not kept.
+func mergeYAML(text, fragment string) (string, error) {
+	src, err := decodeYAML(fragment)
+	if err != nil {
+		return "", fmt.Errorf("fragment: %w", err)
+	}
+
+	dst := any(mapping{})
+	if strings.TrimSpace(text) != "" {
+		dst, err = decodeYAML(text)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if _, ok := src.(mapping); !ok {
+		return "", errors.New("fragment: not a YAML mapping")
+	}
+	if _, ok := dst.(mapping); !ok {
+		return "", errors.New("not a YAML mapping")
+	}
+
+	return writeYAML(mergeMaps(dst, src))
+}
+
+// mergeMaps merges src into dst when both are mappings, otherwise src replaces dst.
+func mergeMaps(dst, src any) any {
+	d, ok := dst.(mapping)
+	s, ok2 := src.(mapping)
+	if !ok || !ok2 {
+		return src
+	}
+
+	for _, p := range s {
+		d = d.set(p.key, mergeMaps(d.get(p.key), p.value))
+	}
+
+	return d
+}
+
+// decodeYAML decodes a single YAML document like PyYAML's safe_load. yaml.v3 only parses it: its
+// nodes keep the text and style of scalars, which are resolved with the rules of PyYAML, YAML 1.1,
+// so that "y" stays a string and "1.0" a float.
+func decodeYAML(text string) (any, error) {
+	var doc yaml.Node
+
+	dec := yaml.NewDecoder(strings.NewReader(text))
+	err := dec.Decode(&doc)
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := dec.Decode(new(yaml.Node)); err != io.EOF {
+		return nil, errors.New("expected a single document")
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	return construct(doc.Content[0])
+}
+
+// construct returns the value of a node: mappings as mapping, sequences as []any and scalars as
+// string, nil, bool, *big.Int, float64 or timestamp. Aliases are expanded.
+func construct(n *yaml.Node) (any, error) {
+	n = deref(n)
+
+	switch n.Kind {
+	case yaml.MappingNode:
+		pairs, err := flatten(n)
+		if err != nil {
+			return nil, err
+		}
+
+		m := mapping{}
+		for _, p := range pairs {
+			key, err := construct(p[0])
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := key.(mapping); ok {
+				return nil, fmt.Errorf("line %d: found unhashable key", p[0].Line)
+			}
+			if _, ok := key.([]any); ok {
+				return nil, fmt.Errorf("line %d: found unhashable key", p[0].Line)
+			}
+
+			value, err := construct(p[1])
+			if err != nil {
+				return nil, err
+			}
+			m = m.set(key, value)
+		}
+		return m, nil
+	case yaml.SequenceNode:
+		items := []any{}
+		for _, c := range n.Content {
+			item, err := construct(c)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+
+	tag := n.ShortTag()
+	if n.Style&yaml.TaggedStyle == 0 {
+		tag = "!!str"
+		if n.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+			tag = resolve(n.Value)
+		}
+	}
+
+	value, err := constructScalar(tag, n.Value)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %w", n.Line, err)
+	}
+
+	return value, nil
+}
+
+// deref returns the node an alias refers to.
+func deref(n *yaml.Node) *yaml.Node {
+	for n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+
+	return n
+}
+
+// flatten returns the keys and values of a mapping with its merge keys replaced by the keys they
+// merge, ahead of its own keys, like PyYAML's flatten_mapping. A later key overrides the value of
+// an earlier one, a list of mappings is merged last to first.
+func flatten(n *yaml.Node) ([][2]*yaml.Node, error) {
+	var merged, own [][2]*yaml.Node
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := deref(n.Content[i]), deref(n.Content[i+1])
+		if key.ShortTag() != "!!merge" {
+			own = append(own, [2]*yaml.Node{key, value})
+			continue
+		}
+
+		var sources []*yaml.Node
+		switch value.Kind {
+		case yaml.MappingNode:
+			sources = []*yaml.Node{value}
+		case yaml.SequenceNode:
+			for j := len(value.Content) - 1; j >= 0; j-- {
+				sources = append(sources, deref(value.Content[j]))
+			}
+		default:
+			return nil, fmt.Errorf("line %d: expected a mapping or list of mappings for merging", value.Line)
+		}
+
+		for _, source := range sources {
+			if source.Kind != yaml.MappingNode {
+				return nil, fmt.Errorf("line %d: expected a mapping for merging", source.Line)
+			}
+			pairs, err := flatten(source)
+			if err != nil {
+				return nil, err
+			}
+			merged = append(merged, pairs...)
+		}
+	}
+
+	return append(merged, own...), nil
+}
+
+const (
+	// yamlIndent and yamlWidth are the indentation and the column long scalars are folded at, the
+	// defaults of PyYAML.
+	yamlIndent = 2
+	yamlWidth  = 80
+)
+
+// The patterns of PyYAML's resolver for plain scalars that do not read back as strings.
+const (
+	boolPattern      = `yes|Yes|YES|no|No|NO|true|True|TRUE|false|False|FALSE|on|On|ON|off|Off|OFF`
+	floatPattern     = `[-+]?(?:[0-9][0-9_]*)\.[0-9_]*(?:[eE][-+][0-9]+)?|\.[0-9][0-9_]*(?:[eE][-+][0-9]+)?|[-+]?[0-9][0-9_]*(?::[0-5]?[0-9])+\.[0-9_]*|[-+]?\.(?:inf|Inf|INF)|\.(?:nan|NaN|NAN)`
+	intPattern       = `[-+]?0b[0-1_]+|[-+]?0[0-7_]+|[-+]?(?:0|[1-9][0-9_]*)|[-+]?0x[0-9a-fA-F_]+|[-+]?[1-9][0-9_]*(?::[0-5]?[0-9])+`
+	nullPattern      = `~|null|Null|NULL|`
+	timestampPattern = `[0-9][0-9][0-9][0-9]-[0-9][0-9]-[0-9][0-9]|[0-9][0-9][0-9][0-9]-[0-9][0-9]?-[0-9][0-9]?(?:[Tt]|[ \t]+)[0-9][0-9]?:[0-9][0-9]:[0-9][0-9](?:\.[0-9]*)?(?:[ \t]*(?:Z|[-+][0-9][0-9]?(?::[0-9][0-9])?))?`
+)
+
+var (
+	// implicit matches the plain scalars that do not read back as strings, merge and value keys
+	// included.
+	implicit = regexp.MustCompile(`^(?:` + strings.Join([]string{
+		boolPattern, floatPattern, intPattern, `<<`, nullPattern, timestampPattern, `=`,
+	}, "|") + `)$`)
+
+	// resolvers are the tags of the patterns, in the order PyYAML tries them.
+	resolvers = []struct {
+		tag     string
+		pattern *regexp.Regexp
+	}{
+		{"!!bool", regexp.MustCompile(`^(?:` + boolPattern + `)$`)},
+		{"!!float", regexp.MustCompile(`^(?:` + floatPattern + `)$`)},
+		{"!!int", regexp.MustCompile(`^(?:` + intPattern + `)$`)},
+		{"!!merge", regexp.MustCompile(`^<<$`)},
+		{"!!null", regexp.MustCompile(`^(?:` + nullPattern + `)$`)},
+		{"!!timestamp", regexp.MustCompile(`^(?:` + timestampPattern + `)$`)},
+		{"!!value", regexp.MustCompile(`^=$`)},
+	}
+
+	// timestampParts splits a timestamp like PyYAML's SafeConstructor.timestamp_regexp.
+	timestampParts = regexp.MustCompile(`^([0-9]{4})-([0-9][0-9]?)-([0-9][0-9]?)(?:(?:[Tt]|[ \t]+)([0-9][0-9]?):([0-9][0-9]):([0-9][0-9])(?:\.([0-9]*))?(?:[ \t]*(Z|([-+])([0-9][0-9]?)(?::([0-9][0-9]))?))?)?$`)
+)
+
+// resolve returns the tag of a plain scalar.
+func resolve(text string) string {
+	for _, r := range resolvers {
+		if r.pattern.MatchString(text) {
+			return r.tag
+		}
+	}
+
+	return "!!str"
+}
+
+// constructScalar returns the value of a scalar with tag, like PyYAML's SafeConstructor.
+func constructScalar(tag, text string) (any, error) {
+	switch tag {
+	case "!", "!!str":
+		return text, nil
+	case "!!null":
+		return nil, nil
+	case "!!bool":
+		switch strings.ToLower(text) {
+		case "yes", "true", "on":
+			return true, nil
+		case "no", "false", "off":
+			return false, nil
+		}
+	case "!!int":
+		if n, ok := constructInt(text); ok {
+			return n, nil
+		}
+	case "!!float":
+		if f, ok := constructFloat(text); ok {
+			return f, nil
+		}
+	case "!!timestamp":
+		if t, ok := constructTimestamp(text); ok {
+			return t, nil
+		}
+	default:
+		return nil, fmt.Errorf("could not determine a constructor for the tag %s", tag)
+	}
+
+	return nil, fmt.Errorf("invalid %s value %q", strings.TrimPrefix(tag, "!!"), text)
+}
+
+// sign removes the sign of a number and reports whether it was negative.
+func sign(text string) (string, bool) {
+	if text != "" && (text[0] == '-' || text[0] == '+') {
+		return text[1:], text[0] == '-'
+	}
+
+	return text, false
+}
+
+// constructInt parses an integer: binary after 0b, hexadecimal after 0x, octal after 0, base 60
+// with colons and decimal otherwise, with underscores ignored.
+func constructInt(text string) (*big.Int, bool) {
+	text, negative := sign(strings.ReplaceAll(text, "_", ""))
+
+	n := new(big.Int)
+	ok := true
+	switch {
+	case text == "0":
+	case strings.HasPrefix(text, "0b"):
+		_, ok = n.SetString(text[2:], 2)
+	case strings.HasPrefix(text, "0x"):
+		_, ok = n.SetString(text[2:], 16)
+	case strings.HasPrefix(text, "0"):
+		_, ok = n.SetString(text, 8)
+	case strings.Contains(text, ":"):
+		for _, part := range strings.Split(text, ":") {
+			digit, ok2 := new(big.Int).SetString(part, 10)
+			if !ok2 {
+				return nil, false
+			}
+			n.Mul(n, big.NewInt(60)).Add(n, digit)
+		}
+	default:
+		_, ok = n.SetString(text, 10)
+	}
+	if negative {
+		n.Neg(n)
+	}
+
+	return n, ok
+}
+
+// constructFloat parses a float, in base 60 with colons, with underscores ignored.
+func constructFloat(text string) (float64, bool) {
+	text, negative := sign(strings.ToLower(strings.ReplaceAll(text, "_", "")))
+
+	var f float64
+	switch {
+	case text == ".inf":
+		f = math.Inf(1)
+	case text == ".nan":
+		return math.NaN(), true
+	case strings.Contains(text, ":"):
+		// summed from the lowest part up, like PyYAML, to round the same way
+		parts := strings.Split(text, ":")
+		base := 1.0
+		for i := len(parts) - 1; i >= 0; i-- {
+			digit, err := strconv.ParseFloat(parts[i], 64)
+			if err != nil {
+				return 0, false
+			}
+			f += digit * base
+			base *= 60
+		}
+	default:
+		var err error
+		f, err = strconv.ParseFloat(text, 64)
+		if err != nil {
+			return 0, false
+		}
+	}
+	if negative {
+		f = -f
+	}
+
+	return f, true
+}
+
+// constructTimestamp parses a date, or a date and time with an optional fraction and time zone,
+// and writes it like Python's date.isoformat or datetime.isoformat(" ").
+func constructTimestamp(text string) (timestamp, bool) {
+	m := timestampParts.FindStringSubmatch(text)
+	if m == nil {
+		return "", false
+	}
+
+	n := make([]int, len(m))
+	for i, part := range m[1:] {
+		n[i+1], _ = strconv.Atoi(part)
+	}
+	year, month, day, hour, minute, second := n[1], n[2], n[3], n[4], n[5], n[6]
+
+	date := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	if date.Year() != year || int(date.Month()) != month || date.Day() != day {
+		return "", false
+	}
+	out := fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+	if m[4] == "" {
+		return timestamp(out), true
+	}
+
+	if hour > 23 || minute > 59 || second > 59 {
+		return "", false
+	}
+	out += fmt.Sprintf(" %02d:%02d:%02d", hour, minute, second)
+
+	// the fraction is cut or padded to microseconds
+	if fraction := (m[7] + "000000")[:6]; strings.Trim(fraction, "0") != "" {
+		out += "." + fraction
+	}
+
+	switch {
+	case m[9] != "":
+		offset := n[10]*60 + n[11]
+		if offset >= 24*60 {
+			return "", false
+		}
+		zone := "+"
+		if m[9] == "-" && offset != 0 {
+			zone = "-"
+		}
+		out += fmt.Sprintf("%s%02d:%02d", zone, offset/60, offset%60)
+	case m[8] == "Z":
+		out += "+00:00"
+	}
+
+	return timestamp(out), true
+}
+
+// yamlEscapes are the escapes of double quoted scalars with a short form.
+var yamlEscapes = map[rune]string{
+	0: "0", '\a': "a", '\b': "b", '\t': "t", '\n': "n", '\v': "v", '\f': "f", '\r': "r", 0x1b: "e",
+	'"': "\"", '\\': "\\", 0x85: "N", 0xa0: "_", 0x2028: "L", 0x2029: "P",
+}
+
+// scalar is a scalar as the emitter writes it: the text and whether it reads back as the same
+// value when written plain.
+type scalar struct {
+	text  []rune
+	plain bool
+}
+
+// analysis is what a scalar allows, see PyYAML's Emitter.analyze_scalar.
+type analysis struct {
+	empty, multiline                bool
+	allowFlowPlain, allowBlockPlain bool
+	allowSingleQuoted, allowBlock   bool
+}
+
+// yamlEmitter writes YAML like PyYAML's safe_dump with default_flow_style=False and
+// allow_unicode=True, of which it ports the parts these options reach: collections in block
+// style, empty ones in flow style, scalars plain when they read back as the same value, quoted
+// otherwise and folded at yamlWidth.
+type yamlEmitter struct {
+	out        strings.Builder
+	column     int
+	whitespace bool  // the last character written is a whitespace
+	indention  bool  // the last characters written are indentation, "-", "?" or ":"
+	indent     int   // the current indentation, -1 before the root node
+	indents    []int // the indentations of the enclosing nodes
+	flowLevel  int
+}
+
+// writeYAML writes a value returned by decodeYAML.
+func writeYAML(value any) (string, error) {
+	e := yamlEmitter{whitespace: true, indention: true, indent: -1}
+	if err := e.node(value, false, false); err != nil {
+		return "", err
+	}
+	e.writeIndent()
+
+	return e.out.String(), nil
+}
+
+// newScalar returns the scalar PyYAML's SafeRepresenter makes of value.
+func newScalar(value any) (scalar, error) {
+	var text string
+
+	switch v := value.(type) {
+	case string:
+		return scalar{text: []rune(v), plain: !implicit.MatchString(v)}, nil
+	case nil:
+		text = "null"
+	case bool:
+		text = strconv.FormatBool(v)
+	case *big.Int:
+		text = v.String()
+	case timestamp:
+		text = string(v)
+	case float64:
+		switch {
+		case math.IsNaN(v):
+			text = ".nan"
+		case math.IsInf(v, 1):
+			text = ".inf"
+		case math.IsInf(v, -1):
+			text = "-.inf"
+		default:
+			// the repr of 1e16 is 1e+16, which YAML 1.1 reads as a string
+			text = reprFloat(v)
+			if !strings.Contains(text, ".") {
+				text = strings.Replace(text, "e", ".0e", 1)
+			}
+		}
+	default:
+		return scalar{}, fmt.Errorf("cannot write %T as YAML", value)
+	}
+
+	return scalar{text: []rune(text), plain: true}, nil
+}
+
+// node writes a mapping, a sequence or a scalar, as a mapping key or value or as a sequence item.
+func (e *yamlEmitter) node(value any, inMapping, simpleKey bool) error {
+	switch v := value.(type) {
+	case mapping:
+		if len(v) == 0 {
+			e.emptyFlow("{", "}")
+			return nil
+		}
+		return e.blockMapping(v)
+	case []any:
+		if len(v) == 0 {
+			e.emptyFlow("[", "]")
+			return nil
+		}
+		return e.blockSequence(v, inMapping)
+	}
+
+	s, err := newScalar(value)
+	if err != nil {
+		return err
+	}
+	e.increaseIndent(true, false)
+	e.scalar(s, simpleKey)
+	e.popIndent()
+
+	return nil
+}
+
+// emptyFlow writes an empty collection in flow style.
+func (e *yamlEmitter) emptyFlow(open, close string) {
+	e.writeIndicator(open, true, true, false)
+	e.flowLevel++
+	e.increaseIndent(true, false)
+	e.popIndent()
+	e.flowLevel--
+	e.writeIndicator(close, false, false, false)
+}
+
+// blockSequence writes the items of a sequence, the value of a mapping key is not indented.
+func (e *yamlEmitter) blockSequence(items []any, inMapping bool) error {
+	e.increaseIndent(false, inMapping && !e.indention)
+	for _, item := range items {
+		e.writeIndent()
+		e.writeIndicator("-", true, false, true)
+		if err := e.node(item, false, false); err != nil {
+			return err
+		}
+	}
+	e.popIndent()
+
+	return nil
+}
+
+// blockMapping writes the keys and values of a mapping. Long and multiline keys are written as
+// complex keys, after "?".
+func (e *yamlEmitter) blockMapping(items mapping) error {
+	e.increaseIndent(false, false)
+	for _, item := range items {
+		e.writeIndent()
+		simple, err := simpleKey(item.key)
+		if err != nil {
+			return err
+		}
+
+		if simple {
+			if err := e.node(item.key, true, true); err != nil {
+				return err
+			}
+			e.writeIndicator(":", false, false, false)
+		} else {
+			e.writeIndicator("?", true, false, true)
+			if err := e.node(item.key, true, false); err != nil {
+				return err
+			}
+			e.writeIndent()
+			e.writeIndicator(":", true, false, true)
+		}
+
+		if err := e.node(item.value, true, false); err != nil {
+			return err
+		}
+	}
+	e.popIndent()
+
+	return nil
+}
+
+// simpleKey reports whether key fits on the line of its value.
+func simpleKey(key any) (bool, error) {
+	s, err := newScalar(key)
+	if err != nil {
+		return false, err
+	}
+	a := analyze(s.text)
+
+	return len(s.text) < 128 && !a.empty && !a.multiline, nil
+}
+
+// scalar writes a scalar in the style PyYAML's Emitter.choose_scalar_style picks.
+func (e *yamlEmitter) scalar(s scalar, simpleKey bool) {
+	a := analyze(s.text)
+	split := !simpleKey
+
+	allowPlain := a.allowBlockPlain
+	if e.flowLevel > 0 {
+		allowPlain = a.allowFlowPlain
+	}
+
+	switch {
+	case s.plain && !(simpleKey && (a.empty || a.multiline)) && allowPlain:
+		e.writePlain(s.text, split)
+	case a.allowSingleQuoted && !(simpleKey && a.multiline):
+		e.writeSingleQuoted(s.text, split)
+	default:
+		e.writeDoubleQuoted(s.text, split)
+	}
+}
+
+// isBreak reports whether ch is a line break.
+func isBreak(ch rune) bool {
+	return ch == '\n' || ch == 0x85 || ch == 0x2028 || ch == 0x2029
+}
+
+// isBlank reports whether ch is a whitespace or the end of the text, -1.
+func isBlank(ch rune) bool {
+	return ch == -1 || ch == 0 || ch == ' ' || ch == '\t' || ch == '\r' || isBreak(ch)
+}
+
+// at returns the character of text at i, or -1 past its end.
+func at(text []rune, i int) rune {
+	if i < len(text) {
+		return text[i]
+	}
+
+	return -1
+}
+
+// analyze returns the styles a scalar can be written in.
+func analyze(text []rune) analysis {
+	if len(text) == 0 {
+		return analysis{empty: true, allowBlockPlain: true, allowSingleQuoted: true}
+	}
+
+	var blockIndicators, flowIndicators, lineBreaks, specialCharacters bool
+	var leadingSpace, leadingBreak, trailingSpace, trailingBreak, breakSpace, spaceBreak bool
+
+	if s := string(text); strings.HasPrefix(s, "---") || strings.HasPrefix(s, "...") {
+		blockIndicators, flowIndicators = true, true
+	}
+
+	precededByWhitespace := true
+	followedByWhitespace := isBlank(at(text, 1))
+	previousSpace, previousBreak := false, false
+
+	for i, ch := range text {
+		if i == 0 {
+			if strings.ContainsRune("#,[]{}&*!|>'\"%@`", ch) {
+				flowIndicators, blockIndicators = true, true
+			}
+			if ch == '?' || ch == ':' {
+				flowIndicators = true
+				if followedByWhitespace {
+					blockIndicators = true
+				}
+			}
+			if ch == '-' && followedByWhitespace {
+				flowIndicators, blockIndicators = true, true
+			}
+		} else {
+			if strings.ContainsRune(",?[]{}", ch) {
+				flowIndicators = true
+			}
+			if ch == ':' {
+				flowIndicators = true
+				if followedByWhitespace {
+					blockIndicators = true
+				}
+			}
+			if ch == '#' && precededByWhitespace {
+				flowIndicators, blockIndicators = true, true
+			}
+		}
+
+		if isBreak(ch) {
+			lineBreaks = true
+		}
+		if ch != '\n' && (ch < 0x20 || ch > 0x7e) {
+			unicode := ch == 0x85 || ch >= 0xa0 && ch <= 0xd7ff || ch >= 0xe000 && ch <= 0xfffd || ch >= 0x10000 && ch < 0x10ffff
+			if !unicode || ch == 0xfeff {
+				specialCharacters = true
+			}
+		}
+
+		switch {
+		case ch == ' ':
+			leadingSpace = leadingSpace || i == 0
+			trailingSpace = trailingSpace || i == len(text)-1
+			breakSpace = breakSpace || previousBreak
+			previousSpace, previousBreak = true, false
+		case isBreak(ch):
+			leadingBreak = leadingBreak || i == 0
+			trailingBreak = trailingBreak || i == len(text)-1
+			spaceBreak = spaceBreak || previousSpace
+			previousSpace, previousBreak = false, true
+		default:
+			previousSpace, previousBreak = false, false
+		}
+
+		precededByWhitespace = isBlank(ch)
+		followedByWhitespace = isBlank(at(text, i+2))
+	}
+
+	a := analysis{
+		multiline:         lineBreaks,
+		allowFlowPlain:    true,
+		allowBlockPlain:   true,
+		allowSingleQuoted: true,
+		allowBlock:        true,
+	}
+	if leadingSpace || leadingBreak || trailingSpace || trailingBreak {
+		a.allowFlowPlain, a.allowBlockPlain = false, false
+	}
+	if trailingSpace {
+		a.allowBlock = false
+	}
+	if breakSpace {
+		a.allowFlowPlain, a.allowBlockPlain, a.allowSingleQuoted = false, false, false
+	}
+	if spaceBreak || specialCharacters {
+		a.allowFlowPlain, a.allowBlockPlain, a.allowSingleQuoted, a.allowBlock = false, false, false, false
+	}
+	if lineBreaks {
+		a.allowFlowPlain, a.allowBlockPlain = false, false
+	}
+	if flowIndicators {
+		a.allowFlowPlain = false
+	}
+	if blockIndicators {
+		a.allowBlockPlain = false
+	}
+
+	return a
+}
+
+// increaseIndent indents the next node, flow nodes and the root by yamlIndent, an indentless
+// sequence not at all.
+func (e *yamlEmitter) increaseIndent(flow, indentless bool) {
+	e.indents = append(e.indents, e.indent)
+	switch {
+	case e.indent < 0 && flow:
+		e.indent = yamlIndent
+	case e.indent < 0:
+		e.indent = 0
+	case !indentless:
+		e.indent += yamlIndent
+	}
+}
+
+// popIndent restores the indentation of the enclosing node.
+func (e *yamlEmitter) popIndent() {
+	e.indent = e.indents[len(e.indents)-1]
+	e.indents = e.indents[:len(e.indents)-1]
+}
+
+// write writes text that holds no line break.
+func (e *yamlEmitter) write(text string) {
+	e.column += len([]rune(text))
+	e.out.WriteString(text)
+}
+
+// writeIndicator writes an indicator, after a space when it needs one.
+func (e *yamlEmitter) writeIndicator(indicator string, needWhitespace, whitespace, indention bool) {
+	if !e.whitespace && needWhitespace {
+		indicator = " " + indicator
+	}
+	e.whitespace = whitespace
+	e.indention = e.indention && indention
+	e.write(indicator)
+}
+
+// writeIndent starts a new line unless the current one holds only indentation, and indents it.
+func (e *yamlEmitter) writeIndent() {
+	indent := max(e.indent, 0)
+	if !e.indention || e.column > indent || (e.column == indent && !e.whitespace) {
+		e.writeLineBreak(-1)
+	}
+	if e.column < indent {
+		e.whitespace = true
+		e.write(strings.Repeat(" ", indent-e.column))
+	}
+}
+
+// writeLineBreak writes br, or a newline for -1.
+func (e *yamlEmitter) writeLineBreak(br rune) {
+	if br == -1 {
+		br = '\n'
+	}
+	e.whitespace, e.indention = true, true
+	e.column = 0
+	e.out.WriteRune(br)
+}
+
+// writeBreaks writes the line breaks of text, a leading newline doubled, and indents the next line.
+func (e *yamlEmitter) writeBreaks(text []rune) {
+	if text[0] == '\n' {
+		e.writeLineBreak(-1)
+	}
+	for _, br := range text {
+		e.writeLineBreak(br)
+	}
+	e.writeIndent()
+}
+
+// writePlain writes a plain scalar, folded at a space past yamlWidth when split.
+func (e *yamlEmitter) writePlain(text []rune, split bool) {
+	if len(text) == 0 {
+		return
+	}
+	if !e.whitespace {
+		e.write(" ")
+	}
+	e.whitespace, e.indention = false, false
+
+	spaces, breaks := false, false
+	start := 0
+	for end := 0; end <= len(text); end++ {
+		ch := at(text, end)
+		switch {
+		case spaces:
+			if ch != ' ' {
+				if start+1 == end && e.column > yamlWidth && split {
+					e.writeIndent()
+					e.whitespace, e.indention = false, false
+				} else {
+					e.write(string(text[start:end]))
+				}
+				start = end
+			}
+		case breaks:
+			if !isBreak(ch) {
+				e.writeBreaks(text[start:end])
+				e.whitespace, e.indention = false, false
+				start = end
+			}
+		default:
+			if ch == -1 || ch == ' ' || isBreak(ch) {
+				e.write(string(text[start:end]))
+				start = end
+			}
+		}
+		if ch != -1 {
+			spaces, breaks = ch == ' ', isBreak(ch)
+		}
+	}
+}
+
+// writeSingleQuoted writes a single quoted scalar, quotes doubled, folded at a space past
+// yamlWidth when split.
+func (e *yamlEmitter) writeSingleQuoted(text []rune, split bool) {
+	e.writeIndicator("'", true, false, false)
+
+	spaces, breaks := false, false
+	start := 0
+	for end := 0; end <= len(text); end++ {
+		ch := at(text, end)
+		switch {
+		case spaces:
+			if ch != ' ' {
+				if start+1 == end && e.column > yamlWidth && split && start != 0 && end != len(text) {
+					e.writeIndent()
+				} else {
+					e.write(string(text[start:end]))
+				}
+				start = end
+			}
+		case breaks:
+			if !isBreak(ch) {
+				e.writeBreaks(text[start:end])
+				start = end
+			}
+		default:
+			if (ch == -1 || ch == ' ' || isBreak(ch) || ch == '\'') && start < end {
+				e.write(string(text[start:end]))
+				start = end
+			}
+		}
+		if ch == '\'' {
+			e.write("''")
+			start = end + 1
+		}
+		if ch != -1 {
+			spaces, breaks = ch == ' ', isBreak(ch)
+		}
+	}
+
+	e.writeIndicator("'", false, false, false)
+}
+
+// writeDoubleQuoted writes a double quoted scalar with escapes, folded with a backslash past
+// yamlWidth when split.
+func (e *yamlEmitter) writeDoubleQuoted(text []rune, split bool) {
+	e.writeIndicator("\"", true, false, false)
+
+	start := 0
+	for end := 0; end <= len(text); end++ {
+		ch := at(text, end)
+		printable := ch >= 0x20 && ch <= 0x7e || ch >= 0xa0 && ch <= 0xd7ff || ch >= 0xe000 && ch <= 0xfffd
+		if ch == -1 || strings.ContainsRune("\"\\\u0085\u2028\u2029\ufeff", ch) || !printable {
+			if start < end {
+				e.write(string(text[start:end]))
+				start = end
+			}
+			if ch != -1 {
+				escape, ok := yamlEscapes[ch]
+				switch {
+				case ok:
+					escape = "\\" + escape
+				case ch <= 0xff:
+					escape = fmt.Sprintf("\\x%02X", ch)
+				case ch <= 0xffff:
+					escape = fmt.Sprintf("\\u%04X", ch)
+				default:
+					escape = fmt.Sprintf("\\U%08X", ch)
+				}
+				e.write(escape)
+				start = end + 1
+			}
+		}
+
+		if end > 0 && end < len(text)-1 && (ch == ' ' || start >= end) && e.column+(end-start) > yamlWidth && split {
+			data := "\\"
+			if start < end {
+				data = string(text[start:end]) + data
+				start = end
+			}
+			e.write(data)
+			e.writeIndent()
+			e.whitespace, e.indention = false, false
+			if text[start] == ' ' {
+				e.write("\\")
+			}
+		}
+	}
+
+	e.writeIndicator("\"", false, false, false)
+}
@@ -0,0 +1,61 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Handler is a command patches trigger with notify. A notified handler runs once, after all
+// selected patches are written or reverted, however many patches notify it.
+type Handler struct {
+	Name    string // Name used in notify, "<unit>" stands for a systemd unit, e.g. "restart sshd"
+	Command string // Command run, "<unit>" is replaced by the unit
+}
+
+var (
+	// Handlers are the handlers patches can notify, in the order they run: systemd learns about
+	// new units before udev rules and kernel parameters are reloaded, services are restarted last.
+	// Handlers of units run in the order the units were first notified.
+	Handlers = []Handler{
+		{Name: "systemd daemon-reload", Command: "systemctl daemon-reload"},
+		{Name: "udev reload", Command: "udevadm control --reload && udevadm trigger"},
+		{Name: "sysctl reload", Command: "sysctl --system"},
+		{Name: "reload <unit>", Command: "systemctl reload <unit>"},
+		{Name: "restart <unit>", Command: "systemctl restart <unit>"},
+	}
+
+	// validUnit matches the systemd units of handlers, with or without their suffix.
+	validUnit = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9@_.:-]*$`)
+)
+
+// HandlerCommand returns the command of a notified handler, e.g. "systemctl restart sshd" for
+// "restart sshd", and its position in Handlers, which orders the handlers of a run.
+func HandlerCommand(name string) (command string, rank int, err error) {
+	for rank, handler := range Handlers {
+		prefix, generic := strings.CutSuffix(handler.Name, "<unit>")
+		if !generic {
+			if name == handler.Name {
+				return handler.Command, rank, nil
+			}
+			continue
+		}
+
+		unit, found := strings.CutPrefix(name, prefix)
+		if !found {
+			continue
+		}
+		if !validUnit.MatchString(unit) {
+			return "", 0, fmt.Errorf("handler %q: %q is not a systemd unit", name, unit)
+		}
+
+		return strings.ReplaceAll(handler.Command, "<unit>", unit), rank, nil
+	}
+
+	names := make([]string, 0, len(Handlers))
+	for _, handler := range Handlers {
+		names = append(names, handler.Name)
+	}
+
+	return "", 0, fmt.Errorf("handler %q must be one of %s", name, strings.Join(names, ", "))
+}
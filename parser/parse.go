@@ -2,26 +2,263 @@
 package parser
 
 import (
+	"fmt"
+	"path"
+	"strings"
+
 	"gopkg.in/yaml.v2"
 )
 
+const (
+	// SystemdUnitDir is the directory units of the systemd kind are installed to.
+	SystemdUnitDir = "/etc/systemd/system"
+)
+
 // Patch represents a patch definition parsed from a YAML file.
 //
 //go:generate easytags $GOFILE yaml:camel
 type Patch struct {
-	Output           string   `yaml:"output"`           // Target file path where patch will be applied
-	Mode             string   `yaml:"mode"`             // Write mode: "overwrite" or "append"
-	Body             string   `yaml:"body"`             // Content to write to the target file
-	CommandsAfter    []string `yaml:"commandsAfter"`    // Commands to execute after applying the patch
-	CommentCharacter string   `yaml:"commentCharacter"` // Character used for comments in target file
-	Categories       []string `yaml:"categories"`       // List of categories this patch belongs to
-	Description      string   `yaml:"description"`      // Human-readable description of the patch
+	Kind                 string      `yaml:"kind"`                 // Patch kind: "file" (default), "systemd" or "sysctl"
+	Output               string      `yaml:"output"`               // Target file path where patch will be applied
+	Mode                 string      `yaml:"mode"`                 // Write mode: "overwrite", "append", "diff", "lines" or "merge"
+	Body                 string      `yaml:"body"`                 // Content to write to the target file, a unified diff in diff mode, the fragment in merge mode
+	Rules                []Rule      `yaml:"rules"`                // Line rules of lines mode, applied in order to every line
+	Format               string      `yaml:"format"`               // Format of the target in merge mode: "json", "yaml", "ini" or "toml"
+	CommandsBefore       []string    `yaml:"commandsBefore"`       // Commands to execute before applying the patch, a failure skips it
+	CommandsAfter        []string    `yaml:"commandsAfter"`        // Commands to execute after applying the patch
+	CommandsBeforeRevert []string    `yaml:"commandsBeforeRevert"` // Commands to execute before reverting the patch, a failure skips it
+	CommandsAfterRevert  []string    `yaml:"commandsAfterRevert"`  // Commands to execute after reverting the patch, e.g. to undo side effects of CommandsAfter
+	Notify               []string    `yaml:"notify"`               // Handlers run once after all selected patches are written or reverted, e.g. "restart sshd"
+	Verify               []Assertion `yaml:"verify"`               // Assertions run after all patches and handlers, checking the patch took effect
+	Risky                bool        `yaml:"risky"`                // The patch can lock the operator out, e.g. over SSH, and is reverted after a while unless confirmed
+	Risk                 string      `yaml:"risk"`                 // Risk level: "low" (default), "medium" or "high", high-risk patches are left out of all unless confirmed
+	CommentCharacter     string      `yaml:"commentCharacter"`     // Character used for comments in target file
+	Categories           []string    `yaml:"categories"`           // List of categories this patch belongs to
+	Description          string      `yaml:"description"`          // Human-readable description of the patch
+	Unit                 *Unit       `yaml:"unit"`                 // Unit installed by the systemd kind, the body is the unit file
+	Sysctl               Sysctl      `yaml:"sysctl"`               // Kernel parameters of the sysctl kind, the body is generated from them
+	Values               Values      `yaml:"values"`               // Values computed on the host from its facts, used in the body as %{name}
+}
+
+// RiskLevel returns the risk level of the patch, "low" when none is declared.
+func (patch *Patch) RiskLevel() string {
+	if patch.Risk == "" {
+		return "low"
+	}
+
+	return patch.Risk
+}
+
+// Sysctl is the map of kernel parameters of the sysctl kind, in the order of the YAML file.
+type Sysctl []SysctlKey
+
+// SysctlKey is a kernel parameter with the value it is set to.
+type SysctlKey struct {
+	Key   string // Parameter name, e.g. "net.ipv4.tcp_sack"
+	Value string // Value as written to /proc/sys, e.g. "4096 262144 16777216"
+}
+
+// UnmarshalYAML reads a mapping of parameter names to values, keeping their order.
+func (sysctl *Sysctl) UnmarshalYAML(unmarshal func(any) error) error {
+	var items yaml.MapSlice
+	err := unmarshal(&items)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		*sysctl = append(*sysctl, SysctlKey{Key: fmt.Sprint(item.Key), Value: scalar(item.Value)})
+	}
+
+	return nil
+}
+
+// Body returns the sysctl.conf lines that set the parameters.
+func (sysctl Sysctl) Body() string {
+	lines := make([]string, 0, len(sysctl))
+	for _, key := range sysctl {
+		lines = append(lines, key.Key+" = "+key.Value)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Values are the values of a patch, in the order of the YAML file, so a value can use earlier ones.
+type Values []Value
+
+// Value is an integer computed on the host when the patch is applied. Expressions are bash
+// arithmetic over the host facts and earlier values, see the values package.
+type Value struct {
+	Name string // Name used in the body as %{name}
+	Expr string // Expression computing the value, e.g. "mem_gb * 65536"
+	Min  string // Optional expression the value is raised to when it is smaller
+	Max  string // Optional expression the value is lowered to when it is larger
+}
+
+// UnmarshalYAML reads a mapping of value names to an expression or to a mapping with the keys
+// expr, min and max, keeping their order.
+func (values *Values) UnmarshalYAML(unmarshal func(any) error) error {
+	var items yaml.MapSlice
+	err := unmarshal(&items)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		value := Value{Name: fmt.Sprint(item.Key)}
+
+		fields, ok := item.Value.(yaml.MapSlice)
+		if !ok {
+			value.Expr = scalar(item.Value)
+			*values = append(*values, value)
+			continue
+		}
+
+		for _, field := range fields {
+			switch fmt.Sprint(field.Key) {
+			case "expr":
+				value.Expr = scalar(field.Value)
+			case "min":
+				value.Min = scalar(field.Value)
+			case "max":
+				value.Max = scalar(field.Value)
+			default:
+				return fmt.Errorf("value %q: unknown field %q, use expr, min and max", value.Name, fmt.Sprint(field.Key))
+			}
+		}
+		*values = append(*values, value)
+	}
+
+	return nil
+}
+
+// scalar returns a YAML scalar as a string, empty for null.
+func scalar(v any) string {
+	if v == nil {
+		return ""
+	}
+
+	return fmt.Sprint(v)
+}
+
+// Assertion checks that a patch took effect, e.g. that the running kernel uses a parameter. It
+// passes when the command exits with 0 and, when set, its output without trailing newlines equals
+// Equals or contains Contains. Stderr of the command is not compared.
+type Assertion struct {
+	Command  string `yaml:"command"`  // Shell command, e.g. "sysctl -n net.ipv4.tcp_congestion_control"
+	Equals   string `yaml:"equals"`   // Output the command must print, e.g. "bbr"
+	Contains string `yaml:"contains"` // Text the output of the command must contain, e.g. "[none]"
+}
+
+// UnmarshalYAML reads an assertion as a command, which must exit with 0, or as a mapping with the
+// keys command, equals and contains.
+func (assertion *Assertion) UnmarshalYAML(unmarshal func(any) error) error {
+	var command string
+	if err := unmarshal(&command); err == nil {
+		assertion.Command = command
+		return nil
+	}
+
+	var fields yaml.MapSlice
+	err := unmarshal(&fields)
+	if err != nil {
+		return err
+	}
+
+	for _, field := range fields {
+		switch fmt.Sprint(field.Key) {
+		case "command":
+			assertion.Command = scalar(field.Value)
+		case "equals":
+			assertion.Equals = scalar(field.Value)
+		case "contains":
+			assertion.Contains = scalar(field.Value)
+		default:
+			return fmt.Errorf("verify: unknown field %q, use command, equals and contains", fmt.Sprint(field.Key))
+		}
+	}
+
+	return nil
+}
+
+// String returns the assertion in one line, e.g. "sysctl -n net.ipv4.tcp_congestion_control == bbr".
+func (assertion Assertion) String() string {
+	switch {
+	case assertion.Equals != "":
+		return assertion.Command + " == " + assertion.Equals
+	case assertion.Contains != "":
+		return assertion.Command + " contains " + assertion.Contains
+	}
+
+	return assertion.Command
+}
+
+// Rule is a line rule of lines mode. Lines matching the POSIX extended regular expression are
+// replaced by Line (present), removed (absent) or commented out (commented). A present Line that no
+// line matches is appended at the end, and only the first match is kept.
+type Rule struct {
+	Match string `yaml:"match"` // POSIX extended regular expression matched against every line
+	Line  string `yaml:"line"`  // Line that must be present, must match Match
+	State string `yaml:"state"` // "present" (default), "absent" or "commented"
+}
+
+// Unit describes the systemd unit of a patch of the systemd kind.
+type Unit struct {
+	Name   string `yaml:"name"`   // Unit file name, e.g. "autotune.service"
+	Enable bool   `yaml:"enable"` // Enable the unit, or its timer, at boot
+	Start  bool   `yaml:"start"`  // Start the unit, or its timer, right away, restarting it when it runs
+	Timer  string `yaml:"timer"`  // Body of an optional timer unit installed next to the unit
+}
+
+// Path returns the path the unit file is installed to.
+func (unit *Unit) Path() string {
+	return path.Join(SystemdUnitDir, unit.Name)
+}
+
+// TimerName returns the name of the unit's timer, e.g. "autotune.timer" for "autotune.service".
+func (unit *Unit) TimerName() string {
+	return strings.TrimSuffix(unit.Name, path.Ext(unit.Name)) + ".timer"
+}
+
+// TimerPath returns the path the timer unit file is installed to.
+func (unit *Unit) TimerPath() string {
+	return path.Join(SystemdUnitDir, unit.TimerName())
 }
 
 // parse unmarshals YAML content into a Patch structure.
 // It takes raw YAML bytes and returns a parsed Patch struct or an error if parsing fails.
+// A patch of the systemd kind gets the unit file as its output, overwrite mode and '#' comments,
+// so it is written, backed up, checked and reverted like any other file. A patch of the sysctl kind
+// gets overwrite mode, '#' comments and its parameters as the body.
 func parse(body []byte) (patch *Patch, err error) {
 	err = yaml.Unmarshal(body, &patch)
+	if err != nil || patch == nil {
+		return
+	}
+
+	if patch.Kind == "systemd" && patch.Unit != nil {
+		if patch.Output == "" {
+			patch.Output = patch.Unit.Path()
+		}
+		if patch.Mode == "" {
+			patch.Mode = "overwrite"
+		}
+		if patch.CommentCharacter == "" {
+			patch.CommentCharacter = "#"
+		}
+	}
+
+	if patch.Kind == "sysctl" {
+		if patch.Mode == "" {
+			patch.Mode = "overwrite"
+		}
+		if patch.CommentCharacter == "" {
+			patch.CommentCharacter = "#"
+		}
+		if patch.Body == "" {
+			patch.Body = patch.Sysctl.Body()
+		}
+	}
 
 	return
 }
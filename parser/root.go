@@ -2,12 +2,10 @@
 package parser
 
 import (
-	"context"
-	"embed"
+	"errors"
 	"io/fs"
-	"path/filepath"
+	"path"
 	"strings"
-	"time"
 
 	"go.uber.org/zap"
 )
@@ -30,79 +28,99 @@ type Result struct {
 	Patch   *Patch  // Parsed patch definition
 }
 
-// Run parses all YAML patch files from the embedded filesystem and returns channels for errors and results.
-// It reads all files from the patches directory, parses each one in a goroutine, and sends parsed results
-// or errors through the respective channels. The function waits for all files to be processed before canceling the context.
-func Run(log *zap.Logger, cancel *context.CancelFunc, content embed.FS) (errors chan *Error, results chan *Result) {
-	var res []fs.DirEntry
-	errors = make(chan *Error, 100)
-	results = make(chan *Result, 100)
+// ShortName returns the part of the patch name before the first underscore. Patches sharing
+// a short name, like limits_1 and limits_2, are selected together.
+func (r *Result) ShortName() string {
+	return strings.Split(r.Name, "_")[0]
+}
+
+// Load parses all YAML patch files from the patches directory of the given filesystem and returns
+// the parsed results and the errors. Files are processed in directory order, synchronously.
+func Load(log *zap.Logger, content fs.FS) (results []*Result, errors []*Error) {
+	return LoadDir(log, content, patchesDir)
+}
 
-	res, err := content.ReadDir(patchesDir)
+// LoadDir parses all YAML patch files from a directory of the given filesystem, like Load.
+func LoadDir(log *zap.Logger, content fs.FS, dir string) (results []*Result, errors []*Error) {
+	res, err := fs.ReadDir(content, dir)
 	if err != nil {
 		e := Error{
 			Error:   err,
-			FileLoc: nil,
+			FileLoc: &dir,
 		}
-		errors <- &e
+		errors = append(errors, &e)
 		return
 	}
 
-	go func() {
-		for _, entry := range res {
-			fileLoc := filepath.Join(patchesDir, entry.Name())
-			fileName := filepath.Base(entry.Name())
-			fileName = strings.Split(fileName, ".")[0]
-
-			logger := log.WithOptions(zap.Fields(
-				zap.String("fileLoc", fileLoc),
-			))
-			logger.Debug("attempt to parse file")
-
-			body, err := content.ReadFile(fileLoc)
-			if err != nil {
-				logger.Error("error in reading",
-					zap.Error(err),
-				)
-
-				e := Error{
-					Error:   err,
-					FileLoc: &fileLoc,
-				}
-				errors <- &e
-				continue
-			}
-
-			patch, err := parse(body)
-			if err != nil {
-				logger.Error("error in parsing",
-					zap.Error(err),
-				)
-
-				e := Error{
-					Error:   err,
-					FileLoc: &fileLoc,
-				}
-				errors <- &e
-				continue
-			}
-
-			r := Result{
-				Name:    fileName,
-				FileLoc: &fileLoc,
-				Patch:   patch,
-			}
-
-			logger.Info("successfully parsed file")
-			results <- &r
+	for _, entry := range res {
+		if !isPatchFile(entry) {
+			continue
 		}
 
-		// wait until all processed
-		for len(results) > 0 {
-			time.Sleep(100 * time.Millisecond)
+		r, e := loadFile(log, content, dir, entry)
+		if e != nil {
+			errors = append(errors, e)
+			continue
 		}
-		(*cancel)()
-	}()
+		results = append(results, r)
+	}
 
 	return
 }
+
+// isPatchFile reports whether a directory entry is a patch definition. Disabled patches
+// (e.g. "initial_window_1.yaml.disabled") and subdirectories are skipped.
+func isPatchFile(entry fs.DirEntry) bool {
+	return !entry.IsDir() && path.Ext(entry.Name()) == ".yaml"
+}
+
+// loadFile reads and parses a single patch file from a directory.
+// The patch name is the file name up to the first dot.
+func loadFile(log *zap.Logger, content fs.FS, dir string, entry fs.DirEntry) (*Result, *Error) {
+	fileLoc := path.Join(dir, entry.Name())
+	fileName := path.Base(entry.Name())
+	fileName = strings.Split(fileName, ".")[0]
+
+	logger := log.WithOptions(zap.Fields(
+		zap.String("fileLoc", fileLoc),
+	))
+	logger.Debug("attempt to parse file")
+
+	body, err := fs.ReadFile(content, fileLoc)
+	if err != nil {
+		logger.Error("error in reading",
+			zap.Error(err),
+		)
+
+		e := Error{
+			Error:   err,
+			FileLoc: &fileLoc,
+		}
+		return nil, &e
+	}
+
+	patch, err := parse(body)
+	if err == nil && patch == nil {
+		err = errors.New("empty patch definition")
+	}
+	if err != nil {
+		logger.Error("error in parsing",
+			zap.Error(err),
+		)
+
+		e := Error{
+			Error:   err,
+			FileLoc: &fileLoc,
+		}
+		return nil, &e
+	}
+
+	r := Result{
+		Name:    fileName,
+		FileLoc: &fileLoc,
+		Patch:   patch,
+	}
+
+	logger.Debug("successfully parsed file")
+	return &r, nil
+}
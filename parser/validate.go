@@ -0,0 +1,260 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"patchfiles/merge"
+	"patchfiles/textdiff"
+	"patchfiles/values"
+)
+
+var (
+	// modes are the supported write modes of a patch.
+	modes = []string{"overwrite", "append", "diff", "lines", "merge"}
+	// states are the supported states of a line rule, empty is the same as "present".
+	states = []string{"", "present", "absent", "commented"}
+	// kinds are the supported patch kinds, empty is the same as "file".
+	kinds = []string{"", "file", "systemd", "sysctl"}
+	// risks are the supported risk levels, empty is the same as "low".
+	risks = []string{"", "low", "medium", "high"}
+	// validUnitName matches unit names of the systemd kind, timers are declared with the timer field.
+	validUnitName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9@_.:-]*\.(service|socket|path|mount|target)$`)
+	// validSysctlKey matches kernel parameter names, separated by dots or slashes.
+	validSysctlKey = regexp.MustCompile(`^[A-Za-z0-9_-]+([./][A-Za-z0-9_:@.-]+)+$`)
+	// validName matches patch names that can be used as selectors in the generated scripts.
+	validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+)
+
+// Validate checks a parsed patch for problems that would produce a broken script and returns all of them.
+func (r *Result) Validate() (errs []error) {
+	if !validName.MatchString(r.Name) {
+		errs = append(errs, fmt.Errorf("name %q must contain only letters, digits, '_', '.' and '-'", r.Name))
+	}
+
+	return append(errs, r.Patch.Validate()...)
+}
+
+// Validate checks a patch definition for missing or invalid fields and returns all problems found.
+func (patch *Patch) Validate() (errs []error) {
+	switch {
+	case patch.Output == "":
+		errs = append(errs, errors.New("output is required"))
+	case !path.IsAbs(patch.Output):
+		errs = append(errs, fmt.Errorf("output %q must be an absolute path", patch.Output))
+	}
+
+	valid := false
+	for _, mode := range modes {
+		valid = valid || patch.Mode == mode
+	}
+	if !valid {
+		errs = append(errs, fmt.Errorf("mode %q must be one of %v", patch.Mode, modes))
+	}
+
+	if !slices.Contains(risks, patch.Risk) {
+		errs = append(errs, fmt.Errorf("risk %q must be one of low, medium and high", patch.Risk))
+	}
+
+	if patch.Mode == "append" && patch.CommentCharacter == "" {
+		errs = append(errs, errors.New("commentCharacter is required in append mode"))
+	}
+
+	errs = append(errs, patch.validateValues()...)
+
+	for i, name := range patch.Notify {
+		if _, _, err := HandlerCommand(name); err != nil {
+			errs = append(errs, fmt.Errorf("notify: %w", err))
+		}
+		if slices.Contains(patch.Notify[:i], name) {
+			errs = append(errs, fmt.Errorf("notify: handler %q is listed twice", name))
+		}
+	}
+
+	for i, assertion := range patch.Verify {
+		switch {
+		case strings.TrimSpace(assertion.Command) == "":
+			errs = append(errs, fmt.Errorf("verify: assertion %d needs a command", i+1))
+		case assertion.Equals != "" && assertion.Contains != "":
+			errs = append(errs, fmt.Errorf("verify: assertion %q has both equals and contains", assertion.Command))
+		}
+	}
+
+	if patch.Mode == "lines" {
+		return append(errs, patch.validateRules()...)
+	}
+	if len(patch.Rules) > 0 {
+		errs = append(errs, errors.New("rules are only used in lines mode"))
+	}
+
+	if patch.Mode != "merge" && patch.Format != "" {
+		errs = append(errs, errors.New("format is only used in merge mode"))
+	}
+
+	switch {
+	case patch.Body == "":
+		errs = append(errs, errors.New("body is required"))
+	case patch.Mode == "diff":
+		if err := textdiff.Check(patch.Body); err != nil {
+			errs = append(errs, fmt.Errorf("body: %w", err))
+		}
+	case patch.Mode == "merge" && !slices.Contains(merge.Formats, patch.Format):
+		errs = append(errs, fmt.Errorf("format %q must be one of %v in merge mode", patch.Format, merge.Formats))
+	case patch.Mode == "merge":
+		if err := merge.Check(patch.Format, patch.Body); err != nil {
+			errs = append(errs, fmt.Errorf("body: %w", err))
+		}
+	}
+
+	return append(errs, patch.validateKind()...)
+}
+
+// validateRules checks the rules of lines mode, which take the place of the body.
+func (patch *Patch) validateRules() (errs []error) {
+	if patch.Body != "" {
+		errs = append(errs, errors.New("body is not used in lines mode, declare rules instead"))
+	}
+	if len(patch.Rules) == 0 {
+		errs = append(errs, errors.New("rules are required in lines mode"))
+	}
+
+	for i, rule := range patch.Rules {
+		if !slices.Contains(states, rule.State) {
+			errs = append(errs, fmt.Errorf("rule %d: state %q must be one of %v", i+1, rule.State, states[1:]))
+			continue
+		}
+
+		match, err := regexp.CompilePOSIX(rule.Match)
+		switch {
+		case rule.Match == "":
+			errs = append(errs, fmt.Errorf("rule %d: match is required", i+1))
+		case err != nil:
+			errs = append(errs, fmt.Errorf("rule %d: match must be a POSIX extended regular expression: %w", i+1, err))
+		case (rule.State == "" || rule.State == "present") && !match.MatchString(rule.Line):
+			// a line that its own rule does not match would be appended again on every run
+			errs = append(errs, fmt.Errorf("rule %d: line %q must match %q", i+1, rule.Line, rule.Match))
+		case rule.State == "commented" && patch.CommentCharacter == "":
+			errs = append(errs, fmt.Errorf("rule %d: commentCharacter is required to comment lines out", i+1))
+		}
+		if strings.Contains(rule.Line, "\n") {
+			errs = append(errs, fmt.Errorf("rule %d: line must be a single line", i+1))
+		}
+	}
+
+	return
+}
+
+// validateValues checks the names and expressions of the values and that the body uses no
+// undeclared ones. Values are rendered into the whole payload, so they are limited to the modes
+// that write it as it is.
+func (patch *Patch) validateValues() (errs []error) {
+	if len(patch.Values) == 0 {
+		return
+	}
+	if patch.Mode != "overwrite" && patch.Mode != "append" {
+		errs = append(errs, fmt.Errorf("values are only used in overwrite and append mode, not in %s mode", patch.Mode))
+	}
+
+	var known []string
+	for _, value := range patch.Values {
+		switch {
+		case !values.ValidName(value.Name):
+			errs = append(errs, fmt.Errorf("value %q: name must be lower case letters, digits and '_', starting with a letter", value.Name))
+			continue
+		case values.IsFact(value.Name):
+			errs = append(errs, fmt.Errorf("value %q: name is taken by a fact", value.Name))
+		case slices.Contains(known, value.Name):
+			errs = append(errs, fmt.Errorf("value %q is declared twice", value.Name))
+		case value.Expr == "":
+			errs = append(errs, fmt.Errorf("value %q: expr is required", value.Name))
+		}
+
+		for _, field := range []struct{ name, expr string }{{"expr", value.Expr}, {"min", value.Min}, {"max", value.Max}} {
+			if field.expr == "" {
+				continue
+			}
+			if err := values.Check(field.expr, known); err != nil {
+				errs = append(errs, fmt.Errorf("value %q: %s: %w", value.Name, field.name, err))
+			}
+		}
+		known = append(known, value.Name)
+	}
+
+	for _, name := range values.Names(patch.Body) {
+		if !slices.Contains(known, name) {
+			errs = append(errs, fmt.Errorf("body uses %%{%s}, which is not a declared value", name))
+		}
+	}
+
+	return
+}
+
+// validateKind checks the fields that belong to the patch kind.
+func (patch *Patch) validateKind() (errs []error) {
+	if !slices.Contains(kinds, patch.Kind) {
+		return append(errs, fmt.Errorf("kind %q must be one of %v", patch.Kind, kinds[1:]))
+	}
+
+	if patch.Kind != "sysctl" && len(patch.Sysctl) > 0 {
+		errs = append(errs, errors.New("sysctl is only used by the sysctl kind"))
+	}
+	if patch.Kind == "sysctl" {
+		return append(errs, patch.validateSysctl()...)
+	}
+
+	if patch.Kind != "systemd" {
+		if patch.Unit != nil {
+			errs = append(errs, errors.New("unit is only used by the systemd kind"))
+		}
+		return
+	}
+
+	switch {
+	case patch.Unit == nil:
+		errs = append(errs, errors.New("unit is required by the systemd kind"))
+	case !validUnitName.MatchString(patch.Unit.Name):
+		errs = append(errs, fmt.Errorf("unit name %q must be a service, socket, path, mount or target unit", patch.Unit.Name))
+	case patch.Output != patch.Unit.Path():
+		errs = append(errs, fmt.Errorf("output %q must be empty or %q for the systemd kind", patch.Output, patch.Unit.Path()))
+	}
+
+	if patch.Mode != "overwrite" {
+		errs = append(errs, fmt.Errorf("mode %q must be overwrite for the systemd kind", patch.Mode))
+	}
+
+	return
+}
+
+// validateSysctl checks the parameters of the sysctl kind, which take the place of the body.
+func (patch *Patch) validateSysctl() (errs []error) {
+	if len(patch.Sysctl) == 0 {
+		errs = append(errs, errors.New("sysctl is required by the sysctl kind"))
+	}
+	if patch.Body != patch.Sysctl.Body() {
+		errs = append(errs, errors.New("body is generated from sysctl for the sysctl kind, leave it empty"))
+	}
+	if patch.Mode != "overwrite" {
+		errs = append(errs, fmt.Errorf("mode %q must be overwrite for the sysctl kind", patch.Mode))
+	}
+
+	seen := make(map[string]bool)
+	for _, key := range patch.Sysctl {
+		switch {
+		case !validSysctlKey.MatchString(key.Key):
+			errs = append(errs, fmt.Errorf("sysctl key %q must be a kernel parameter like net.ipv4.tcp_sack", key.Key))
+		case seen[key.Key]:
+			errs = append(errs, fmt.Errorf("sysctl key %q is set twice", key.Key))
+		case key.Value == "":
+			errs = append(errs, fmt.Errorf("sysctl key %q needs a value", key.Key))
+		case strings.ContainsAny(key.Value, "\t\n\r"):
+			errs = append(errs, fmt.Errorf("sysctl key %q: value must be a single line without tabs, separate numbers with spaces", key.Key))
+		}
+		seen[key.Key] = true
+	}
+
+	return
+}
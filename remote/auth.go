@@ -0,0 +1,100 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	// defaultIdentities are the private keys in ~/.ssh tried when no identity file is given.
+	defaultIdentities = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+)
+
+// AuthOptions selects how the runner authenticates and verifies hosts.
+type AuthOptions struct {
+	Identities     []string      // Private key files, ~/.ssh/id_* when empty
+	KnownHosts     string        // known_hosts file, ~/.ssh/known_hosts when empty
+	InsecureHosts  bool          // Accept any host key, for throwaway test machines only
+	ConnectTimeout time.Duration // Time limit for establishing a connection
+}
+
+// ClientConfig returns an SSH client configuration that authenticates with the running ssh-agent
+// and the identity files, and checks host keys against the known_hosts file. The returned function
+// closes the connection to the ssh-agent, call it once the connections are done.
+func ClientConfig(options AuthOptions) (config *ssh.ClientConfig, closeAgent func(), err error) {
+	home, _ := os.UserHomeDir()
+
+	closeAgent = func() {}
+	methods := make([]ssh.AuthMethod, 0)
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		conn, dialErr := net.Dial("unix", socket)
+		if dialErr == nil {
+			closeAgent = func() { conn.Close() }
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	defer func() {
+		if err != nil {
+			closeAgent()
+		}
+	}()
+
+	identities := options.Identities
+	explicit := len(identities) > 0
+	if !explicit {
+		for _, name := range defaultIdentities {
+			identities = append(identities, filepath.Join(home, ".ssh", name))
+		}
+	}
+
+	signers := make([]ssh.Signer, 0)
+	for _, fileLoc := range identities {
+		body, err := os.ReadFile(fileLoc)
+		if errors.Is(err, os.ErrNotExist) && !explicit {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		signer, err := ssh.ParsePrivateKey(body)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", fileLoc, err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	if len(methods) == 0 {
+		return nil, nil, errors.New("no ssh-agent and no identity file found")
+	}
+
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if !options.InsecureHosts {
+		knownHosts := options.KnownHosts
+		if knownHosts == "" {
+			knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+		}
+
+		hostKeyCallback, err = knownhosts.New(knownHosts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading known hosts: %w", err)
+		}
+	}
+
+	config = &ssh.ClientConfig{
+		Auth:            methods,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         options.ConnectTimeout,
+	}
+	return config, closeAgent, nil
+}
@@ -0,0 +1,273 @@
+// Package remote runs generated scripts on many hosts over SSH, the way
+// "ssh host 'bash -s' < patch.sh" does, and collects the result of every host.
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"patchfiles/generator"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// validVarName matches environment variable names that can be passed to the remote script.
+	validVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// Host is a single SSH target.
+type Host struct {
+	Name string // Host as written in the hosts file, used in the report
+	User string // Login user
+	Addr string // Address with port to dial
+}
+
+// Result is the outcome of running the script on one host.
+type Result struct {
+	Host     string        `json:"host" yaml:"host"`                       // Host as written in the hosts file
+	ExitCode int           `json:"exitCode" yaml:"exitCode"`               // Exit code of the script, -1 when it did not finish
+	Output   string        `json:"output" yaml:"output"`                   // Combined stdout and stderr of the script
+	Error    string        `json:"error,omitempty" yaml:"error,omitempty"` // Connection or session error
+	Duration time.Duration `json:"duration" yaml:"duration"`               // Time spent on the host
+}
+
+// Failed reports whether the script did not run or exited with a non-zero code.
+func (r *Result) Failed() bool {
+	return r.Error != "" || r.ExitCode != 0
+}
+
+// Runner streams a script to hosts over SSH with bounded concurrency.
+type Runner struct {
+	Log         *zap.Logger       // Logger instance for logging operations
+	Config      *ssh.ClientConfig // Authentication and host key checking, the user is set per host
+	Concurrency int               // Number of hosts worked on at the same time, 1 when not positive
+	Timeout     time.Duration     // Time limit per host, no limit when zero
+	Sudo        bool              // Run the script with "sudo -n" for non-root logins
+}
+
+// ParseHosts reads a hosts file with one "[user@]host[:port]" per line. Empty lines and lines
+// starting with # are skipped. Hosts without user or port get the given defaults.
+func ParseHosts(r io.Reader, user string, port int) (hosts []Host, err error) {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.Trim(scanner.Text(), " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		host := Host{
+			Name: line,
+			User: user,
+		}
+
+		address := line
+		if at := strings.LastIndex(address, "@"); at >= 0 {
+			host.User = address[:at]
+			address = address[at+1:]
+		}
+
+		hostname, portText, splitErr := net.SplitHostPort(address)
+		if splitErr != nil {
+			hostname, portText = strings.Trim(address, "[]"), strconv.Itoa(port)
+		}
+		if hostname == "" || strings.ContainsAny(hostname, " \t") {
+			return nil, fmt.Errorf("line %d: invalid host %q", n, line)
+		}
+		if _, convErr := strconv.Atoi(portText); convErr != nil {
+			return nil, fmt.Errorf("line %d: invalid port in %q", n, line)
+		}
+		if host.User == "" {
+			return nil, fmt.Errorf("line %d: no user for %q", n, line)
+		}
+
+		host.Addr = net.JoinHostPort(hostname, portText)
+		hosts = append(hosts, host)
+	}
+
+	err = scanner.Err()
+	return
+}
+
+// Command returns the remote command line that reads the script from stdin and runs it with bash,
+// with the variables ("KEY=VALUE") in its environment and the arguments as script arguments.
+func Command(args, vars []string, sudo bool) (string, error) {
+	parts := make([]string, 0)
+	if sudo {
+		parts = append(parts, "sudo", "-n")
+	}
+
+	if len(vars) > 0 {
+		parts = append(parts, "env")
+		for _, v := range vars {
+			key, _, ok := strings.Cut(v, "=")
+			if !ok || !validVarName.MatchString(key) {
+				return "", fmt.Errorf("invalid variable %q, expected KEY=VALUE", v)
+			}
+			parts = append(parts, generator.Quote(v))
+		}
+	}
+
+	parts = append(parts, "bash", "-s", "--")
+	for _, arg := range args {
+		parts = append(parts, generator.Quote(arg))
+	}
+
+	return strings.Join(parts, " "), nil
+}
+
+// Run streams the script to every host and returns the results in the order of hosts.
+// Hosts that are not started yet when the context is canceled fail with the context error.
+func (runner *Runner) Run(ctx context.Context, hosts []Host, script []byte, args, vars []string) ([]Result, error) {
+	command, err := Command(args, vars, runner.Sudo)
+	if err != nil {
+		return nil, err
+	}
+
+	concurrency := max(runner.Concurrency, 1)
+	results := make([]Result, len(hosts))
+	slots := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				results[i] = Result{Host: host.Name, ExitCode: -1, Error: ctx.Err().Error()}
+				return
+			}
+
+			results[i] = runner.runHost(ctx, host, command, script)
+		}()
+	}
+	wg.Wait()
+
+	return results, nil
+}
+
+// runHost runs the command on a single host with the script as its stdin.
+func (runner *Runner) runHost(ctx context.Context, host Host, command string, script []byte) (result Result) {
+	logger := runner.Log.WithOptions(zap.Fields(
+		zap.String("host", host.Name),
+	))
+	logger.Debug("attempt to run script")
+
+	started := time.Now()
+	result = Result{
+		Host:     host.Name,
+		ExitCode: -1,
+	}
+	output := new(lockedBuffer)
+
+	defer func() {
+		result.Output = output.String()
+		result.Duration = time.Since(started).Round(time.Millisecond)
+
+		logger.Info("host is done",
+			zap.Int("exitCode", result.ExitCode),
+			zap.String("error", result.Error),
+			zap.Duration("duration", result.Duration),
+		)
+	}()
+
+	if runner.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, runner.Timeout)
+		defer cancel()
+	}
+
+	config := *runner.Config
+	config.User = host.User
+
+	dialer := net.Dialer{Timeout: config.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", host.Addr)
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+
+	// closing the connection aborts the handshake and the session when the context ends
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, host.Addr, &config)
+	if err != nil {
+		conn.Close()
+		result.Error = contextError(ctx, err).Error()
+		return
+	}
+	client := ssh.NewClient(sshConn, chans, reqs)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		result.Error = contextError(ctx, err).Error()
+		return
+	}
+	defer session.Close()
+
+	session.Stdin = bytes.NewReader(script)
+	session.Stdout = output
+	session.Stderr = output
+
+	err = session.Run(command)
+
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+		result.ExitCode = 0
+	case errors.As(err, &exitErr) && exitErr.Signal() == "":
+		result.ExitCode = exitErr.ExitStatus()
+	default:
+		result.Error = contextError(ctx, err).Error()
+	}
+
+	return
+}
+
+// contextError prefers the context error over the network error it caused.
+func contextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+// lockedBuffer is a buffer that stdout and stderr of a session can write to at the same time.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
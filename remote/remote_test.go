@@ -0,0 +1,188 @@
+package remote
+
+import (
+	"context"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"patchfiles/internal/sshtest"
+
+	"go.uber.org/zap"
+)
+
+func TestParseHosts(t *testing.T) {
+	hosts, err := ParseHosts(strings.NewReader(`
+# web servers
+web1
+admin@web2:2222
+
+[::1]:2200
+db1.example.com
+`), "root", 22)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Host{
+		{Name: "web1", User: "root", Addr: "web1:22"},
+		{Name: "admin@web2:2222", User: "admin", Addr: "web2:2222"},
+		{Name: "[::1]:2200", User: "root", Addr: "[::1]:2200"},
+		{Name: "db1.example.com", User: "root", Addr: "db1.example.com:22"},
+	}
+	if len(hosts) != len(want) {
+		t.Fatalf("got %d hosts, want %d: %v", len(hosts), len(want), hosts)
+	}
+	for i := range want {
+		if hosts[i] != want[i] {
+			t.Errorf("host %d = %+v, want %+v", i, hosts[i], want[i])
+		}
+	}
+
+	if _, err := ParseHosts(strings.NewReader("web1:http\n"), "root", 22); err == nil {
+		t.Error("accepted an invalid port")
+	}
+}
+
+func TestCommand(t *testing.T) {
+	got, err := Command([]string{"all"}, []string{"PATCHFILES_ROOT=/tmp/it's"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `sudo -n env 'PATCHFILES_ROOT=/tmp/it'\''s' bash -s -- 'all'`
+	if got != want {
+		t.Errorf("Command() = %s, want %s", got, want)
+	}
+
+	if _, err := Command(nil, []string{"1FOO=bar"}, false); err == nil {
+		t.Error("accepted an invalid variable name")
+	}
+}
+
+func TestClientConfigClosesAgent(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	t.Setenv("SSH_AUTH_SOCK", socket)
+
+	_, closeAgent, err := ClientConfig(AuthOptions{InsecureHosts: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	closeAgent()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Errorf("the agent connection is still open: %v", err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not available")
+	}
+
+	server := sshtest.New(t)
+	config, closeAgent, err := ClientConfig(AuthOptions{
+		Identities:    []string{server.Identity},
+		InsecureHosts: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeAgent()
+
+	// a port that refuses connections stands in for an unreachable host
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := listener.Addr().String()
+	listener.Close()
+
+	hosts := []Host{
+		{Name: "one", User: "alice", Addr: server.Addr},
+		{Name: "two", User: "bob", Addr: server.Addr},
+		{Name: "three", User: "carol", Addr: server.Addr},
+		{Name: "down", User: "dave", Addr: closed},
+	}
+
+	script := []byte(`echo "selector=$1 greeting=$GREETING"
+echo "to stderr" >&2
+sleep 0.2
+[[ "$GREETING" == "hi there" ]] || exit 3
+`)
+
+	runner := Runner{
+		Log:         zap.NewNop(),
+		Config:      config,
+		Concurrency: 2,
+		Timeout:     10 * time.Second,
+	}
+	results, err := runner.Run(t.Context(), hosts, script, []string{"all"}, []string{"GREETING=hi there"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range results[:3] {
+		if r.Failed() || !strings.Contains(r.Output, "selector=all greeting=hi there\n") || !strings.Contains(r.Output, "to stderr") {
+			t.Errorf("%s: unexpected result %+v", r.Host, r)
+		}
+	}
+	if down := results[3]; !down.Failed() || down.ExitCode != -1 || down.Error == "" {
+		t.Errorf("unreachable host did not fail: %+v", down)
+	}
+
+	if n := server.MaxSessions(); n > 2 {
+		t.Errorf("%d sessions ran at the same time, want at most 2", n)
+	}
+	if users := server.Users(); len(users) != 3 {
+		t.Errorf("logged in users = %v", users)
+	}
+
+	// the exit code of the script is reported per host
+	results, _ = runner.Run(t.Context(), hosts[:1], script, nil, nil)
+	if results[0].ExitCode != 3 || results[0].Error != "" {
+		t.Errorf("failing script: %+v", results[0])
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not available")
+	}
+
+	server := sshtest.New(t)
+	config, closeAgent, err := ClientConfig(AuthOptions{
+		Identities:    []string{server.Identity},
+		InsecureHosts: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeAgent()
+
+	runner := Runner{
+		Log:     zap.NewNop(),
+		Config:  config,
+		Timeout: 200 * time.Millisecond,
+	}
+	hosts := []Host{{Name: "slow", User: "root", Addr: server.Addr}}
+	results, _ := runner.Run(t.Context(), hosts, []byte("sleep 5\n"), nil, nil)
+
+	if results[0].Error != context.DeadlineExceeded.Error() || results[0].Duration > 2*time.Second {
+		t.Errorf("slow host did not time out: %+v", results[0])
+	}
+}
@@ -0,0 +1,210 @@
+package textdiff
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrMismatch is returned when a hunk does not match the text it is applied to.
+	ErrMismatch = errors.New("hunk does not match")
+	// hunkHeader matches the header of a hunk and captures the start and length of both sides.
+	hunkHeader = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+)
+
+// hunk is a parsed hunk of a unified diff.
+type hunk struct {
+	header   string   // Header line, used in errors
+	oldStart int      // 0-based line of the old text the hunk starts at
+	newStart int      // 0-based line of the new text the hunk starts at
+	old      []string // Unchanged and removed lines, as found in the old text
+	new      []string // Unchanged and added lines, as written to the new text
+}
+
+// Check parses a unified diff and returns an error when it is malformed or has no hunks.
+func Check(diff string) error {
+	_, err := parse(diff)
+	return err
+}
+
+// Apply applies a unified diff to text like patch(1) with no fuzz: the unchanged and removed lines
+// of every hunk must match exactly, at the line in the hunk header or at an offset from it. The
+// file names in the diff are ignored. A hunk that does not match fails with ErrMismatch and nothing
+// is applied.
+func Apply(text, diff string) (string, error) {
+	return apply(text, diff, false)
+}
+
+// Revert applies a unified diff in reverse, like patch -R, turning the new text back into the old.
+func Revert(text, diff string) (string, error) {
+	return apply(text, diff, true)
+}
+
+// apply applies the hunks of a diff in order, or with both sides swapped when reverse is set.
+func apply(text, diff string, reverse bool) (string, error) {
+	hunks, err := parse(diff)
+	if err != nil {
+		return "", err
+	}
+
+	lines := splitLines(text)
+	out := make([]string, 0, len(lines))
+	pos := 0
+	for i, h := range hunks {
+		start, from, to := h.oldStart, h.old, h.new
+		if reverse {
+			start, from, to = h.newStart, h.new, h.old
+		}
+
+		at, ok := find(lines, from, start, pos)
+		if !ok {
+			return "", fmt.Errorf("hunk #%d %s: %w", i+1, h.header, ErrMismatch)
+		}
+
+		out = append(out, lines[pos:at]...)
+		out = append(out, to...)
+		pos = at + len(from)
+	}
+	out = append(out, lines[pos:]...)
+
+	return joinLines(out), nil
+}
+
+// find returns the line where want matches lines, searching outward from start but not before
+// floor, the end of the previous hunk.
+func find(lines, want []string, start, floor int) (int, bool) {
+	matches := func(at int) bool {
+		if at < floor || at+len(want) > len(lines) {
+			return false
+		}
+		for k, line := range want {
+			if lines[at+k] != line {
+				return false
+			}
+		}
+		return true
+	}
+
+	for offset := 0; start-offset >= floor || start+offset <= len(lines); offset++ {
+		if matches(start + offset) {
+			return start + offset, true
+		}
+		if offset > 0 && matches(start-offset) {
+			return start - offset, true
+		}
+	}
+
+	return 0, false
+}
+
+// parse returns the hunks of a unified diff of a single file. Lines before the first hunk, like
+// the file headers, are skipped. An empty line inside a hunk is an unchanged empty line, as some
+// editors strip the leading space.
+func parse(diff string) (hunks []hunk, err error) {
+	lines := strings.Split(strings.TrimSuffix(diff, "\n"), "\n")
+
+	for i := 0; i < len(lines); i++ {
+		match := hunkHeader.FindStringSubmatch(lines[i])
+		switch {
+		case match == nil && len(hunks) == 0:
+			continue
+		case match == nil && strings.HasPrefix(lines[i], "--- "):
+			return nil, fmt.Errorf("line %d: the diff changes more than one file", i+1)
+		case match == nil:
+			return nil, fmt.Errorf("line %d: unexpected %q after hunk %s", i+1, lines[i], hunks[len(hunks)-1].header)
+		}
+
+		h := hunk{header: match[0]}
+		oldLen, newLen := length(match[2]), length(match[4])
+		h.oldStart = start(match[1], oldLen)
+		h.newStart = start(match[3], newLen)
+
+		// kind of the last line, a following "\ No newline at end of file" applies to its side
+		last := byte(0)
+		for oldLen > 0 || newLen > 0 || (i+1 < len(lines) && strings.HasPrefix(lines[i+1], `\`)) {
+			i++
+			if i >= len(lines) {
+				return nil, fmt.Errorf("hunk %s is cut short", h.header)
+			}
+
+			line := lines[i]
+			if line == "" {
+				line = " "
+			}
+			kind, content := line[0], line[1:]
+
+			switch {
+			case kind == '\\' && last == 0:
+				return nil, fmt.Errorf("line %d: %q does not follow a line", i+1, lines[i])
+			case kind == '\\':
+				if last == ' ' || last == '-' {
+					h.old[len(h.old)-1] += noEOLMark
+				}
+				if last == ' ' || last == '+' {
+					h.new[len(h.new)-1] += noEOLMark
+				}
+				continue
+			case kind == ' ' && oldLen > 0 && newLen > 0:
+				h.old = append(h.old, content)
+				h.new = append(h.new, content)
+				oldLen--
+				newLen--
+			case kind == '-' && oldLen > 0:
+				h.old = append(h.old, content)
+				oldLen--
+			case kind == '+' && newLen > 0:
+				h.new = append(h.new, content)
+				newLen--
+			default:
+				return nil, fmt.Errorf("line %d: %q does not fit hunk %s", i+1, lines[i], h.header)
+			}
+			last = kind
+		}
+
+		hunks = append(hunks, h)
+	}
+
+	if len(hunks) == 0 {
+		return nil, errors.New("no hunks found, the body must be a unified diff")
+	}
+
+	return
+}
+
+// length returns the length of a hunk side, 1 when the header leaves it out.
+func length(s string) int {
+	if s == "" {
+		return 1
+	}
+
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// start returns the 0-based first line of a hunk side. An empty side names the line after which
+// lines are inserted, which is also the 0-based index of the insertion point.
+func start(s string, length int) int {
+	n, _ := strconv.Atoi(s)
+	if length == 0 {
+		return n
+	}
+
+	return n - 1
+}
+
+// joinLines joins lines split by splitLines back into text.
+func joinLines(lines []string) string {
+	var out strings.Builder
+	for _, line := range lines {
+		line, noEOL := strings.CutSuffix(line, noEOLMark)
+		out.WriteString(line)
+		if !noEOL {
+			out.WriteString("\n")
+		}
+	}
+
+	return out.String()
+}
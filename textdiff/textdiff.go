@@ -0,0 +1,152 @@
+// Package textdiff produces line based unified diffs of text files.
+package textdiff
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// contextLines is the number of unchanged lines shown around each change.
+	contextLines = 3
+	// noEOLMark is appended internally to a last line that has no trailing newline.
+	noEOLMark = "\x00"
+)
+
+// op is a single line of an edit script.
+type op struct {
+	kind byte   // ' ' for an unchanged line, '-' for a removed line, '+' for an added line
+	line string // line content without the trailing newline
+	a, b int    // index of the line in the old and new text before this op
+}
+
+// Unified returns the unified diff that turns old into new, with oldName and newName in the
+// file header lines. It returns an empty string when both texts are equal.
+func Unified(oldName, newName, old, new string) string {
+	if old == new {
+		return ""
+	}
+
+	a := splitLines(old)
+	b := splitLines(new)
+	ops := editScript(a, b)
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", oldName, newName)
+
+	for _, hunk := range hunks(ops) {
+		first := hunk[0]
+		aLen, bLen := 0, 0
+		for _, o := range hunk {
+			if o.kind != '+' {
+				aLen++
+			}
+			if o.kind != '-' {
+				bLen++
+			}
+		}
+
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(first.a, aLen), hunkRange(first.b, bLen))
+		for _, o := range hunk {
+			line, noEOL := strings.CutSuffix(o.line, noEOLMark)
+			fmt.Fprintf(&out, "%c%s\n", o.kind, line)
+
+			// mark a last line without newline the way diff(1) does
+			if noEOL {
+				out.WriteString("\\ No newline at end of file\n")
+			}
+		}
+	}
+
+	return out.String()
+}
+
+// splitLines splits text into lines without their newlines. A last line without newline gets
+// noEOLMark appended, so it differs from the same line with a newline.
+func splitLines(text string) (lines []string) {
+	if text == "" {
+		return nil
+	}
+
+	lines = strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	if !strings.HasSuffix(text, "\n") {
+		lines[len(lines)-1] += noEOLMark
+	}
+
+	return
+}
+
+// editScript returns the shortest sequence of unchanged, removed and added lines turning a into b,
+// computed from the longest common subsequence table.
+func editScript(a, b []string) (ops []op) {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, op{kind: ' ', line: a[i], a: i, b: j})
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] > lcs[i+1][j]):
+			ops = append(ops, op{kind: '+', line: b[j], a: i, b: j})
+			j++
+		default:
+			ops = append(ops, op{kind: '-', line: a[i], a: i, b: j})
+			i++
+		}
+	}
+
+	return
+}
+
+// hunks groups the ops into hunks of changes with up to contextLines unchanged lines around them.
+// Changes closer than twice the context are merged into one hunk.
+func hunks(ops []op) (out [][]op) {
+	start, end := -1, -1
+	for k, o := range ops {
+		if o.kind == ' ' {
+			continue
+		}
+
+		from := max(k-contextLines, 0)
+		if start >= 0 && from > end {
+			out = append(out, ops[start:end])
+			start = -1
+		}
+		if start < 0 {
+			start = from
+		}
+		end = min(k+contextLines+1, len(ops))
+	}
+	if start >= 0 {
+		out = append(out, ops[start:end])
+	}
+
+	return
+}
+
+// hunkRange formats the start and length of a hunk side, using 1-based line numbers.
+func hunkRange(start, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if length == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
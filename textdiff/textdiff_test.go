@@ -0,0 +1,183 @@
+package textdiff
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnified(t *testing.T) {
+	cases := []struct {
+		name string
+		old  string
+		new  string
+		want string
+	}{
+		{
+			name: "equal",
+			old:  "a\nb\n",
+			new:  "a\nb\n",
+			want: "",
+		},
+		{
+			name: "change",
+			old:  "1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			new:  "1\n2\n3\n4\nfive\n6\n7\n8\n9\n",
+			want: "--- a\n+++ b\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+		},
+		{
+			name: "create",
+			old:  "",
+			new:  "x\ny\n",
+			want: "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+x\n+y\n",
+		},
+		{
+			name: "append without newline at end",
+			old:  "a",
+			new:  "a\nb\n",
+			want: "--- a\n+++ b\n@@ -1 +1,2 @@\n-a\n\\ No newline at end of file\n+a\n+b\n",
+		},
+		{
+			name: "two hunks",
+			old:  "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			new:  "one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve\n",
+			want: "--- a\n+++ b\n@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n+twelve\n",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := Unified("a", "b", c.old, c.new)
+			if got != c.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, c.want)
+			}
+		})
+	}
+}
+
+// TestUnifiedAppliesWithPatch checks that patch(1) accepts the output.
+func TestUnifiedAppliesWithPatch(t *testing.T) {
+	if _, err := exec.LookPath("patch"); err != nil {
+		t.Skip("patch is not available")
+	}
+
+	old := "kernel.sysrq = 0\nvm.swappiness = 60\n\n# tail\nfs.file-max = 1\n"
+	new := "kernel.sysrq = 0\nvm.swappiness = 1\nvm.dirty_ratio = 30\n\n# tail\n"
+
+	dir := t.TempDir()
+	target := filepath.Join(dir, "sysctl.conf")
+	os.WriteFile(target, []byte(old), 0o644)
+
+	cmd := exec.Command("patch", "-s", target)
+	cmd.Stdin = strings.NewReader(Unified("sysctl.conf", "sysctl.conf", old, new))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("patch failed: %v\n%s", err, out)
+	}
+
+	got, _ := os.ReadFile(target)
+	if string(got) != new {
+		t.Errorf("patched file:\n%s\nwant:\n%s", got, new)
+	}
+}
+
+func TestApplyAndRevert(t *testing.T) {
+	cases := []struct {
+		name string
+		old  string
+		new  string
+	}{
+		{name: "change", old: "1\n2\n3\n4\n5\n6\n7\n8\n9\n", new: "1\n2\n3\n4\nfive\n6\n7\n8\n9\n"},
+		{name: "create", old: "", new: "x\ny\n"},
+		{name: "newline at end", old: "a", new: "a\nb\n"},
+		{name: "remove newline at end", old: "a\nb\n", new: "a\nb"},
+		{name: "two hunks", old: "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n", new: "one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve\n"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			diff := Unified("a", "b", c.old, c.new)
+
+			got, err := Apply(c.old, diff)
+			if err != nil || got != c.new {
+				t.Errorf("apply: %q, %v, want %q", got, err, c.new)
+			}
+
+			got, err = Revert(c.new, diff)
+			if err != nil || got != c.old {
+				t.Errorf("revert: %q, %v, want %q", got, err, c.old)
+			}
+		})
+	}
+}
+
+func TestApplyOffsetAndMismatch(t *testing.T) {
+	diff := "--- a/sshd_config\n+++ b/sshd_config\n@@ -2,3 +2,3 @@\n Port 22\n-PermitRootLogin yes\n+PermitRootLogin no\n \n"
+
+	// two lines added in front move the hunk, it still applies
+	got, err := Apply("# a\n# b\n# c\nPort 22\nPermitRootLogin yes\n\nX11Forwarding no\n", diff)
+	if err != nil || got != "# a\n# b\n# c\nPort 22\nPermitRootLogin no\n\nX11Forwarding no\n" {
+		t.Errorf("apply with offset: %q, %v", got, err)
+	}
+
+	if _, err := Apply("# a\nPort 2222\nPermitRootLogin yes\n\n", diff); !errors.Is(err, ErrMismatch) {
+		t.Errorf("apply to a changed file: %v, want ErrMismatch", err)
+	}
+
+	// applied already, the reverse matches and the forward does not
+	if _, err := Apply(got, diff); !errors.Is(err, ErrMismatch) {
+		t.Errorf("apply twice: %v, want ErrMismatch", err)
+	}
+	if _, err := Revert(got, diff); err != nil {
+		t.Errorf("revert: %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	for diff, want := range map[string]string{
+		"@@ -1 +1 @@\n-a\n+b\n":                                    "",
+		"--- a\n+++ b\n@@ -1,2 +1,2 @@\n a\n-b\n+c\n":              "",
+		"just text\n":                                              "no hunks",
+		"@@ -1,2 +1,2 @@\n-a\n+b\n":                                "cut short",
+		"@@ -1 +1 @@\n-a\n+b\ntrailing\n":                          "unexpected",
+		"@@ -1 +1 @@\n-a\n+b\n--- c\n+++ c\n@@ -1 +1 @@\n-a\n+b\n": "more than one file",
+	} {
+		err := Check(diff)
+		if (err == nil) != (want == "") || (err != nil && !strings.Contains(err.Error(), want)) {
+			t.Errorf("%q: %v, want %q", diff, err, want)
+		}
+	}
+}
+
+// TestApplyMatchesPatch checks that Apply and Revert give the same result as patch(1).
+func TestApplyMatchesPatch(t *testing.T) {
+	if _, err := exec.LookPath("patch"); err != nil {
+		t.Skip("patch is not available")
+	}
+
+	old := "kernel.sysrq = 0\nvm.swappiness = 60\n\n# tail\nfs.file-max = 1"
+	diff := Unified("sysctl.conf", "sysctl.conf", old, "# head\nkernel.sysrq = 0\nvm.swappiness = 1\n\n# tail\nfs.file-max = 2\n")
+
+	target := filepath.Join(t.TempDir(), "sysctl.conf")
+	os.WriteFile(target, []byte(old), 0o644)
+	for _, args := range [][]string{{"-s"}, {"-s", "-R"}} {
+		before, _ := os.ReadFile(target)
+
+		cmd := exec.Command("patch", append(args, target)...)
+		cmd.Stdin = strings.NewReader(diff)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("patch %v failed: %v\n%s", args, err, out)
+		}
+		after, _ := os.ReadFile(target)
+
+		want, err := Apply(string(before), diff)
+		if len(args) > 1 {
+			want, err = Revert(string(before), diff)
+		}
+		if err != nil || want != string(after) {
+			t.Errorf("patch %v gives %q, built-in gives %q, %v", args, after, want, err)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// Package values checks and compiles the expressions of patch values. A value is an integer
+// computed on the host from facts like the total memory or the number of CPUs, clamped to a
+// minimum and maximum, and used in a patch body as %{name}. Expressions are compiled to bash
+// arithmetic, so the generated scripts compute them without any helper.
+package values
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Fact is a property of the host that value expressions can use by name.
+type Fact struct {
+	Name        string // Name used in expressions, e.g. "mem_gb"
+	Description string // What the fact is and how it is read
+}
+
+var (
+	// Facts are the host facts the scripts read before computing values.
+	Facts = []Fact{
+		{"mem_kb", "total memory in kB, MemTotal of /proc/meminfo"},
+		{"mem_mb", "total memory in MB, rounded down"},
+		{"mem_gb", "total memory in GB, rounded up, at least 1"},
+		{"cpus", "number of CPUs in /proc/cpuinfo, at least 1"},
+		{"nic_speed", "highest speed of the physical network interfaces in Mbit/s, 0 when unknown"},
+		{"disk_rotational", "1 when a disk is rotational, otherwise 0"},
+		{"disk_nvme", "1 when an NVMe disk is present, otherwise 0"},
+	}
+
+	// ErrSyntax is returned for expressions that are not valid.
+	ErrSyntax = errors.New("syntax error")
+
+	// validName matches names of values and facts.
+	validName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+	// placeholder matches a use of a value in a body, e.g. "%{conntrack_max}".
+	placeholder = regexp.MustCompile(`%\{([a-z][a-z0-9_]*)\}`)
+	// operators are the operators of expressions, longest first so "<=" wins over "<".
+	operators = []string{"&&", "||", "==", "!=", "<=", ">=", "+", "-", "*", "/", "%", "<", ">", "!", "?", ":", "(", ")"}
+	// binary are the binary operators by precedence, lowest first, like in bash arithmetic.
+	binary = [][]string{{"||"}, {"&&"}, {"==", "!="}, {"<", "<=", ">", ">="}, {"+", "-"}, {"*", "/", "%"}}
+)
+
+// IsFact reports whether name is the name of a fact.
+func IsFact(name string) bool {
+	return slices.ContainsFunc(Facts, func(f Fact) bool { return f.Name == name })
+}
+
+// ValidName reports whether name can be used as the name of a value.
+func ValidName(name string) bool {
+	return validName.MatchString(name)
+}
+
+// Variable returns the bash variable holding a fact or value, e.g. PF_FACT_mem_gb.
+func Variable(name string) string {
+	if IsFact(name) {
+		return "PF_FACT_" + name
+	}
+
+	return "PF_VALUE_" + name
+}
+
+// Check checks an expression, which may use the facts and the values in known. Expressions are
+// integer arithmetic like in bash: decimal numbers, names, parentheses, the unary operators
+// - + !, the binary operators * / % + - < <= > >= == != && || and the conditional a ? b : c.
+func Check(expr string, known []string) error {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		if validName.MatchString(token) && !IsFact(token) && !slices.Contains(known, token) {
+			return fmt.Errorf("unknown name %q", token)
+		}
+	}
+
+	p := exprParser{tokens: tokens}
+	err = p.conditional()
+	if err == nil && p.pos < len(tokens) {
+		err = fmt.Errorf("%w: unexpected %q", ErrSyntax, tokens[p.pos])
+	}
+
+	return err
+}
+
+// Compile returns a checked expression as bash arithmetic, with names replaced by their
+// variables, e.g. "PF_FACT_mem_gb * 65536" for "mem_gb*65536".
+func Compile(expr string) string {
+	tokens, _ := tokenize(expr)
+	for i, token := range tokens {
+		if validName.MatchString(token) {
+			tokens[i] = Variable(token)
+		}
+	}
+
+	return strings.Join(tokens, " ")
+}
+
+// Names returns the names of the placeholders in text, in order and without duplicates.
+func Names(text string) (names []string) {
+	for _, match := range placeholder.FindAllStringSubmatch(text, -1) {
+		if !slices.Contains(names, match[1]) {
+			names = append(names, match[1])
+		}
+	}
+
+	return
+}
+
+// Render replaces the placeholders of the values in text by the values. Placeholders of other
+// names are kept, like the pf_render function of the patch script.
+func Render(text string, values map[string]string) string {
+	return placeholder.ReplaceAllStringFunc(text, func(match string) string {
+		if value, ok := values[match[2:len(match)-1]]; ok {
+			return value
+		}
+		return match
+	})
+}
+
+// tokenize splits an expression into numbers, names and operators.
+func tokenize(expr string) (tokens []string, err error) {
+	for i := 0; i < len(expr); {
+		c := expr[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+			continue
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(expr) && expr[j] >= '0' && expr[j] <= '9' {
+				j++
+			}
+			// bash reads numbers with a leading zero as octal
+			if c == '0' && j-i > 1 {
+				return nil, fmt.Errorf("%w: number %q has a leading zero", ErrSyntax, expr[i:j])
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+			continue
+		case c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_':
+			j := i
+			for j < len(expr) && (expr[j] >= 'a' && expr[j] <= 'z' || expr[j] >= 'A' && expr[j] <= 'Z' || expr[j] >= '0' && expr[j] <= '9' || expr[j] == '_') {
+				j++
+			}
+			if !validName.MatchString(expr[i:j]) {
+				return nil, fmt.Errorf("%w: name %q must be lower case", ErrSyntax, expr[i:j])
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+			continue
+		}
+
+		found := false
+		for _, op := range operators {
+			if strings.HasPrefix(expr[i:], op) {
+				tokens = append(tokens, op)
+				i += len(op)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: unexpected %q", ErrSyntax, expr[i:i+1])
+		}
+	}
+
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%w: empty expression", ErrSyntax)
+	}
+
+	return
+}
+
+// exprParser checks the grammar of a tokenized expression by recursive descent.
+type exprParser struct {
+	tokens []string
+	pos    int
+}
+
+// next returns the current token, or an empty string at the end.
+func (p *exprParser) next() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+
+	return ""
+}
+
+// conditional parses a ? b : c, which binds weakest.
+func (p *exprParser) conditional() error {
+	if err := p.binary(0); err != nil {
+		return err
+	}
+	if p.next() != "?" {
+		return nil
+	}
+
+	p.pos++
+	if err := p.conditional(); err != nil {
+		return err
+	}
+	if p.next() != ":" {
+		return fmt.Errorf("%w: missing ':' of '?'", ErrSyntax)
+	}
+	p.pos++
+
+	return p.conditional()
+}
+
+// binary parses the binary operators of precedence level and higher.
+func (p *exprParser) binary(level int) error {
+	if level == len(binary) {
+		return p.unary()
+	}
+
+	if err := p.binary(level + 1); err != nil {
+		return err
+	}
+	for slices.Contains(binary[level], p.next()) {
+		p.pos++
+		if err := p.binary(level + 1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unary parses unary operators, numbers, names and parentheses.
+func (p *exprParser) unary() error {
+	token := p.next()
+	p.pos++
+
+	switch {
+	case token == "-" || token == "+" || token == "!":
+		return p.unary()
+	case token == "(":
+		if err := p.conditional(); err != nil {
+			return err
+		}
+		if p.next() != ")" {
+			return fmt.Errorf("%w: missing ')'", ErrSyntax)
+		}
+		p.pos++
+		return nil
+	case token == "":
+		return fmt.Errorf("%w: unexpected end", ErrSyntax)
+	case token[0] >= '0' && token[0] <= '9' || validName.MatchString(token):
+		return nil
+	}
+
+	return fmt.Errorf("%w: unexpected %q", ErrSyntax, token)
+}
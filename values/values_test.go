@@ -0,0 +1,71 @@
+package values
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	valid := []string{
+		"mem_gb * 65536",
+		"cpus > 4 ? cpus - 1 : 1",
+		"-(mem_mb / 2) + !disk_rotational",
+		"nic_speed >= 10000 && disk_nvme || base % 3 == 0",
+		"a ? b ? 1 : 2 : 3",
+		"0",
+	}
+	for _, expr := range valid {
+		if err := Check(expr, []string{"base", "a", "b"}); err != nil {
+			t.Errorf("Check(%q) = %v", expr, err)
+		}
+	}
+
+	invalid := []struct {
+		expr string
+		want string
+	}{
+		{"", "empty expression"},
+		{"mem_gb *", "unexpected end"},
+		{"(mem_gb", "missing ')'"},
+		{"cpus ? 1", "missing ':'"},
+		{"2 3", `unexpected "3"`},
+		{"mem_gb = 1", `unexpected "="`},
+		{"010", "leading zero"},
+		{"MemTotal", "must be lower case"},
+		{"ram * 2", `unknown name "ram"`},
+		{"$(reboot)", `unexpected "$"`},
+	}
+	for _, c := range invalid {
+		err := Check(c.expr, nil)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("Check(%q) = %v, want %q", c.expr, err, c.want)
+		}
+	}
+
+	if err := Check("1 +", nil); !errors.Is(err, ErrSyntax) {
+		t.Errorf("error %v is not ErrSyntax", err)
+	}
+}
+
+func TestCompile(t *testing.T) {
+	got := Compile("mem_gb*per_gb>=-1?cpus:0")
+	want := "PF_FACT_mem_gb * PF_VALUE_per_gb >= - 1 ? PF_FACT_cpus : 0"
+	if got != want {
+		t.Errorf("Compile() = %q, want %q", got, want)
+	}
+}
+
+func TestRender(t *testing.T) {
+	text := "max = %{conntrack_max}\nLogFormat \"%{Referer}i %{user}\"\nagain %{conntrack_max}\n"
+
+	if got := Names(text); strings.Join(got, ",") != "conntrack_max,user" {
+		t.Errorf("Names() = %v", got)
+	}
+
+	got := Render(text, map[string]string{"conntrack_max": "262144"})
+	want := "max = 262144\nLogFormat \"%{Referer}i %{user}\"\nagain 262144\n"
+	if got != want {
+		t.Errorf("Render() = %q, want %q", got, want)
+	}
+}